@@ -0,0 +1,418 @@
+// Package bolt11 decodes and encodes BOLT11 Lightning invoices.
+//
+// Only the fields the L402 flow cares about are exposed: network, amount,
+// payment hash, payment secret, description (hash), expiry and payee.
+// Unknown tagged fields are skipped as the spec requires.
+package bolt11
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+)
+
+type Network string
+
+const (
+	Mainnet Network = "mainnet"
+	Testnet Network = "testnet"
+	Signet  Network = "signet"
+	Regtest Network = "regtest"
+	Simnet  Network = "simnet"
+)
+
+// prefixes maps the BOLT11 currency prefix to its network. Longer prefixes
+// come first so "tbs" is not mistaken for "tb".
+var prefixes = []struct {
+	prefix  string
+	network Network
+}{
+	{"bcrt", Regtest},
+	{"tbs", Signet},
+	{"bc", Mainnet},
+	{"tb", Testnet},
+	{"sb", Simnet},
+}
+
+func (n Network) prefix() (string, error) {
+	for _, p := range prefixes {
+		if p.network == n {
+			return p.prefix, nil
+		}
+	}
+	return "", fmt.Errorf("unknown network %q", n)
+}
+
+// DefaultExpiry is used when an invoice does not carry an expiry field.
+const DefaultExpiry = time.Hour
+
+// DefaultMinFinalCLTVExpiry is used when an invoice does not carry a
+// min_final_cltv_expiry field.
+const DefaultMinFinalCLTVExpiry = 18
+
+const (
+	fieldPaymentHash     = 1
+	fieldRouting         = 3
+	fieldFeatures        = 5
+	fieldExpiry          = 6
+	fieldFallback        = 9
+	fieldDescription     = 13
+	fieldPaymentSecret   = 16
+	fieldPayee           = 19
+	fieldDescriptionHash = 23
+	fieldMinFinalCLTV    = 24
+	fieldMetadata        = 27
+)
+
+// uriScheme may prefix invoices, e.g. in QR codes.
+const uriScheme = "lightning:"
+
+// signatureLen is the length of the recoverable signature in 5-bit groups.
+const signatureLen = 104
+
+type Invoice struct {
+	// Network the invoice is payable on.
+	Network Network
+
+	// AmountMsat is the requested amount in millisatoshis. Zero means the
+	// invoice does not specify an amount.
+	AmountMsat int64
+
+	// Timestamp is the creation time of the invoice.
+	Timestamp time.Time
+
+	PaymentHash   [32]byte
+	PaymentSecret *[32]byte
+
+	// Only one of Description and DescriptionHash is normally set.
+	Description     *string
+	DescriptionHash *[32]byte
+
+	// Expiry is relative to Timestamp.
+	Expiry time.Duration
+
+	MinFinalCLTVExpiry uint64
+
+	// Payee is the compressed public key of the node that signed the
+	// invoice.
+	Payee []byte
+}
+
+// ExpiresAt returns the absolute expiry time of the invoice.
+func (inv *Invoice) ExpiresAt() time.Time {
+	return inv.Timestamp.Add(inv.Expiry)
+}
+
+// Expired reports whether the invoice is expired at the given time.
+func (inv *Invoice) Expired(now time.Time) bool {
+	return !now.Before(inv.ExpiresAt())
+}
+
+// Decode parses a BOLT11 invoice and verifies its signature.
+func Decode(invoice string) (*Invoice, error) {
+	invoice = strings.TrimSpace(invoice)
+	if len(invoice) > len(uriScheme) && strings.EqualFold(invoice[:len(uriScheme)], uriScheme) {
+		invoice = invoice[len(uriScheme):]
+	}
+
+	hrp, data, err := bech32Decode(invoice)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invoice encoding: %w", err)
+	}
+	if len(data) < 7+signatureLen {
+		return nil, errors.New("invoice too short")
+	}
+
+	inv := &Invoice{
+		Expiry:             DefaultExpiry,
+		MinFinalCLTVExpiry: DefaultMinFinalCLTVExpiry,
+	}
+	if err := parseHRP(hrp, inv); err != nil {
+		return nil, err
+	}
+
+	sigGroups := data[len(data)-signatureLen:]
+	data = data[:len(data)-signatureLen]
+
+	inv.Timestamp = time.Unix(int64(groupsToUint(data[:7])), 0).UTC()
+	if err := parseFields(data[7:], inv); err != nil {
+		return nil, err
+	}
+
+	sig, err := convertBits(sigGroups, 5, 8, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	payee, err := recoverPayee(hrp, data, sig)
+	if err != nil {
+		return nil, err
+	}
+	if inv.Payee != nil && string(inv.Payee) != string(payee) {
+		return nil, errors.New("signature does not match payee")
+	}
+	inv.Payee = payee
+
+	if inv.PaymentHash == ([32]byte{}) {
+		return nil, errors.New("invoice has no payment hash")
+	}
+
+	return inv, nil
+}
+
+func parseHRP(hrp string, inv *Invoice) error {
+	if !strings.HasPrefix(hrp, "ln") {
+		return fmt.Errorf("invalid invoice prefix %q", hrp)
+	}
+	rest := hrp[2:]
+
+	for _, p := range prefixes {
+		if !strings.HasPrefix(rest, p.prefix) {
+			continue
+		}
+		amount := rest[len(p.prefix):]
+		if amount != "" && (amount[0] < '0' || amount[0] > '9') {
+			continue
+		}
+		inv.Network = p.network
+		msat, err := parseAmount(amount)
+		if err != nil {
+			return err
+		}
+		inv.AmountMsat = msat
+		return nil
+	}
+
+	return fmt.Errorf("unknown invoice network in %q", hrp)
+}
+
+// msatPerUnit is the number of millisatoshis in one unit of each
+// multiplier, except pico which is a tenth of a millisatoshi.
+var msatPerUnit = map[byte]int64{
+	'm': 100_000_000,
+	'u': 100_000,
+	'n': 100,
+}
+
+func parseAmount(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	digits, mult := s[:len(s)-1], s[len(s)-1]
+	unit, ok := msatPerUnit[mult]
+	switch {
+	case mult >= '0' && mult <= '9':
+		digits, unit = s, 100_000_000_000
+	case mult == 'p':
+		unit = 1
+	case !ok:
+		return 0, fmt.Errorf("invalid amount multiplier %q", mult)
+	}
+
+	n, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %w", s, err)
+	}
+	if mult == 'p' {
+		if n%10 != 0 {
+			return 0, fmt.Errorf("invalid sub-millisatoshi amount %q", s)
+		}
+		n /= 10
+	}
+	if n > math.MaxInt64/uint64(unit) {
+		return 0, fmt.Errorf("invalid amount %q: too large", s)
+	}
+	return int64(n) * unit, nil
+}
+
+func formatAmount(msat int64) string {
+	if msat == 0 {
+		return ""
+	}
+	if msat%100_000_000_000 == 0 {
+		return strconv.FormatInt(msat/100_000_000_000, 10)
+	}
+	for _, m := range []byte{'m', 'u', 'n'} {
+		if msat%msatPerUnit[m] == 0 {
+			return strconv.FormatInt(msat/msatPerUnit[m], 10) + string(m)
+		}
+	}
+	return strconv.FormatInt(msat*10, 10) + "p"
+}
+
+func parseFields(data []byte, inv *Invoice) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return errors.New("truncated tagged field")
+		}
+		typ := data[0]
+		length := int(data[1])<<5 | int(data[2])
+		data = data[3:]
+		if len(data) < length {
+			return errors.New("truncated tagged field")
+		}
+		field := data[:length]
+		data = data[length:]
+
+		switch typ {
+		case fieldPaymentHash:
+			if length != 52 {
+				continue
+			}
+			b, err := convertBits(field, 5, 8, false)
+			if err != nil {
+				return fmt.Errorf("invalid payment hash: %w", err)
+			}
+			copy(inv.PaymentHash[:], b)
+
+		case fieldPaymentSecret:
+			if length != 52 {
+				continue
+			}
+			b, err := convertBits(field, 5, 8, false)
+			if err != nil {
+				return fmt.Errorf("invalid payment secret: %w", err)
+			}
+			var secret [32]byte
+			copy(secret[:], b)
+			inv.PaymentSecret = &secret
+
+		case fieldDescription:
+			b, err := convertBits(field, 5, 8, false)
+			if err != nil {
+				return fmt.Errorf("invalid description: %w", err)
+			}
+			desc := string(b)
+			inv.Description = &desc
+
+		case fieldDescriptionHash:
+			if length != 52 {
+				continue
+			}
+			b, err := convertBits(field, 5, 8, false)
+			if err != nil {
+				return fmt.Errorf("invalid description hash: %w", err)
+			}
+			var hash [32]byte
+			copy(hash[:], b)
+			inv.DescriptionHash = &hash
+
+		case fieldPayee:
+			if length != 53 {
+				continue
+			}
+			b, err := convertBits(field, 5, 8, false)
+			if err != nil {
+				return fmt.Errorf("invalid payee: %w", err)
+			}
+			inv.Payee = b
+
+		case fieldExpiry:
+			inv.Expiry = time.Duration(groupsToUint(field)) * time.Second
+
+		case fieldMinFinalCLTV:
+			inv.MinFinalCLTVExpiry = groupsToUint(field)
+		}
+	}
+	return nil
+}
+
+func signingHash(hrp string, data []byte) []byte {
+	b, _ := convertBits(data, 5, 8, true)
+	h := sha256.Sum256(append([]byte(hrp), b...))
+	return h[:]
+}
+
+func recoverPayee(hrp string, data, sig []byte) ([]byte, error) {
+	if len(sig) != 65 || sig[64] > 3 {
+		return nil, errors.New("invalid signature")
+	}
+
+	// btcec expects the bitcoin compact format: header byte first.
+	compact := make([]byte, 65)
+	compact[0] = 27 + 4 + sig[64]
+	copy(compact[1:], sig[:64])
+
+	pub, _, err := ecdsa.RecoverCompact(compact, signingHash(hrp, data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	return pub.SerializeCompressed(), nil
+}
+
+// Encode serializes and signs an invoice with the payee's key. The Payee
+// field is ignored; it is implied by the signature.
+func Encode(inv *Invoice, key *btcec.PrivateKey) (string, error) {
+	prefix, err := inv.Network.prefix()
+	if err != nil {
+		return "", err
+	}
+	if inv.AmountMsat < 0 {
+		return "", errors.New("negative amount")
+	}
+	hrp := "ln" + prefix + formatAmount(inv.AmountMsat)
+
+	data := uintToGroups(uint64(inv.Timestamp.Unix()), 7)
+	data = appendBytesField(data, fieldPaymentHash, inv.PaymentHash[:])
+	if inv.PaymentSecret != nil {
+		data = appendBytesField(data, fieldPaymentSecret, inv.PaymentSecret[:])
+	}
+	if inv.Description != nil {
+		data = appendBytesField(data, fieldDescription, []byte(*inv.Description))
+	}
+	if inv.DescriptionHash != nil {
+		data = appendBytesField(data, fieldDescriptionHash, inv.DescriptionHash[:])
+	}
+	if inv.Expiry != 0 && inv.Expiry != DefaultExpiry {
+		data = appendField(data, fieldExpiry, uintToGroups(uint64(inv.Expiry/time.Second), 0))
+	}
+	if inv.MinFinalCLTVExpiry != 0 && inv.MinFinalCLTVExpiry != DefaultMinFinalCLTVExpiry {
+		data = appendField(data, fieldMinFinalCLTV, uintToGroups(inv.MinFinalCLTVExpiry, 0))
+	}
+
+	compact := ecdsa.SignCompact(key, signingHash(hrp, data), true)
+	sig := make([]byte, 65)
+	copy(sig, compact[1:])
+	sig[64] = compact[0] - 27 - 4
+
+	sigGroups, _ := convertBits(sig, 8, 5, true)
+	return bech32Encode(hrp, append(data, sigGroups...)), nil
+}
+
+func appendBytesField(data []byte, typ byte, b []byte) []byte {
+	groups, _ := convertBits(b, 8, 5, true)
+	return appendField(data, typ, groups)
+}
+
+func appendField(data []byte, typ byte, groups []byte) []byte {
+	return append(append(data, typ, byte(len(groups)>>5), byte(len(groups)&31)), groups...)
+}
+
+func groupsToUint(groups []byte) uint64 {
+	var n uint64
+	for _, g := range groups {
+		n = n<<5 | uint64(g)
+	}
+	return n
+}
+
+// uintToGroups encodes n as big-endian 5-bit groups. A zero width uses the
+// minimal number of groups.
+func uintToGroups(n uint64, width int) []byte {
+	var groups []byte
+	for n > 0 {
+		groups = append([]byte{byte(n & 31)}, groups...)
+		n >>= 5
+	}
+	for len(groups) < width {
+		groups = append([]byte{0}, groups...)
+	}
+	return groups
+}
@@ -0,0 +1,313 @@
+package bolt11
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Test vectors from the examples of the BOLT11 specification. They are all
+// signed by the same node with the same payment hash and secret.
+const (
+	specPayee       = "03e7156ae33b0a208d0744199163177e909e80176e55d97a2f221ede0f934dd9ad"
+	specPaymentHash = "0001020304050607080900010203040506070809000102030405060708090102"
+	specSecret      = "1111111111111111111111111111111111111111111111111111111111111111"
+	specTimestamp   = 1496314658
+)
+
+var specVectors = []struct {
+	name            string
+	invoice         string
+	network         Network
+	amountMsat      int64
+	description     string
+	descriptionHash string
+	expiry          time.Duration
+}{
+	{
+		name:        "donation of any amount",
+		invoice:     "lnbc1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq9qrsgq357wnc5r2ueh7ck6q93dj32dlqnls087fxdwk8qakdyafkq3yap9us6v52vjjsrvywa6rt52cm9r9zqt8r2t7mlcwspyetp5h2tztugp9lfyql",
+		network:     Mainnet,
+		description: "Please consider supporting this project",
+		expiry:      DefaultExpiry,
+	},
+	{
+		name:        "coffee within one minute",
+		invoice:     "lnbc2500u1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpu9qrsgquk0rl77nj30yxdy8j9vdx85fkpmdla2087ne0xh8nhedh8w27kyke0lp53ut353s06fv3qfegext0eh0ymjpf39tuven09sam30g4vgpfna3rh",
+		network:     Mainnet,
+		amountMsat:  250_000_000,
+		description: "1 cup coffee",
+		expiry:      time.Minute,
+	},
+	{
+		name:        "utf-8 description",
+		invoice:     "lnbc2500u1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpquwpc4curk03c9wlrswe78q4eyqc7d8d0xqzpu9qrsgqhtjpauu9ur7fw2thcl4y9vfvh4m9wlfyz2gem29g5ghe2aak2pm3ps8fdhtceqsaagty2vph7utlgj48u0ged6a337aewvraedendscp573dxr",
+		network:     Mainnet,
+		amountMsat:  250_000_000,
+		description: "ナンセンス 1杯",
+		expiry:      time.Minute,
+	},
+	{
+		name:            "hashed description on testnet",
+		invoice:         "lntb20m1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygshp58yjmdan79s6qqdhdzgynm4zwqd5d7xmw5fk98klysy043l2ahrqspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqfpp3x9et2e20v6pu37c5d9vax37wxq72un989qrsgqdj545axuxtnfemtpwkc45hx9d2ft7x04mt8q7y6t0k2dge9e7h8kpy9p34ytyslj3yu569aalz2xdk8xkd7ltxqld94u8h2esmsmacgpghe9k8",
+		network:         Testnet,
+		amountMsat:      2_000_000_000,
+		descriptionHash: "3925b6f67e2c340036ed12093dd44e0368df1b6ea26c53dbe4811f58fd5db8c1",
+		expiry:          DefaultExpiry,
+	},
+}
+
+func TestDecodeSpecVectors(t *testing.T) {
+	for _, tt := range specVectors {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, err := Decode(tt.invoice)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if inv.Network != tt.network {
+				t.Errorf("network = %s, want %s", inv.Network, tt.network)
+			}
+			if inv.AmountMsat != tt.amountMsat {
+				t.Errorf("amount = %d msat, want %d", inv.AmountMsat, tt.amountMsat)
+			}
+			if got := inv.Timestamp.Unix(); got != specTimestamp {
+				t.Errorf("timestamp = %d, want %d", got, specTimestamp)
+			}
+			if got := hex.EncodeToString(inv.PaymentHash[:]); got != specPaymentHash {
+				t.Errorf("payment hash = %s, want %s", got, specPaymentHash)
+			}
+			if inv.PaymentSecret == nil || hex.EncodeToString(inv.PaymentSecret[:]) != specSecret {
+				t.Errorf("payment secret = %x, want %s", inv.PaymentSecret, specSecret)
+			}
+			if got := hex.EncodeToString(inv.Payee); got != specPayee {
+				t.Errorf("payee = %s, want %s", got, specPayee)
+			}
+			if inv.Expiry != tt.expiry {
+				t.Errorf("expiry = %s, want %s", inv.Expiry, tt.expiry)
+			}
+
+			switch {
+			case tt.description != "":
+				if inv.Description == nil || *inv.Description != tt.description {
+					t.Errorf("description = %v, want %q", inv.Description, tt.description)
+				}
+			case inv.Description != nil:
+				t.Errorf("unexpected description %q", *inv.Description)
+			}
+			switch {
+			case tt.descriptionHash != "":
+				if inv.DescriptionHash == nil || hex.EncodeToString(inv.DescriptionHash[:]) != tt.descriptionHash {
+					t.Errorf("description hash = %x, want %s", inv.DescriptionHash, tt.descriptionHash)
+				}
+			case inv.DescriptionHash != nil:
+				t.Errorf("unexpected description hash %x", *inv.DescriptionHash)
+			}
+		})
+	}
+}
+
+func TestDecodeAcceptsUppercaseAndURI(t *testing.T) {
+	invoice := specVectors[1].invoice
+	for _, s := range []string{
+		strings.ToUpper(invoice),
+		"lightning:" + invoice,
+		"LIGHTNING:" + strings.ToUpper(invoice),
+		" " + invoice + "\n",
+	} {
+		inv, err := Decode(s)
+		if err != nil {
+			t.Errorf("Decode(%.20q...): %v", s, err)
+			continue
+		}
+		if inv.AmountMsat != 250_000_000 {
+			t.Errorf("Decode(%.20q...): amount = %d msat", s, inv.AmountMsat)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	coffee := specVectors[1].invoice
+	tests := []struct {
+		name    string
+		invoice string
+		want    string
+	}{
+		{
+			name:    "bad checksum",
+			invoice: coffee[:len(coffee)-1] + "q",
+			want:    "checksum",
+		},
+		{
+			name:    "mixed case",
+			invoice: strings.ToUpper(coffee[:10]) + coffee[10:],
+			want:    "mixed case",
+		},
+		{
+			name:    "no separator",
+			invoice: "lnbc2500u",
+			want:    "separator",
+		},
+		{
+			name:    "invalid character",
+			invoice: coffee[:20] + "b" + coffee[21:],
+			want:    "character",
+		},
+		{
+			name:    "too short",
+			invoice: bech32Encode("lnbc", make([]byte, 10)),
+			want:    "too short",
+		},
+		{
+			name:    "unknown network",
+			invoice: bech32Encode("lnxy", make([]byte, 7+signatureLen)),
+			want:    "unknown invoice network",
+		},
+		{
+			name:    "not a lightning invoice",
+			invoice: bech32Encode("bc", make([]byte, 7+signatureLen)),
+			want:    "prefix",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.invoice)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Decode error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		amount string
+		msat   int64
+		err    bool
+	}{
+		{amount: "", msat: 0},
+		{amount: "1", msat: 100_000_000_000},
+		{amount: "20m", msat: 2_000_000_000},
+		{amount: "2500u", msat: 250_000_000},
+		{amount: "1n", msat: 100},
+		{amount: "10p", msat: 1},
+		{amount: "25000000000p", msat: 2_500_000_000},
+
+		// Sub-millisatoshi precision
+		{amount: "1p", err: true},
+		{amount: "2500000001p", err: true},
+		// Unknown multiplier
+		{amount: "2500x", err: true},
+		{amount: "m", err: true},
+		// Signs are not part of the grammar
+		{amount: "+1m", err: true},
+		{amount: "-1m", err: true},
+		// Overflows of int64 millisatoshis, with and without multiplier
+		{amount: "92233721", err: true},
+		{amount: "92233720368548m", err: true},
+		{amount: "92233720368547759u", err: true},
+		{amount: "18446744073709551616n", err: true},
+		{amount: "99999999999999999999p", err: true},
+		{amount: "92233720368547758", err: true},
+		// Large amounts that fit
+		{amount: "92233720", msat: 9_223_372_000_000_000_000},
+		{amount: "18446744073709551610p", msat: 1_844_674_407_370_955_161},
+	}
+	for _, tt := range tests {
+		msat, err := parseAmount(tt.amount)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseAmount(%q) = %d, want an error", tt.amount, msat)
+			}
+			continue
+		}
+		if err != nil || msat != tt.msat {
+			t.Errorf("parseAmount(%q) = %d, %v, want %d", tt.amount, msat, err, tt.msat)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := "l402 offer_0001"
+	secret := [32]byte{1, 2, 3}
+	want := &Invoice{
+		Network:            Signet,
+		AmountMsat:         123_456_789,
+		Timestamp:          time.Unix(1700000000, 0).UTC(),
+		PaymentHash:        [32]byte{9, 8, 7},
+		PaymentSecret:      &secret,
+		Description:        &desc,
+		Expiry:             10 * time.Minute,
+		MinFinalCLTVExpiry: 40,
+	}
+
+	invoice, err := Encode(want, key)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if !strings.HasPrefix(invoice, "lntbs1234567890p1") {
+		t.Errorf("invoice %s has an unexpected prefix", invoice)
+	}
+
+	got, err := Decode(invoice)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	switch {
+	case got.Network != want.Network,
+		got.AmountMsat != want.AmountMsat,
+		!got.Timestamp.Equal(want.Timestamp),
+		got.PaymentHash != want.PaymentHash,
+		got.PaymentSecret == nil || *got.PaymentSecret != secret,
+		got.Description == nil || *got.Description != desc,
+		got.Expiry != want.Expiry,
+		got.MinFinalCLTVExpiry != want.MinFinalCLTVExpiry:
+		t.Errorf("Decode(Encode(inv)) = %+v, want %+v", got, want)
+	}
+	if string(got.Payee) != string(key.PubKey().SerializeCompressed()) {
+		t.Errorf("payee = %x, want the signing key", got.Payee)
+	}
+}
+
+func TestDecodeRejectsTamperedSignature(t *testing.T) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoice, err := Encode(&Invoice{
+		Network:     Mainnet,
+		AmountMsat:  1000,
+		Timestamp:   time.Unix(1700000000, 0),
+		PaymentHash: [32]byte{1},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A payee field that doesn't match the signer must be rejected
+	inv, err := Decode(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hrp, data, err := bech32Decode(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := data[:len(data)-signatureLen]
+	fields = appendBytesField(fields, fieldPayee, other.PubKey().SerializeCompressed())
+	sigGroups := data[len(data)-signatureLen:]
+	forged := bech32Encode(hrp, append(append([]byte(nil), fields...), sigGroups...))
+	if _, err := Decode(forged); err == nil {
+		t.Errorf("Decode accepted a forged invoice of %x", inv.Payee)
+	}
+}
@@ -0,0 +1,180 @@
+// Package cardproc is a mock card processor. It charges tokenized cards and
+// supports the three scenarios a hosted card checkout has to handle:
+// immediate success, decline and a 3-D Secure challenge.
+package cardproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Test card tokens, each one triggers a scenario
+const (
+	TokenSuccess   = "tok_success"
+	TokenDecline   = "tok_decline"
+	TokenChallenge = "tok_challenge"
+)
+
+// ChallengeCode is the code that passes a simulated 3-D Secure challenge
+const ChallengeCode = "123456"
+
+// maxChallengeAttempts is how many wrong codes fail a charge
+const maxChallengeAttempts = 3
+
+type Status string
+
+const (
+	StatusSucceeded      Status = "succeeded"
+	StatusDeclined       Status = "declined"
+	StatusRequiresAction Status = "requires_action"
+	StatusFailed         Status = "failed"
+)
+
+var (
+	ErrChargeNotFound = errors.New("charge not found")
+	ErrNoChallenge    = errors.New("charge has no pending challenge")
+	ErrUnknownToken   = errors.New("unknown card token")
+	ErrNotRefundable  = errors.New("charge can't be refunded")
+)
+
+type Charge struct {
+	ID          string            `json:"id"`
+	Amount      int               `json:"amount"`
+	Currency    string            `json:"currency"`
+	Description string            `json:"description"`
+	Status      Status            `json:"status"`
+	DeclineCode string            `json:"decline_code,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+
+	// Part of the amount refunded so far
+	AmountRefunded int `json:"amount_refunded,omitempty"`
+
+	attempts int
+}
+
+// Refund gives part of a charge back to the card
+type Refund struct {
+	ID        string    `json:"id"`
+	ChargeID  string    `json:"charge_id"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Processor keeps charges in memory
+type Processor struct {
+	mu      sync.Mutex
+	charges map[string]*Charge
+}
+
+func New() *Processor {
+	return &Processor{
+		charges: make(map[string]*Charge),
+	}
+}
+
+// CreateCharge charges a tokenized card. Charges with a challenge token come
+// back as requires_action until CompleteChallenge is called.
+func (p *Processor) CreateCharge(ctx context.Context, token string, amount int, currency, description string, metadata map[string]string) (*Charge, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid amount %d", amount)
+	}
+
+	c := &Charge{
+		ID:          "ch_" + uuid.New().String(),
+		Amount:      amount,
+		Currency:    currency,
+		Description: description,
+		Metadata:    metadata,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	switch token {
+	case TokenSuccess:
+		c.Status = StatusSucceeded
+	case TokenDecline:
+		c.Status = StatusDeclined
+		c.DeclineCode = "card_declined"
+	case TokenChallenge:
+		c.Status = StatusRequiresAction
+	default:
+		return nil, ErrUnknownToken
+	}
+
+	p.mu.Lock()
+	p.charges[c.ID] = c
+	p.mu.Unlock()
+
+	charge := *c
+	return &charge, nil
+}
+
+// CompleteChallenge answers the 3-D Secure challenge of a charge
+func (p *Processor) CompleteChallenge(ctx context.Context, chargeID, code string) (*Charge, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.charges[chargeID]
+	if !ok {
+		return nil, ErrChargeNotFound
+	}
+	if c.Status != StatusRequiresAction {
+		return nil, ErrNoChallenge
+	}
+
+	if code == ChallengeCode {
+		c.Status = StatusSucceeded
+	} else {
+		c.attempts++
+		if c.attempts >= maxChallengeAttempts {
+			c.Status = StatusFailed
+			c.DeclineCode = "authentication_failed"
+		}
+	}
+
+	charge := *c
+	return &charge, nil
+}
+
+// Charge returns a charge by ID
+func (p *Processor) Charge(ctx context.Context, chargeID string) (*Charge, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.charges[chargeID]
+	if !ok {
+		return nil, ErrChargeNotFound
+	}
+	charge := *c
+	return &charge, nil
+}
+
+// Refund gives amount of a succeeded charge back to the card
+func (p *Processor) Refund(ctx context.Context, chargeID string, amount int) (*Refund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.charges[chargeID]
+	if !ok {
+		return nil, ErrChargeNotFound
+	}
+	if c.Status != StatusSucceeded {
+		return nil, ErrNotRefundable
+	}
+	if amount <= 0 || c.AmountRefunded+amount > c.Amount {
+		return nil, fmt.Errorf("%w: %d of %d left to refund", ErrNotRefundable, c.Amount-c.AmountRefunded, c.Amount)
+	}
+	c.AmountRefunded += amount
+
+	return &Refund{
+		ID:        "re_" + uuid.New().String(),
+		ChargeID:  c.ID,
+		Amount:    amount,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
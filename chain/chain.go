@@ -0,0 +1,357 @@
+// Package chain implements a tiny simulated blockchain used to demo on-chain
+// L402 payments without a real node.
+//
+// The model is UTXO based and supports several assets per chain (e.g. a
+// stablecoin denominated in USD cents). There are no scripts or signatures:
+// whoever names an output as an input can spend it.
+package chain
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AddressPrefix is prepended to every simulated address.
+const AddressPrefix = "sim1"
+
+var (
+	ErrTxNotFound     = errors.New("transaction not found")
+	ErrMissingInput   = errors.New("input does not exist or is already spent")
+	ErrInsufficient   = errors.New("outputs exceed inputs")
+	ErrInvalidTx      = errors.New("invalid transaction")
+	ErrUnknownAddress = errors.New("invalid address")
+)
+
+type OutPoint struct {
+	TxID  string `json:"txid"`
+	Index int    `json:"index"`
+}
+
+func (o OutPoint) String() string {
+	return fmt.Sprintf("%s:%d", o.TxID, o.Index)
+}
+
+type TxOut struct {
+	Address string `json:"address"`
+	Asset   string `json:"asset"`
+	Amount  int64  `json:"amount"`
+}
+
+type Tx struct {
+	ID      string     `json:"id"`
+	Inputs  []OutPoint `json:"inputs"`
+	Outputs []TxOut    `json:"outputs"`
+}
+
+type UTXO struct {
+	OutPoint
+	TxOut
+	Confirmations int `json:"confirmations"`
+}
+
+type Block struct {
+	Height   int       `json:"height"`
+	Hash     string    `json:"hash"`
+	PrevHash string    `json:"prev_hash"`
+	Time     time.Time `json:"time"`
+	TxIDs    []string  `json:"txids"`
+}
+
+type Info struct {
+	Chain  string `json:"chain"`
+	Height int    `json:"height"`
+}
+
+// Node is what wallets and the gateway need from a chain. It is implemented
+// by *Chain in-process and by *Client over HTTP.
+type Node interface {
+	Info(ctx context.Context) (Info, error)
+	UTXOs(ctx context.Context, address string) ([]UTXO, error)
+	Submit(ctx context.Context, tx *Tx) (string, error)
+	// Received returns the total amount of asset ever paid to address in
+	// transactions with at least minConf confirmations.
+	Received(ctx context.Context, address, asset string, minConf int) (int64, error)
+	Confirmations(ctx context.Context, txid string) (int, error)
+}
+
+// Chain is an in-memory simulated chain with a mempool.
+type Chain struct {
+	mu sync.Mutex
+
+	name    string
+	blocks  []Block
+	txs     map[string]*Tx
+	heights map[string]int // txid -> block height, absent while in mempool
+	mempool []string
+	utxos   map[OutPoint]TxOut
+	spent   map[OutPoint]string // outpoint -> spending txid (mempool included)
+}
+
+// New creates a chain with a genesis block.
+func New(name string) *Chain {
+	c := &Chain{
+		name:    name,
+		txs:     make(map[string]*Tx),
+		heights: make(map[string]int),
+		utxos:   make(map[OutPoint]TxOut),
+		spent:   make(map[OutPoint]string),
+	}
+	c.blocks = append(c.blocks, Block{
+		Height: 0,
+		Hash:   hashStrings("genesis", name),
+		Time:   time.Now().UTC(),
+	})
+	return c
+}
+
+// DeriveAddress deterministically derives an address from a seed and a label.
+// The gateway uses it to get a fresh address per payment context.
+func DeriveAddress(seed []byte, label string) string {
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte(label))
+	return AddressPrefix + hex.EncodeToString(mac.Sum(nil)[:20])
+}
+
+// NewAddress returns a random address.
+func NewAddress() string {
+	seed := make([]byte, 32)
+	rand.Read(seed)
+	return DeriveAddress(seed, "")
+}
+
+// ValidAddress reports whether s looks like a simulated address.
+func ValidAddress(s string) bool {
+	if len(s) != len(AddressPrefix)+40 || s[:len(AddressPrefix)] != AddressPrefix {
+		return false
+	}
+	_, err := hex.DecodeString(s[len(AddressPrefix):])
+	return err == nil
+}
+
+func (c *Chain) Name() string {
+	return c.name
+}
+
+func (c *Chain) Info(ctx context.Context) (Info, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Info{Chain: c.name, Height: c.height()}, nil
+}
+
+func (c *Chain) height() int {
+	return c.blocks[len(c.blocks)-1].Height
+}
+
+// Faucet creates new coins out of thin air and puts them in the mempool.
+func (c *Chain) Faucet(address, asset string, amount int64) (string, error) {
+	if !ValidAddress(address) {
+		return "", ErrUnknownAddress
+	}
+	if amount <= 0 || asset == "" {
+		return "", fmt.Errorf("%w: faucet needs a positive amount and an asset", ErrInvalidTx)
+	}
+
+	// A random input-less transaction, like a coinbase with a nonce.
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	tx := &Tx{Outputs: []TxOut{{Address: address, Asset: asset, Amount: amount}}}
+	tx.ID = hashStrings("faucet", hex.EncodeToString(nonce))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addToMempool(tx)
+	return tx.ID, nil
+}
+
+// Submit validates a transaction and adds it to the mempool.
+func (c *Chain) Submit(ctx context.Context, tx *Tx) (string, error) {
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return "", fmt.Errorf("%w: transaction needs inputs and outputs", ErrInvalidTx)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	in := make(map[string]int64)
+	seen := make(map[OutPoint]bool)
+	for _, op := range tx.Inputs {
+		out, ok := c.utxos[op]
+		if !ok || seen[op] {
+			return "", fmt.Errorf("%w: %s", ErrMissingInput, op)
+		}
+		if _, spent := c.spent[op]; spent {
+			return "", fmt.Errorf("%w: %s", ErrMissingInput, op)
+		}
+		seen[op] = true
+		in[out.Asset] += out.Amount
+	}
+
+	out := make(map[string]int64)
+	for _, o := range tx.Outputs {
+		if o.Amount <= 0 || !ValidAddress(o.Address) {
+			return "", fmt.Errorf("%w: bad output %+v", ErrInvalidTx, o)
+		}
+		out[o.Asset] += o.Amount
+	}
+	for asset, amount := range out {
+		if amount > in[asset] {
+			return "", fmt.Errorf("%w: %s", ErrInsufficient, asset)
+		}
+	}
+
+	tx.ID = txID(tx)
+	if _, exists := c.txs[tx.ID]; exists {
+		return tx.ID, nil
+	}
+	c.addToMempool(tx)
+	return tx.ID, nil
+}
+
+func (c *Chain) addToMempool(tx *Tx) {
+	c.txs[tx.ID] = tx
+	c.mempool = append(c.mempool, tx.ID)
+	for _, op := range tx.Inputs {
+		c.spent[op] = tx.ID
+	}
+	for i, o := range tx.Outputs {
+		c.utxos[OutPoint{TxID: tx.ID, Index: i}] = o
+	}
+}
+
+// Mine confirms every transaction in the mempool in a new block.
+func (c *Chain) Mine() Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prev := c.blocks[len(c.blocks)-1]
+	b := Block{
+		Height:   prev.Height + 1,
+		PrevHash: prev.Hash,
+		Time:     time.Now().UTC(),
+		TxIDs:    c.mempool,
+	}
+	b.Hash = hashStrings(append([]string{prev.Hash}, b.TxIDs...)...)
+
+	for _, id := range c.mempool {
+		c.heights[id] = b.Height
+	}
+	c.mempool = nil
+	c.blocks = append(c.blocks, b)
+	return b
+}
+
+// MineEvery mines a block on every tick until ctx is done.
+func (c *Chain) MineEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Mine()
+		}
+	}
+}
+
+func (c *Chain) confirmations(txid string) int {
+	h, ok := c.heights[txid]
+	if !ok {
+		return 0
+	}
+	return c.height() - h + 1
+}
+
+func (c *Chain) Confirmations(ctx context.Context, txid string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.txs[txid]; !ok {
+		return 0, ErrTxNotFound
+	}
+	return c.confirmations(txid), nil
+}
+
+// Tx returns a transaction by ID.
+func (c *Chain) Tx(txid string) (*Tx, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tx, ok := c.txs[txid]
+	if !ok {
+		return nil, ErrTxNotFound
+	}
+	return tx, nil
+}
+
+// UTXOs returns the unspent outputs of an address, including unconfirmed
+// ones. Outputs already spent by a mempool transaction are left out.
+func (c *Chain) UTXOs(ctx context.Context, address string) ([]UTXO, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var utxos []UTXO
+	for op, out := range c.utxos {
+		if out.Address != address {
+			continue
+		}
+		if _, spent := c.spent[op]; spent {
+			continue
+		}
+		utxos = append(utxos, UTXO{
+			OutPoint:      op,
+			TxOut:         out,
+			Confirmations: c.confirmations(op.TxID),
+		})
+	}
+
+	sort.Slice(utxos, func(i, j int) bool {
+		return utxos[i].OutPoint.String() < utxos[j].OutPoint.String()
+	})
+	return utxos, nil
+}
+
+func (c *Chain) Received(ctx context.Context, address, asset string, minConf int) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var total int64
+	for op, out := range c.utxos {
+		if out.Address != address || out.Asset != asset {
+			continue
+		}
+		if c.confirmations(op.TxID) < minConf {
+			continue
+		}
+		total += out.Amount
+	}
+	return total, nil
+}
+
+func txID(tx *Tx) string {
+	parts := make([]string, 0, len(tx.Inputs)+len(tx.Outputs))
+	for _, in := range tx.Inputs {
+		parts = append(parts, in.String())
+	}
+	for _, out := range tx.Outputs {
+		parts = append(parts, fmt.Sprintf("%s/%s/%d", out.Address, out.Asset, out.Amount))
+	}
+	return hashStrings(parts...)
+}
+
+func hashStrings(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
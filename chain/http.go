@@ -0,0 +1,215 @@
+package chain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Handler exposes a Chain over HTTP so that several processes (gateway,
+// wallets) can share it.
+type Handler struct {
+	chain *Chain
+	mux   *http.ServeMux
+}
+
+func NewHandler(c *Chain) *Handler {
+	h := &Handler{
+		chain: c,
+		mux:   http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /info", h.handleInfo)
+	h.mux.HandleFunc("GET /addresses/{address}/utxos", h.handleUTXOs)
+	h.mux.HandleFunc("GET /addresses/{address}/received", h.handleReceived)
+	h.mux.HandleFunc("GET /txs/{txid}", h.handleTx)
+	h.mux.HandleFunc("POST /txs", h.handleSubmit)
+	h.mux.HandleFunc("POST /faucet", h.handleFaucet)
+	h.mux.HandleFunc("POST /mine", h.handleMine)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) handleInfo(w http.ResponseWriter, r *http.Request) {
+	info, _ := h.chain.Info(r.Context())
+	writeJSON(w, info)
+}
+
+func (h *Handler) handleUTXOs(w http.ResponseWriter, r *http.Request) {
+	utxos, _ := h.chain.UTXOs(r.Context(), r.PathValue("address"))
+	if utxos == nil {
+		utxos = []UTXO{}
+	}
+	writeJSON(w, utxos)
+}
+
+func (h *Handler) handleReceived(w http.ResponseWriter, r *http.Request) {
+	minConf, _ := strconv.Atoi(r.URL.Query().Get("min_conf"))
+	total, _ := h.chain.Received(r.Context(), r.PathValue("address"),
+		r.URL.Query().Get("asset"), minConf)
+	writeJSON(w, map[string]int64{"amount": total})
+}
+
+type txResponse struct {
+	Tx            *Tx `json:"tx"`
+	Confirmations int `json:"confirmations"`
+}
+
+func (h *Handler) handleTx(w http.ResponseWriter, r *http.Request) {
+	txid := r.PathValue("txid")
+	tx, err := h.chain.Tx(txid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	conf, _ := h.chain.Confirmations(r.Context(), txid)
+	writeJSON(w, txResponse{Tx: tx, Confirmations: conf})
+}
+
+func (h *Handler) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var tx Tx
+	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	txid, err := h.chain.Submit(r.Context(), &tx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, map[string]string{"txid": txid})
+}
+
+type faucetRequest struct {
+	Address string `json:"address"`
+	Asset   string `json:"asset"`
+	Amount  int64  `json:"amount"`
+}
+
+func (h *Handler) handleFaucet(w http.ResponseWriter, r *http.Request) {
+	var req faucetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	txid, err := h.chain.Faucet(req.Address, req.Asset, req.Amount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, map[string]string{"txid": txid})
+}
+
+func (h *Handler) handleMine(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.chain.Mine())
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Client talks to a chain served by Handler.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the chain served at baseURL
+func NewClient(baseURL string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("chain request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		err := errors.New(strings.TrimSpace(string(msg)))
+		if resp.StatusCode == http.StatusNotFound {
+			err = ErrTxNotFound
+		}
+		return fmt.Errorf("chain request failed with status %d: %w", resp.StatusCode, err)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) Info(ctx context.Context) (Info, error) {
+	var info Info
+	err := c.do(ctx, "GET", "/info", nil, &info)
+	return info, err
+}
+
+func (c *Client) UTXOs(ctx context.Context, address string) ([]UTXO, error) {
+	var utxos []UTXO
+	err := c.do(ctx, "GET", "/addresses/"+url.PathEscape(address)+"/utxos", nil, &utxos)
+	return utxos, err
+}
+
+func (c *Client) Submit(ctx context.Context, tx *Tx) (string, error) {
+	var resp struct {
+		TxID string `json:"txid"`
+	}
+	err := c.do(ctx, "POST", "/txs", tx, &resp)
+	return resp.TxID, err
+}
+
+func (c *Client) Received(ctx context.Context, address, asset string, minConf int) (int64, error) {
+	q := url.Values{}
+	q.Set("asset", asset)
+	q.Set("min_conf", strconv.Itoa(minConf))
+
+	var resp struct {
+		Amount int64 `json:"amount"`
+	}
+	err := c.do(ctx, "GET", "/addresses/"+url.PathEscape(address)+"/received?"+q.Encode(), nil, &resp)
+	return resp.Amount, err
+}
+
+func (c *Client) Confirmations(ctx context.Context, txid string) (int, error) {
+	var resp txResponse
+	err := c.do(ctx, "GET", "/txs/"+url.PathEscape(txid), nil, &resp)
+	return resp.Confirmations, err
+}
+
+// Faucet asks the chain to mint coins to address.
+func (c *Client) Faucet(ctx context.Context, address, asset string, amount int64) (string, error) {
+	var resp struct {
+		TxID string `json:"txid"`
+	}
+	err := c.do(ctx, "POST", "/faucet", faucetRequest{Address: address, Asset: asset, Amount: amount}, &resp)
+	return resp.TxID, err
+}
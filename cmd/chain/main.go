@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/l402-protocol/go-example/chain"
+)
+
+const (
+	// demoSeed must match the one used by cmd/client
+	demoSeed = "l402-demo-client"
+)
+
+func main() {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	var (
+		addr      = flag.String("addr", ":8082", "Address to listen on")
+		name      = flag.String("chain", "simnet", "Name of the simulated chain")
+		blockTime = flag.Duration("block-time", 5*time.Second, "Time between blocks")
+		asset     = flag.String("fund-asset", "USD", "Asset used to fund the demo client")
+		amount    = flag.Int64("fund-amount", 100000, "Amount used to fund the demo client")
+	)
+	flag.Parse()
+
+	c := chain.New(*name)
+
+	// Fund the demo client so it can pay right away
+	clientAddress := chain.DeriveAddress([]byte(demoSeed), "wallet")
+	if _, err := c.Faucet(clientAddress, *asset, *amount); err != nil {
+		logger.Error("failed to fund demo client", "error", err)
+		os.Exit(1)
+	}
+	c.Mine()
+
+	go c.MineEvery(context.Background(), *blockTime)
+
+	logger.Info("starting simulated chain",
+		"chain", *name,
+		"addr", *addr,
+		"block_time", blockTime.String(),
+		"funded_address", clientAddress,
+	)
+	if err := http.ListenAndServe(*addr, chain.NewHandler(c)); err != nil {
+		logger.Error("chain failed to start", "error", err)
+		os.Exit(1)
+	}
+}
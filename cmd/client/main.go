@@ -1,17 +1,33 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/l402-protocol/go-example/bolt11"
+	"github.com/l402-protocol/go-example/cardproc"
+	"github.com/l402-protocol/go-example/chain"
+	"github.com/l402-protocol/go-example/keystore"
 	"github.com/l402-protocol/go-example/l402"
 	"github.com/l402-protocol/go-example/wallet"
 )
 
 const (
 	authToken = "01badad5-f2f0-43cf-be44-4f8e1c4d8641"
+
+	// demoSeed must match the one used by cmd/chain
+	demoSeed = "l402-demo-client"
+
+	// demoRates prices the USD offers of the example server, a cent being
+	// 20 sats. Invoices must match it exactly, so pass the gateway's rates.
+	demoRates = "USD:20000"
 )
 
 func main() {
@@ -19,24 +35,177 @@ func main() {
 	slog.SetDefault(logger)
 
 	var (
-		offerID = flag.String("offer-id", "offer_0001", "Offer ID that we will purchase")
-		useFake = flag.Bool("fake", false, "Simulate a fake payment")
+		offerID  = flag.String("offer-id", "offer_0001", "Offer ID that we will purchase")
+		resource = flag.String("url", "http://localhost:8080/private-resource", "URL of the protected resource")
+		useFake  = flag.Bool("fake", false, "Simulate a fake payment")
+		headless = flag.String("headless", "", "Follow fake-pay checkouts without a browser; GET or POST confirms gateways without a confirmation form")
+		onchain  = flag.Bool("onchain", false, "Pay on the simulated chain")
+		chainURL = flag.String("chain-url", "http://localhost:8082", "URL of the simulated chain")
+		nwcURI   = flag.String("nwc", "", "Nostr Wallet Connect URI used to pay lightning invoices")
+		network  = flag.String("network", "mainnet", "Lightning network invoices must be for")
+		rateList = flag.String("rates", demoRates, "Comma separated millisatoshis per smallest unit of offer currencies, used to check invoices")
+		prefer   = flag.String("prefer", "", "Comma separated payment method preference, e.g. onchain,fake-pay")
+		budget   = flag.String("balance-file", "", "Cap spending with the prefunded balance stored in this file")
+		fund     = flag.String("fund", "", "Add funds to the balance file before paying, e.g. USD:1000")
+		card     = flag.String("card-token", "", "Pay credit card offers with this card token, e.g. tok_success")
+		cardCode = flag.String("card-code", cardproc.ChallengeCode, "Code used to answer 3-D Secure challenges")
+		pick     = flag.Bool("pick", false, "Choose the offer and payment method interactively instead of using --offer-id")
+		ksPath   = flag.String("keystore", "", "Load wallet secrets (NWC URI, card token, on-chain seed) from this keystore")
+		execCmd  = flag.String("exec", "", "Pay through an external wallet command, e.g. ./scripts/exec-wallet.py")
+		execPM   = flag.String("exec-methods", "fake-pay", "Comma separated payment methods the external wallet handles")
+		execTime = flag.Duration("exec-timeout", wallet.DefaultExecTimeout, "Maximum time the external wallet may take")
+		waitMode = flag.String("wait", string(l402.WaitPoll), "How to wait for pending payments: poll, sse or prompt")
+		waitTime = flag.Duration("wait-timeout", l402.DefaultSettlementTimeout, "Maximum time to wait for a pending payment")
+		status   = flag.String("payment-status", "", "Show the status and refunds of a past payment, given its status URL, and exit")
 	)
 	flag.Parse()
 
-	// Create the appropriate wallet based on the --fake flag
+	if *status != "" {
+		showPaymentStatus(logger, *status)
+		return
+	}
+
+	// Secrets given as flags take precedence over the keystore
+	var ks *keystore.Keystore
+	if *ksPath != "" {
+		passphrase, err := keystore.ReadPassphrase(keystore.PassphraseEnv, "Keystore passphrase: ")
+		if err != nil {
+			logger.Error("failed to read keystore passphrase", "error", err)
+			os.Exit(1)
+		}
+		ks, err = keystore.OpenUnlocked(*ksPath, passphrase)
+		if err != nil {
+			logger.Error("failed to open keystore", "error", err)
+			os.Exit(1)
+		}
+		defer ks.Lock()
+	}
+	inKeystore := func(name string) bool {
+		return ks != nil && slices.Contains(ks.Names(), name)
+	}
+
+	// Create the appropriate wallets based on the flags
+	var wallets []wallet.MethodWallet
+	if *nwcURI != "" || inKeystore(wallet.SecretNWC) {
+		rates, err := wallet.ParseExchangeRates(*rateList)
+		if err != nil {
+			logger.Error("invalid --rates", "error", err)
+			os.Exit(1)
+		}
+
+		var nw *wallet.NWCWallet
+		if *nwcURI != "" {
+			nw, err = wallet.NewNWCWallet(*offerID, *nwcURI, bolt11.Network(*network), rates)
+		} else {
+			nw, err = wallet.NewNWCWalletFromKeystore(ks, wallet.SecretNWC, *offerID, bolt11.Network(*network), rates)
+		}
+		if err != nil {
+			logger.Error("failed to create nwc wallet", "error", err)
+			os.Exit(1)
+		}
+		defer nw.Close()
+		wallets = append(wallets, nw)
+	}
+	if *onchain {
+		if inKeystore(wallet.SecretOnchainSeed) {
+			ow, err := wallet.NewOnchainWalletFromKeystore(ks, wallet.SecretOnchainSeed, *offerID, chain.NewClient(*chainURL))
+			if err != nil {
+				logger.Error("failed to create onchain wallet", "error", err)
+				os.Exit(1)
+			}
+			wallets = append(wallets, ow)
+		} else {
+			address := chain.DeriveAddress([]byte(demoSeed), "wallet")
+			wallets = append(wallets, wallet.NewOnchainWallet(*offerID, chain.NewClient(*chainURL), address))
+		}
+	}
+	if *card != "" {
+		wallets = append(wallets, wallet.NewCardWallet(*offerID, *card, wallet.StaticChallengeResponder(*cardCode)))
+	} else if inKeystore(wallet.SecretCardToken) {
+		cw, err := wallet.NewCardWalletFromKeystore(ks, wallet.SecretCardToken, *offerID, wallet.StaticChallengeResponder(*cardCode))
+		if err != nil {
+			logger.Error("failed to create card wallet", "error", err)
+			os.Exit(1)
+		}
+		wallets = append(wallets, cw)
+	}
+	if *execCmd != "" {
+		wallets = append(wallets, wallet.NewExecWallet(*offerID, strings.Fields(*execCmd), parseMethods(*execPM), *execTime))
+	}
+	if *headless != "" {
+		wallets = append(wallets, wallet.NewCheckoutWallet(*offerID, *headless))
+	} else if *useFake {
+		wallets = append(wallets, wallet.NewFakeWallet(*offerID, bolt11.Network(*network)))
+	}
+
+	preference := parseMethods(*prefer)
+
 	var w l402.Wallet
-	if *useFake {
-		w = wallet.NewFakeWallet(*offerID)
-	} else {
+	switch {
+	case *pick:
+		if *budget != "" {
+			logger.Error("--pick can't be combined with --balance-file")
+			os.Exit(1)
+		}
+		var payer wallet.MethodWallet
+		switch len(wallets) {
+		case 0:
+		case 1:
+			payer = wallets[0]
+		default:
+			payer = wallet.NewCompositeWallet(*offerID, preference, wallets...)
+		}
+		w = wallet.NewPickerWallet(payer)
+	case len(wallets) == 0:
 		w = wallet.NewMockWallet()
+	case len(wallets) == 1:
+		w = wallets[0].(l402.Wallet)
+	default:
+		w = wallet.NewCompositeWallet(*offerID, preference, wallets...)
+	}
+
+	// Wrap the wallet with a prefunded balance if requested
+	if *budget != "" {
+		bw, err := wallet.NewBalanceWallet(*budget, *offerID, w)
+		if err != nil {
+			logger.Error("failed to open balance wallet", "error", err)
+			os.Exit(1)
+		}
+		if *fund != "" {
+			currency, amount, ok := strings.Cut(*fund, ":")
+			n, err := strconv.ParseInt(amount, 10, 64)
+			if !ok || err != nil {
+				logger.Error("invalid --fund, expected CURRENCY:AMOUNT", "fund", *fund)
+				os.Exit(1)
+			}
+			if err := bw.Credit(currency, n, "cli top-up"); err != nil {
+				logger.Error("failed to fund balance wallet", "error", err)
+				os.Exit(1)
+			}
+		}
+		// Settle payments whose outcome was unknown when they were made
+		if err := bw.SettlePending(context.Background(), http.DefaultClient); err != nil {
+			logger.Warn("failed to settle pending debits", "error", err)
+		}
+		if pending := bw.Pending(); len(pending) > 0 {
+			logger.Warn("balance has pending debits", "pending", pending)
+		}
+		logger.Info("balance wallet loaded", "balances", bw.Balances())
+		w = bw
 	}
 
 	// Create the L402 client with the selected wallet
 	client := l402.NewHTTP402Client(w)
+	switch mode := l402.SettlementWait(*waitMode); mode {
+	case l402.WaitPoll, l402.WaitStream, l402.WaitPrompt:
+		client.SetSettlementWait(mode, *waitTime)
+	default:
+		logger.Error("invalid --wait, expected poll, sse or prompt", "wait", *waitMode)
+		os.Exit(1)
+	}
 
 	// Make a request to the protected resource
-	req, err := http.NewRequest("GET", "http://localhost:8080/private-resource", nil)
+	req, err := http.NewRequest("GET", *resource, nil)
 	if err != nil {
 		logger.Error("failed to create request", "error", err)
 		os.Exit(1)
@@ -46,6 +215,15 @@ func main() {
 	req.Header.Set("Authorization", "Bearer "+authToken)
 
 	resp, err := client.Do(req)
+	var insufficient *wallet.InsufficientFundsError
+	if errors.As(err, &insufficient) {
+		logger.Error("not enough funds to pay",
+			"currency", insufficient.Currency,
+			"needed", insufficient.Needed,
+			"available", insufficient.Available,
+		)
+		os.Exit(1)
+	}
 	if err != nil {
 		logger.Error("failed to execute request",
 			"error", err,
@@ -55,9 +233,63 @@ func main() {
 	}
 	defer resp.Body.Close()
 
+	for _, p := range client.Payments() {
+		logger.Info("payment made",
+			"offer_id", p.OfferID,
+			"method", p.Method,
+			"amount", p.Amount,
+			"currency", p.Currency,
+			"txid", p.TxID,
+			"receipt_id", p.ReceiptID,
+			"status", p.Status,
+			"status_url", p.StatusURL,
+		)
+	}
+
 	logger.Info("request completed",
 		"status", resp.StatusCode,
 		"url", req.URL.String(),
 		"offer_id", *offerID,
 	)
 }
+
+// showPaymentStatus logs how a payment stands, including its refunds
+func showPaymentStatus(logger *slog.Logger, statusURL string) {
+	s, err := l402.GetPaymentStatus(context.Background(), http.DefaultClient, statusURL, "", 0)
+	if err != nil {
+		logger.Error("failed to get payment status",
+			"error", err,
+			"url", statusURL,
+		)
+		os.Exit(1)
+	}
+	logger.Info("payment status",
+		"payment_context", s.PaymentContextToken,
+		"status", s.Status,
+		"offer_id", s.OfferID,
+		"method", s.PaymentMethod,
+		"amount", s.Amount,
+		"currency", s.Currency,
+		"refunded_amount", s.RefundedAmount,
+	)
+	for _, r := range s.Refunds {
+		logger.Info("refund",
+			"id", r.ID,
+			"amount", r.Amount,
+			"currency", r.Currency,
+			"status", r.Status,
+			"created_at", r.CreatedAt,
+		)
+	}
+}
+
+// parseMethods parses a comma separated list of payment methods
+func parseMethods(list string) []l402.PaymentMethods {
+	var methods []l402.PaymentMethods
+	for _, m := range strings.Split(list, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			methods = append(methods, l402.PaymentMethods(m))
+		}
+	}
+	return methods
+}
@@ -1,15 +1,76 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
+	"slices"
 
+	"github.com/l402-protocol/go-example/cardproc"
+	"github.com/l402-protocol/go-example/chain"
+	"github.com/l402-protocol/go-example/config"
 	"github.com/l402-protocol/go-example/gateway"
+	"github.com/l402-protocol/go-example/webhook"
 )
 
 func main() {
-	g := gateway.NewGateway()
-	log.Println("Starting gateway server on :8081")
-	if err := g.Start(":8081"); err != nil {
+	cfg := config.DefaultGateway()
+	if err := config.Parse(flag.CommandLine, os.Args[1:], &cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if slices.Contains(cfg.WebhookSecrets, webhook.DevSecret) {
+		log.Println("Warning: signing webhooks with the development secret, set webhook_secrets")
+	}
+	if cfg.MerchantsFile == "" {
+		switch cfg.AdminKey {
+		case "":
+			log.Println("Warning: no merchants file or admin key, the catalog and webhook deliveries can't be managed")
+		case gateway.DevAdminKey:
+			log.Println("Warning: managing the gateway with the development admin key, set admin_key")
+		}
+	}
+
+	opts := cfg.Options()
+	if cfg.StoreFile != "" {
+		store, err := gateway.NewFileStore(cfg.StoreFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, gateway.WithStore(store))
+	}
+	if cfg.IdempotencyFile != "" {
+		idempotency, err := gateway.NewFileIdempotencyStore(cfg.IdempotencyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, gateway.WithIdempotencyStore(idempotency))
+	}
+	if cfg.MerchantsFile != "" {
+		merchants, err := gateway.NewFileMerchantStore(cfg.MerchantsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, gateway.WithMerchants(merchants))
+	}
+	if cfg.CatalogFile != "" {
+		offers, err := gateway.ReadOffers(cfg.CatalogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, gateway.WithCatalog(offers))
+	}
+	if cfg.ChainURL != "" {
+		opts = append(opts, gateway.WithChain(chain.NewClient(cfg.ChainURL), cfg.Confirmations))
+	}
+
+	if cfg.MockCards {
+		opts = append(opts, gateway.WithCardProcessor(cardproc.New()))
+	}
+
+	g := gateway.NewGateway(opts...)
+	log.Println("Starting gateway server on " + cfg.ListenAddr)
+	if err := g.Start(cfg.ListenAddr); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/l402-protocol/go-example/keystore"
+	"golang.org/x/term"
+)
+
+const usage = `Usage: keystore [--file PATH] COMMAND
+
+Commands:
+  init               create a new keystore
+  list               list stored secrets
+  put NAME [VALUE]   store a secret, read from stdin if VALUE is omitted
+  get NAME           print a secret
+  delete NAME        remove a secret
+  rotate             re-encrypt every secret under a new passphrase
+
+The passphrase is read from $L402_KEYSTORE_PASSPHRASE or asked for. rotate
+reads the new one from $L402_KEYSTORE_NEW_PASSPHRASE.
+`
+
+// newPassphraseEnv holds the new passphrase for rotate
+const newPassphraseEnv = "L402_KEYSTORE_NEW_PASSPHRASE"
+
+func main() {
+	path := flag.String("file", "keystore.json", "Path of the keystore file")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*path, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(path, command string, args []string) error {
+	switch command {
+	case "init":
+		passphrase, err := newPassphrase(keystore.PassphraseEnv)
+		if err != nil {
+			return err
+		}
+		if _, err := keystore.Create(path, passphrase); err != nil {
+			return err
+		}
+		fmt.Printf("keystore created at %s\n", path)
+		return nil
+
+	case "list":
+		ks, err := keystore.Open(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range ks.Names() {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	ks, err := unlock(path)
+	if err != nil {
+		return err
+	}
+	defer ks.Lock()
+
+	switch command {
+	case "put":
+		if len(args) < 1 {
+			return fmt.Errorf("put needs a secret name")
+		}
+		var value string
+		if len(args) > 1 {
+			value = args[1]
+		} else if value, err = readSecret(args[0]); err != nil {
+			return err
+		}
+		return ks.Put(args[0], []byte(value))
+
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("get needs a secret name")
+		}
+		secret, err := ks.Get(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(secret))
+		return nil
+
+	case "delete":
+		if len(args) != 1 {
+			return fmt.Errorf("delete needs a secret name")
+		}
+		return ks.Delete(args[0])
+
+	case "rotate":
+		current, err := keystore.ReadPassphrase(keystore.PassphraseEnv, "Current passphrase: ")
+		if err != nil {
+			return err
+		}
+		next, err := newPassphrase(newPassphraseEnv)
+		if err != nil {
+			return err
+		}
+		if err := ks.Rotate(current, next); err != nil {
+			return err
+		}
+		fmt.Println("keystore rotated")
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %q", command)
+}
+
+func unlock(path string) (*keystore.Keystore, error) {
+	ks, err := keystore.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := keystore.ReadPassphrase(keystore.PassphraseEnv, "Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// newPassphrase asks for a passphrase twice unless it comes from env
+func newPassphrase(env string) (string, error) {
+	if p, ok := os.LookupEnv(env); ok {
+		return p, nil
+	}
+	p, err := keystore.ReadPassphrase(env, "New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	confirm, err := keystore.ReadPassphrase(env, "Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if p != confirm {
+		return "", fmt.Errorf("passphrases don't match")
+	}
+	return p, nil
+}
+
+// readSecret reads a secret value from stdin, hiding it on terminals
+func readSecret(name string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprintf(os.Stderr, "Value for %s: ", name)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read secret from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/l402-protocol/go-example/gateway"
+)
+
+const usage = `Usage: merchant [--file PATH] COMMAND
+
+Commands:
+  add ID [NAME]              create a merchant, prints its API key and webhook secret
+  list                       list merchants
+  show ID                    print a merchant without its webhook secret
+  remove ID                  delete a merchant
+  add-key ID                 create another API key, prints it
+  revoke-key ID KEY_ID       delete an API key
+  rotate-secret ID           add a webhook secret, prints it
+  retire-secrets ID          keep only the newest webhook secret
+  set-webhook ID URL         send the merchant events to URL
+  set-offers ID FILE         replace the offer catalog with the JSON offers in FILE
+
+API keys are only printed when created, the file keeps their hashes. A
+gateway started with --merchants-file picks up changes while it runs.
+
+Every set-offers bumps the catalog version. Catalogs can also be managed by
+the merchant through the gateway /catalog API.
+
+Webhooks are signed with every active secret. To rotate, run rotate-secret,
+give the new secret to the backend next to the old one, then retire-secrets.
+`
+
+func main() {
+	path := flag.String("file", "merchants.json", "Path of the merchants file")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	store, err := gateway.NewFileMerchantStore(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	if err := run(context.Background(), store, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, store gateway.MerchantStore, command string, args []string) error {
+	switch command {
+	case "add":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("add needs a merchant ID and an optional name")
+		}
+		if _, err := store.Get(ctx, args[0]); err == nil {
+			return fmt.Errorf("%w: %s", gateway.ErrMerchantExists, args[0])
+		}
+		key, apiKey := gateway.NewAPIKey()
+		m := &gateway.Merchant{
+			ID:      args[0],
+			APIKeys: []gateway.APIKey{apiKey},
+		}
+		if len(args) == 2 {
+			m.Name = args[1]
+		}
+		secret := m.RotateWebhookSecret()
+		if err := store.Put(ctx, m); err != nil {
+			return err
+		}
+		fmt.Printf("merchant %s created\napi key:        %s\nwebhook secret: %s\n", m.ID, key, secret)
+		return nil
+
+	case "list":
+		merchants, err := store.List(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tKEYS\tOFFERS\tCATALOG\tWEBHOOK")
+		for _, m := range merchants {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\tv%d\t%s\n", m.ID, m.Name, len(m.APIKeys), len(m.Offers), m.CatalogVersion, m.WebhookURL)
+		}
+		return tw.Flush()
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("%s needs a merchant ID", command)
+	}
+	m, err := store.Get(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "show":
+		m.WebhookSecrets = nil
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		return out.Encode(m)
+
+	case "remove":
+		return store.Delete(ctx, m.ID)
+
+	case "add-key":
+		key, apiKey := gateway.NewAPIKey()
+		m.APIKeys = append(m.APIKeys, apiKey)
+		if err := store.Put(ctx, m); err != nil {
+			return err
+		}
+		fmt.Printf("api key %s: %s\n", apiKey.ID, key)
+		return nil
+
+	case "revoke-key":
+		if len(args) != 2 {
+			return fmt.Errorf("revoke-key needs a merchant ID and a key ID")
+		}
+		if err := m.RevokeAPIKey(args[1]); err != nil {
+			return err
+		}
+		return store.Put(ctx, m)
+
+	case "rotate-secret":
+		secret := m.RotateWebhookSecret()
+		if err := store.Put(ctx, m); err != nil {
+			return err
+		}
+		fmt.Printf("webhook secret: %s\n", secret)
+		return nil
+
+	case "retire-secrets":
+		m.RetireWebhookSecrets()
+		return store.Put(ctx, m)
+
+	case "set-webhook":
+		if len(args) != 2 {
+			return fmt.Errorf("set-webhook needs a merchant ID and a URL")
+		}
+		m.WebhookURL = args[1]
+		return store.Put(ctx, m)
+
+	case "set-offers":
+		if len(args) != 2 {
+			return fmt.Errorf("set-offers needs a merchant ID and a file")
+		}
+		offers, err := gateway.ReadOffers(args[1])
+		if err != nil {
+			return err
+		}
+		if err := m.SetOffers(offers); err != nil {
+			return err
+		}
+		if err := store.Put(ctx, m); err != nil {
+			return err
+		}
+		fmt.Printf("catalog version %d\n", m.CatalogVersion)
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %q", command)
+}
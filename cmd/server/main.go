@@ -2,14 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
+	"log"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/l402-protocol/go-example/config"
+	"github.com/l402-protocol/go-example/gateway"
 	"github.com/l402-protocol/go-example/l402"
+	"github.com/l402-protocol/go-example/webhook"
 )
 
 var (
@@ -45,21 +58,47 @@ var (
 )
 
 type Server struct {
-	mux     *http.ServeMux
-	hasPaid bool
-	logger  *slog.Logger
+	mux    *http.ServeMux
+	logger *slog.Logger
+
+	// What was paid, by payment context, and the payment contexts charged
+	mu           sync.Mutex
+	entitlements map[string]*entitlement
+	charged      map[string]bool
+
+	// Gateway charges are created at
+	gatewayURL string
+	apiKey     string
+	client     *http.Client
+
+	// Whether the offers were put in the gateway catalog yet
+	syncCatalog   bool
+	catalogMu     sync.Mutex
+	catalogSynced bool
+
+	// Checks payment webhooks come from the gateway
+	verifier *webhook.Verifier
 }
 
-func NewServer() *Server {
+func NewServer(cfg config.Server) *Server {
 	// Create a JSON logger with timestamp and caller info
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	}))
 
 	s := &Server{
-		mux:     http.NewServeMux(),
-		hasPaid: false,
-		logger:  logger,
+		mux:          http.NewServeMux(),
+		logger:       logger,
+		entitlements: make(map[string]*entitlement),
+		charged:      make(map[string]bool),
+
+		gatewayURL: strings.TrimSuffix(cfg.GatewayURL, "/"),
+		apiKey:     cfg.APIKey,
+
+		syncCatalog: cfg.SyncCatalog,
+
+		verifier: webhook.NewVerifier(cfg.WebhookTolerance.Duration, cfg.WebhookSecrets...),
+		client:   &http.Client{Timeout: cfg.GatewayTimeout.Duration},
 	}
 	s.routes()
 	return s
@@ -70,15 +109,161 @@ func (s *Server) routes() {
 	s.mux.HandleFunc("POST /payment-success", s.handlePaymentSuccess) // Webhook from gateway
 }
 
+// paymentEvent is the part of gateway events the server uses
+type paymentEvent struct {
+	ID                  string `json:"id"`
+	Type                string `json:"type"`
+	PaymentContextToken string `json:"payment_context_token"`
+	OfferID             string `json:"offer_id"`
+	Amount              int    `json:"amount"`
+	Currency            string `json:"currency"`
+	RefundedAmount      int    `json:"refunded_amount"`
+	LateFunds           int64  `json:"late_funds"`
+}
+
+// entitlement is the access a payment gives. Refunds reduce what is left of
+// it, a full refund revokes it.
+type entitlement struct {
+	OfferID  string
+	Amount   int
+	Currency string
+	Refunded int
+}
+
+// active reports whether the entitlement still gives access. The amount
+// is unknown with older gateways.
+func (e *entitlement) active() bool {
+	return e.Amount == 0 || e.Refunded < e.Amount
+}
+
+// entitle records what an event says was paid and refunded for its payment
+// context. Events carry totals, so redelivered or reordered events don't
+// count a refund twice.
+func (s *Server) entitle(event paymentEvent) *entitlement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entitlements[event.PaymentContextToken]
+	if !ok {
+		e = &entitlement{OfferID: event.OfferID}
+		s.entitlements[event.PaymentContextToken] = e
+	}
+	if event.Amount > 0 {
+		e.Amount = event.Amount
+		e.Currency = event.Currency
+	}
+	e.Refunded = max(e.Refunded, event.RefundedAmount)
+	c := *e
+	return &c
+}
+
+// confirmPayment asks the gateway whether a payment context this server
+// charged was paid, for clients retrying before the payment event arrived
+func (s *Server) confirmPayment(ctx context.Context, token string) {
+	s.mu.Lock()
+	charged := s.charged[token]
+	s.mu.Unlock()
+	if !charged {
+		return
+	}
+
+	status, err := l402.GetPaymentStatus(ctx, s.client, s.gatewayURL+"/payments/"+url.PathEscape(token), "", 0)
+	if err != nil {
+		s.logger.Warn("failed to confirm payment with the gateway",
+			"error", err,
+			"payment_context", token,
+		)
+		return
+	}
+	switch status.Status {
+	case l402.PaymentStatusPaid, l402.PaymentStatusPartiallyRefunded:
+	default:
+		return
+	}
+
+	s.entitle(paymentEvent{
+		PaymentContextToken: token,
+		OfferID:             status.OfferID,
+		Amount:              status.Amount,
+		Currency:            status.Currency,
+		RefundedAmount:      status.RefundedAmount,
+	})
+	s.logger.Info("payment confirmed with the gateway",
+		"payment_context", token,
+		"offer_id", status.OfferID,
+	)
+}
+
+// hasPaid reports whether any payment still gives access
+func (s *Server) hasPaid() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entitlements {
+		if e.active() {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) handlePaymentSuccess(w http.ResponseWriter, r *http.Request) {
-	// Verify payment context and offer ID from headers
-	paymentContext := r.Header.Get("X-Payment-Context")
-	offerID := r.Header.Get("X-Offer-ID")
-
-	if paymentContext == "" || offerID == "" {
-		s.logger.Error("missing payment context or offer ID in headers",
-			"payment_context", paymentContext,
-			"offer_id", offerID,
+	// Only trust signed events, headers and bodies are easy to forge
+	body, err := s.verifier.VerifyRequest(r)
+	if err != nil {
+		s.logger.Warn("rejected payment webhook",
+			"error", err,
+			"remote_addr", r.RemoteAddr,
+		)
+		http.Error(w, "invalid webhook signature", http.StatusUnauthorized)
+		return
+	}
+
+	var event paymentEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		s.logger.Error("failed to decode payment webhook",
+			"error", err,
+			"remote_addr", r.RemoteAddr,
+		)
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+
+	// Expired charges may have no offer selected yet
+	switch event.Type {
+	case "payment.succeeded", "payment.refunded":
+	case "payment.expired":
+		s.logger.Info("payment context expired",
+			"event_id", event.ID,
+			"payment_context", event.PaymentContextToken,
+			"offer_id", event.OfferID,
+		)
+		w.WriteHeader(http.StatusOK)
+		return
+	case "payment.late_funds":
+		// Nothing was bought, the customer is owed the funds
+		s.logger.Warn("late payment needs a manual refund",
+			"event_id", event.ID,
+			"payment_context", event.PaymentContextToken,
+			"offer_id", event.OfferID,
+			"late_funds", event.LateFunds,
+		)
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		s.logger.Warn("ignoring unknown event",
+			"event_id", event.ID,
+			"type", event.Type,
+			"payment_context", event.PaymentContextToken,
+		)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if event.PaymentContextToken == "" || event.OfferID == "" {
+		s.logger.Error("missing payment context or offer ID in event",
+			"event_id", event.ID,
+			"payment_context", event.PaymentContextToken,
+			"offer_id", event.OfferID,
 			"remote_addr", r.RemoteAddr,
 		)
 		http.Error(w, "missing payment context or offer ID", http.StatusBadRequest)
@@ -89,12 +274,27 @@ func (s *Server) handlePaymentSuccess(w http.ResponseWriter, r *http.Request) {
 	// 1. Verify the payment context is valid
 	// 2. Check if the offer exists and is valid
 	// 3. Update user's credits/access based on the offer type
-	// For demo, we just set hasPaid to true
-	s.hasPaid = true
+	// For demo, we keep what each payment context paid for
+	e := s.entitle(event)
+
+	if event.Type == "payment.refunded" {
+		s.logger.Info("payment refunded",
+			"event_id", event.ID,
+			"payment_context", event.PaymentContextToken,
+			"offer_id", event.OfferID,
+			"refunded_amount", e.Refunded,
+			"remaining", e.Amount-e.Refunded,
+			"currency", e.Currency,
+			"access_revoked", !e.active(),
+		)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
 	s.logger.Info("payment processed successfully",
-		"payment_context", paymentContext,
-		"offer_id", offerID,
+		"event_id", event.ID,
+		"payment_context", event.PaymentContextToken,
+		"offer_id", event.OfferID,
 		"remote_addr", r.RemoteAddr,
 	)
 	w.WriteHeader(http.StatusOK)
@@ -125,15 +325,32 @@ func (s *Server) handleGetPrivateResource(w http.ResponseWriter, r *http.Request
 	s.logger.Debug("authenticated request received",
 		"remote_addr", r.RemoteAddr,
 		"path", r.URL.Path,
-		"has_paid", s.hasPaid,
+		"has_paid", s.hasPaid(),
+		"payment_context", r.Header.Get("X-Payment-Context"),
 	)
 
-	if !s.hasPaid {
-		// Send offers to gateway's charge endpoint
-		chargeReq := struct {
-			Offers []l402.Offer `json:"offers"`
-		}{
-			Offers: offers,
+	// The payment event may still be on its way, ask the gateway
+	if token := r.Header.Get("X-Payment-Context"); token != "" && !s.hasPaid() {
+		s.confirmPayment(r.Context(), token)
+	}
+
+	if !s.hasPaid() {
+		// Charge the offers by ID, the gateway catalog has their prices
+		var chargeReq struct {
+			OfferIDs []string `json:"offer_ids,omitempty"`
+		}
+		if s.syncCatalog {
+			if err := s.ensureCatalog(r.Context()); err != nil {
+				s.logger.Error("failed to sync the gateway catalog",
+					"error", err,
+					"remote_addr", r.RemoteAddr,
+				)
+				http.Error(w, "gateway error", http.StatusBadGateway)
+				return
+			}
+			for _, o := range offers {
+				chargeReq.OfferIDs = append(chargeReq.OfferIDs, o.ID)
+			}
 		}
 
 		body, err := json.Marshal(chargeReq)
@@ -147,11 +364,11 @@ func (s *Server) handleGetPrivateResource(w http.ResponseWriter, r *http.Request
 		}
 
 		s.logger.Debug("sending charge request to gateway",
-			"num_offers", len(offers),
+			"offer_ids", chargeReq.OfferIDs,
 			"remote_addr", r.RemoteAddr,
 		)
 
-		resp, err := http.Post("http://localhost:8081/charge", "application/json", bytes.NewBuffer(body))
+		resp, err := s.charge(r.Context(), body)
 		if err != nil {
 			s.logger.Error("failed to contact gateway",
 				"error", err,
@@ -162,10 +379,37 @@ func (s *Server) handleGetPrivateResource(w http.ResponseWriter, r *http.Request
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode != http.StatusOK {
+			s.logger.Error("gateway rejected charge request",
+				"status", resp.StatusCode,
+				"remote_addr", r.RemoteAddr,
+			)
+			http.Error(w, "gateway error", http.StatusBadGateway)
+			return
+		}
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			s.logger.Error("failed to read charge response",
+				"error", err,
+				"remote_addr", r.RemoteAddr,
+			)
+			http.Error(w, "gateway error", http.StatusBadGateway)
+			return
+		}
+		var charge struct {
+			PaymentContextToken string `json:"payment_context_token"`
+		}
+		if json.Unmarshal(data, &charge) == nil && charge.PaymentContextToken != "" {
+			s.mu.Lock()
+			s.charged[charge.PaymentContextToken] = true
+			s.mu.Unlock()
+		}
+
 		// Forward the gateway's response
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusPaymentRequired)
-		io.Copy(w, resp.Body)
+		w.Write(data)
 
 		s.logger.Info("payment required response sent",
 			"remote_addr", r.RemoteAddr,
@@ -188,14 +432,152 @@ func (s *Server) handleGetPrivateResource(w http.ResponseWriter, r *http.Request
 	)
 }
 
+// chargeAttempts is how often a charge is tried while the gateway is
+// unreachable or failing
+const chargeAttempts = 3
+
+// charge asks the gateway for a payment context. Retries carry the same
+// idempotency key, so the gateway creates at most one context.
+func (s *Server) charge(ctx context.Context, body []byte) (*http.Response, error) {
+	key := uuid.NewString()
+	for attempt := 1; ; attempt++ {
+		resp, err := s.chargeOnce(ctx, body, key)
+		if err == nil && resp.StatusCode < 500 || attempt == chargeAttempts {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("gateway answered %s", resp.Status)
+		}
+		s.logger.Warn("charge request failed, retrying",
+			"error", err,
+			"attempt", attempt,
+			"idempotency_key", key,
+		)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * 200 * time.Millisecond):
+		}
+	}
+}
+
+func (s *Server) chargeOnce(ctx context.Context, body []byte, key string) (*http.Response, error) {
+	req, err := s.gatewayRequest(ctx, "POST", "/charge", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Idempotency-Key", key)
+	return s.client.Do(req)
+}
+
+// gatewayRequest returns a request to the gateway API
+func (s *Server) gatewayRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.gatewayURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	}
+	return req, nil
+}
+
+// gatewayCatalog is the part of the gateway catalog the server uses
+type gatewayCatalog struct {
+	Version int          `json:"version"`
+	Offers  []l402.Offer `json:"offers"`
+}
+
+// ensureCatalog puts the offers in the gateway catalog unless they are there
+// already. It is done once, later edits on the gateway are left alone.
+func (s *Server) ensureCatalog(ctx context.Context) error {
+	s.catalogMu.Lock()
+	defer s.catalogMu.Unlock()
+	if s.catalogSynced {
+		return nil
+	}
+
+	req, err := s.gatewayRequest(ctx, "GET", "/catalog", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gateway answered %s", resp.Status)
+	}
+	var current gatewayCatalog
+	if err := json.NewDecoder(resp.Body).Decode(&current); err != nil {
+		return fmt.Errorf("failed to decode catalog: %w", err)
+	}
+
+	if !reflect.DeepEqual(current.Offers, offers) {
+		body, err := json.Marshal(gatewayCatalog{Offers: offers})
+		if err != nil {
+			return err
+		}
+		req, err := s.gatewayRequest(ctx, "PUT", "/catalog", body)
+		if err != nil {
+			return err
+		}
+		// Don't overwrite a catalog changed in the meantime
+		req.Header.Set("If-Match", resp.Header.Get("ETag"))
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return fmt.Errorf("gateway rejected the catalog: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&current); err != nil {
+			return fmt.Errorf("failed to decode catalog: %w", err)
+		}
+	}
+
+	s.logger.Info("gateway catalog synced",
+		"version", current.Version,
+		"num_offers", len(offers),
+	)
+	s.catalogSynced = true
+	return nil
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
 func main() {
-	server := NewServer()
-	server.logger.Info("starting backend server", "port", ":8080")
-	if err := http.ListenAndServe(":8080", server); err != nil {
+	cfg := config.DefaultServer()
+	if err := config.Parse(flag.CommandLine, os.Args[1:], &cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	server := NewServer(cfg)
+	if slices.Contains(cfg.WebhookSecrets, webhook.DevSecret) {
+		server.logger.Warn("accepting webhooks signed with the development secret, set webhook_secrets")
+	}
+	if cfg.APIKey == gateway.DevAdminKey {
+		server.logger.Warn("calling the gateway with the development admin key, set api_key")
+	}
+	srv := &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      server,
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+	}
+	server.logger.Info("starting backend server",
+		"addr", cfg.ListenAddr,
+		"gateway_url", server.gatewayURL,
+	)
+	if err := srv.ListenAndServe(); err != nil {
 		server.logger.Error("server failed to start", "error", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvFile names the config file when --config isn't given
+const EnvFile = "L402_CONFIG"
+
+// Duration is a time.Duration written as "30s" in config files
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// List is a comma separated list of strings in flags and environment
+// variables, and a JSON array in config files
+type List []string
+
+func (l *List) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *List) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// Config is implemented by the config of every command
+type Config interface {
+	// RegisterFlags binds the config fields to flags
+	RegisterFlags(fs *flag.FlagSet)
+
+	// Validate reports the first invalid setting
+	Validate() error
+}
+
+// Parse fills cfg from, in increasing precedence, its defaults, the JSON file
+// given with --config or L402_CONFIG, the environment and the command line
+// flags.
+func Parse(fs *flag.FlagSet, args []string, cfg Config) error {
+	cfg.RegisterFlags(fs)
+	path := fs.String("config", os.Getenv(EnvFile), "JSON config file, flags and environment variables override it")
+
+	// Flags are parsed twice: first to find the config file, then again so
+	// they win over the file and the environment
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path != "" {
+		if err := LoadFile(*path, cfg); err != nil {
+			return err
+		}
+	}
+	if err := ApplyEnv(cfg); err != nil {
+		return err
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
+
+// LoadFile sets the fields of cfg present in the JSON file at path. Unknown
+// fields are rejected to catch typos.
+func LoadFile(path string, cfg any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv sets the fields of cfg, a pointer to a struct, tagged with
+// `env:"NAME"` from the environment variables that are set
+func ApplyEnv(cfg any) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(f reflect.Value, value string) error {
+	if l, ok := f.Addr().Interface().(*List); ok {
+		return l.Set(value)
+	}
+	if d, ok := f.Addr().Interface().(*Duration); ok {
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		d.Duration = v
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(v))
+	case reflect.Bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(v)
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
+
+// checkURL reports whether s is an absolute http(s) URL
+func checkURL(name, s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid %s %q: must be an absolute http(s) URL", name, s)
+	}
+	return nil
+}
+
+var errNoListenAddr = errors.New("listen address is required")
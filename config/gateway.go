@@ -0,0 +1,222 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/l402-protocol/go-example/gateway"
+	"github.com/l402-protocol/go-example/l402"
+	"github.com/l402-protocol/go-example/webhook"
+)
+
+// Gateway configures cmd/gateway
+type Gateway struct {
+	// Address the gateway listens on, e.g. ":8081"
+	ListenAddr string `json:"listen_addr" env:"L402_GATEWAY_LISTEN_ADDR"`
+
+	// Base URL clients reach the gateway at, e.g. behind a reverse proxy.
+	// Payment request and checkout URLs are built from it.
+	PublicURL string `json:"public_url" env:"L402_GATEWAY_PUBLIC_URL"`
+
+	// Backend endpoint receiving payment events
+	WebhookURL     string   `json:"webhook_url" env:"L402_GATEWAY_WEBHOOK_URL"`
+	WebhookTimeout Duration `json:"webhook_timeout" env:"L402_GATEWAY_WEBHOOK_TIMEOUT"`
+
+	// Secrets signing the webhooks of charges without a merchant, newest
+	// last. Merchants have their own.
+	WebhookSecrets List `json:"webhook_secrets" env:"L402_GATEWAY_WEBHOOK_SECRETS"`
+
+	// Delivery of webhooks: events wait in the outbox of the store until
+	// delivered, failed deliveries are retried with exponential backoff
+	WebhookWorkers     int      `json:"webhook_workers" env:"L402_GATEWAY_WEBHOOK_WORKERS"`
+	WebhookMaxAttempts int      `json:"webhook_max_attempts" env:"L402_GATEWAY_WEBHOOK_MAX_ATTEMPTS"`
+	WebhookBackoff     Duration `json:"webhook_backoff" env:"L402_GATEWAY_WEBHOOK_BACKOFF"`
+	WebhookMaxBackoff  Duration `json:"webhook_max_backoff" env:"L402_GATEWAY_WEBHOOK_MAX_BACKOFF"`
+
+	ReadTimeout  Duration `json:"read_timeout" env:"L402_GATEWAY_READ_TIMEOUT"`
+	WriteTimeout Duration `json:"write_timeout" env:"L402_GATEWAY_WRITE_TIMEOUT"`
+
+	ChainURL      string `json:"chain_url" env:"L402_GATEWAY_CHAIN_URL"`
+	Confirmations int    `json:"confirmations" env:"L402_GATEWAY_CONFIRMATIONS"`
+	MockCards     bool   `json:"mock_cards" env:"L402_GATEWAY_MOCK_CARDS"`
+	StoreFile     string `json:"store_file" env:"L402_GATEWAY_STORE_FILE"`
+
+	// How long seen on-chain payments may wait for confirmations past their
+	// expiry, and how long expired addresses are checked for late funds
+	ConfirmTimeout  Duration `json:"confirm_timeout" env:"L402_GATEWAY_CONFIRM_TIMEOUT"`
+	LateFundsWindow Duration `json:"late_funds_window" env:"L402_GATEWAY_LATE_FUNDS_WINDOW"`
+
+	// Merchants created with cmd/merchant. Without it anyone can create
+	// charges, every event goes to WebhookURL and the gateway is managed
+	// with AdminKey.
+	MerchantsFile string `json:"merchants_file" env:"L402_GATEWAY_MERCHANTS_FILE"`
+	AdminKey      string `json:"admin_key" env:"L402_GATEWAY_ADMIN_KEY"`
+
+	// Offer catalog of charges made without merchants, as a JSON array. With
+	// OpenCatalog, merchants with an empty catalog may charge any offers.
+	CatalogFile string `json:"catalog_file" env:"L402_GATEWAY_CATALOG_FILE"`
+	OpenCatalog bool   `json:"open_catalog" env:"L402_GATEWAY_OPEN_CATALOG"`
+
+	// Checkout page templates overriding the built-in ones, with a
+	// subdirectory per merchant
+	TemplatesDir string `json:"templates_dir" env:"L402_GATEWAY_TEMPLATES_DIR"`
+
+	ContextTTL    Duration `json:"context_ttl" env:"L402_GATEWAY_CONTEXT_TTL"`
+	FakeTTL       Duration `json:"fake_ttl" env:"L402_GATEWAY_FAKE_TTL"`
+	CardTTL       Duration `json:"card_ttl" env:"L402_GATEWAY_CARD_TTL"`
+	OnchainTTL    Duration `json:"onchain_ttl" env:"L402_GATEWAY_ONCHAIN_TTL"`
+	SweepInterval Duration `json:"sweep_interval" env:"L402_GATEWAY_SWEEP_INTERVAL"`
+
+	// Responses to requests with an Idempotency-Key, and how long they are
+	// replayed
+	IdempotencyFile string   `json:"idempotency_file" env:"L402_GATEWAY_IDEMPOTENCY_FILE"`
+	IdempotencyTTL  Duration `json:"idempotency_ttl" env:"L402_GATEWAY_IDEMPOTENCY_TTL"`
+}
+
+// DefaultGateway returns the config of a gateway running next to the
+// example server on localhost
+func DefaultGateway() Gateway {
+	return Gateway{
+		ListenAddr:     ":8081",
+		PublicURL:      gateway.DefaultPublicURL,
+		WebhookURL:     gateway.DefaultWebhookURL,
+		WebhookTimeout: Duration{gateway.DefaultWebhookTimeout},
+		WebhookSecrets: List{webhook.DevSecret},
+		AdminKey:       gateway.DevAdminKey,
+
+		WebhookWorkers:     gateway.DefaultWebhookWorkers,
+		WebhookMaxAttempts: gateway.DefaultWebhookMaxAttempts,
+		WebhookBackoff:     Duration{gateway.DefaultWebhookBackoff},
+		WebhookMaxBackoff:  Duration{gateway.DefaultWebhookMaxBackoff},
+
+		ReadTimeout:   Duration{15 * time.Second},
+		WriteTimeout:  Duration{time.Minute},
+		Confirmations: 1,
+		MockCards:     true,
+
+		ConfirmTimeout:  Duration{gateway.DefaultConfirmTimeout},
+		LateFundsWindow: Duration{gateway.DefaultLateFundsWindow},
+
+		ContextTTL:    Duration{gateway.DefaultContextTTL},
+		FakeTTL:       Duration{gateway.DefaultPaymentTTLs[l402.FakePay]},
+		CardTTL:       Duration{gateway.DefaultPaymentTTLs[l402.CreditCard]},
+		OnchainTTL:    Duration{gateway.DefaultPaymentTTLs[l402.Onchain]},
+		SweepInterval: Duration{gateway.DefaultSweepInterval},
+
+		IdempotencyTTL: Duration{gateway.DefaultIdempotencyTTL},
+	}
+}
+
+func (c *Gateway) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "Address to listen on")
+	fs.StringVar(&c.PublicURL, "public-url", c.PublicURL, "Base URL clients reach the gateway at")
+	fs.StringVar(&c.WebhookURL, "webhook-url", c.WebhookURL, "Backend endpoint receiving payment events")
+	fs.DurationVar(&c.WebhookTimeout.Duration, "webhook-timeout", c.WebhookTimeout.Duration, "Timeout of webhook calls to the backend")
+	fs.Var(&c.WebhookSecrets, "webhook-secrets", "Comma separated secrets signing webhooks of charges without a merchant")
+	fs.IntVar(&c.WebhookWorkers, "webhook-workers", c.WebhookWorkers, "Number of webhook deliveries made in parallel")
+	fs.IntVar(&c.WebhookMaxAttempts, "webhook-max-attempts", c.WebhookMaxAttempts, "Attempts before a webhook delivery is dead")
+	fs.DurationVar(&c.WebhookBackoff.Duration, "webhook-backoff", c.WebhookBackoff.Duration, "Delay before the first webhook retry, doubled after every failure")
+	fs.DurationVar(&c.WebhookMaxBackoff.Duration, "webhook-max-backoff", c.WebhookMaxBackoff.Duration, "Longest delay between webhook retries")
+	fs.DurationVar(&c.ReadTimeout.Duration, "read-timeout", c.ReadTimeout.Duration, "Maximum duration for reading a request")
+	fs.DurationVar(&c.WriteTimeout.Duration, "write-timeout", c.WriteTimeout.Duration, "Maximum duration for writing a response")
+	fs.StringVar(&c.ChainURL, "chain-url", c.ChainURL, "URL of the simulated chain, enables on-chain payments")
+	fs.IntVar(&c.Confirmations, "confirmations", c.Confirmations, "Confirmations required for on-chain payments")
+	fs.DurationVar(&c.ConfirmTimeout.Duration, "confirm-timeout", c.ConfirmTimeout.Duration, "How long a seen on-chain payment may wait for confirmations past its expiry")
+	fs.DurationVar(&c.LateFundsWindow.Duration, "late-funds-window", c.LateFundsWindow.Duration, "How long addresses of expired payments are checked for late funds")
+	fs.BoolVar(&c.MockCards, "mock-cards", c.MockCards, "Accept card payments through the mock card processor")
+	fs.StringVar(&c.StoreFile, "store-file", c.StoreFile, "Persist payment contexts and undelivered webhook events to this database file instead of memory")
+	fs.StringVar(&c.MerchantsFile, "merchants-file", c.MerchantsFile, "Require merchant API keys from this file to create charges")
+	fs.StringVar(&c.AdminKey, "admin-key", c.AdminKey, "API key managing the gateway when merchants aren't configured")
+	fs.StringVar(&c.CatalogFile, "catalog-file", c.CatalogFile, "JSON offers charged when merchants aren't configured")
+	fs.BoolVar(&c.OpenCatalog, "open-catalog", c.OpenCatalog, "Let merchants with an empty catalog charge any offers")
+	fs.StringVar(&c.TemplatesDir, "templates-dir", c.TemplatesDir, "Directory with checkout page templates overriding the built-in ones")
+	fs.DurationVar(&c.ContextTTL.Duration, "context-ttl", c.ContextTTL.Duration, "How long a charge waits for a payment request")
+	fs.DurationVar(&c.FakeTTL.Duration, "fake-ttl", c.FakeTTL.Duration, "How long a fake-pay payment request stays open")
+	fs.DurationVar(&c.CardTTL.Duration, "card-ttl", c.CardTTL.Duration, "How long a card payment request stays open")
+	fs.DurationVar(&c.OnchainTTL.Duration, "onchain-ttl", c.OnchainTTL.Duration, "How long an on-chain payment request stays open")
+	fs.DurationVar(&c.SweepInterval.Duration, "sweep-interval", c.SweepInterval.Duration, "How often expired payment contexts are looked for")
+	fs.StringVar(&c.IdempotencyFile, "idempotency-file", c.IdempotencyFile, "Persist idempotency keys to this file instead of memory")
+	fs.DurationVar(&c.IdempotencyTTL.Duration, "idempotency-ttl", c.IdempotencyTTL.Duration, "How long responses to requests with an Idempotency-Key are replayed")
+}
+
+func (c *Gateway) Validate() error {
+	if c.ListenAddr == "" {
+		return errNoListenAddr
+	}
+	if err := checkURL("public_url", c.PublicURL); err != nil {
+		return err
+	}
+	if err := checkURL("webhook_url", c.WebhookURL); err != nil {
+		return err
+	}
+	if len(c.WebhookSecrets) == 0 {
+		return errors.New("at least one webhook secret is required")
+	}
+	if c.ChainURL != "" {
+		if err := checkURL("chain_url", c.ChainURL); err != nil {
+			return err
+		}
+	}
+	if c.WebhookWorkers < 1 {
+		return errors.New("invalid webhook_workers: must be at least 1")
+	}
+	if c.WebhookMaxAttempts < 1 {
+		return errors.New("invalid webhook_max_attempts: must be at least 1")
+	}
+	if c.Confirmations < 0 {
+		return errors.New("invalid confirmations: must not be negative")
+	}
+
+	durations := []struct {
+		name string
+		d    Duration
+	}{
+		{"webhook_timeout", c.WebhookTimeout},
+		{"webhook_backoff", c.WebhookBackoff},
+		{"webhook_max_backoff", c.WebhookMaxBackoff},
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"context_ttl", c.ContextTTL},
+		{"fake_ttl", c.FakeTTL},
+		{"card_ttl", c.CardTTL},
+		{"onchain_ttl", c.OnchainTTL},
+		{"confirm_timeout", c.ConfirmTimeout},
+		{"late_funds_window", c.LateFundsWindow},
+		{"sweep_interval", c.SweepInterval},
+		{"idempotency_ttl", c.IdempotencyTTL},
+	}
+	for _, d := range durations {
+		if d.d.Duration < 0 {
+			return fmt.Errorf("invalid %s: must not be negative", d.name)
+		}
+	}
+	return nil
+}
+
+// Options returns the gateway options matching the config, except the
+// stores, chain and card processor which the caller builds
+func (c *Gateway) Options() []gateway.Option {
+	opts := []gateway.Option{
+		gateway.WithPublicURL(c.PublicURL),
+		gateway.WithWebhook(c.WebhookURL, c.WebhookTimeout.Duration),
+		gateway.WithWebhookSecrets(c.WebhookSecrets...),
+		gateway.WithWebhookRetries(c.WebhookWorkers, c.WebhookMaxAttempts, c.WebhookBackoff.Duration, c.WebhookMaxBackoff.Duration),
+		gateway.WithHTTPTimeouts(c.ReadTimeout.Duration, c.WriteTimeout.Duration),
+		gateway.WithTTLs(c.ContextTTL.Duration, map[l402.PaymentMethods]time.Duration{
+			l402.FakePay:    c.FakeTTL.Duration,
+			l402.CreditCard: c.CardTTL.Duration,
+			l402.Onchain:    c.OnchainTTL.Duration,
+		}),
+		gateway.WithSweepInterval(c.SweepInterval.Duration),
+		gateway.WithOnchainTimeouts(c.ConfirmTimeout.Duration, c.LateFundsWindow.Duration),
+		gateway.WithIdempotencyTTL(c.IdempotencyTTL.Duration),
+		gateway.WithTemplates(c.TemplatesDir),
+		gateway.WithAdminKey(c.AdminKey),
+	}
+	if c.OpenCatalog {
+		opts = append(opts, gateway.WithOpenCatalog())
+	}
+	return opts
+}
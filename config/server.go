@@ -0,0 +1,92 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/l402-protocol/go-example/gateway"
+	"github.com/l402-protocol/go-example/webhook"
+)
+
+// Server configures cmd/server
+type Server struct {
+	// Address the server listens on, e.g. ":8080"
+	ListenAddr string `json:"listen_addr" env:"L402_SERVER_LISTEN_ADDR"`
+
+	// Base URL of the gateway charges are created at
+	GatewayURL     string   `json:"gateway_url" env:"L402_SERVER_GATEWAY_URL"`
+	GatewayTimeout Duration `json:"gateway_timeout" env:"L402_SERVER_GATEWAY_TIMEOUT"`
+
+	// Merchant API key, or the admin key of gateways without merchants
+	APIKey string `json:"api_key" env:"L402_SERVER_API_KEY"`
+
+	// Put the server offers in the gateway catalog before the first charge.
+	// Without it the catalog is managed on the gateway and charged whole.
+	SyncCatalog bool `json:"sync_catalog" env:"L402_SERVER_SYNC_CATALOG"`
+
+	// Secrets payment webhooks may be signed with, and how old they may be
+	WebhookSecrets   List     `json:"webhook_secrets" env:"L402_SERVER_WEBHOOK_SECRETS"`
+	WebhookTolerance Duration `json:"webhook_tolerance" env:"L402_SERVER_WEBHOOK_TOLERANCE"`
+
+	ReadTimeout  Duration `json:"read_timeout" env:"L402_SERVER_READ_TIMEOUT"`
+	WriteTimeout Duration `json:"write_timeout" env:"L402_SERVER_WRITE_TIMEOUT"`
+}
+
+// DefaultServer returns the config of a server using a gateway on localhost
+func DefaultServer() Server {
+	return Server{
+		ListenAddr:     ":8080",
+		GatewayURL:     "http://localhost:8081",
+		GatewayTimeout: Duration{10 * time.Second},
+		APIKey:         gateway.DevAdminKey,
+		SyncCatalog:    true,
+
+		WebhookSecrets:   List{webhook.DevSecret},
+		WebhookTolerance: Duration{webhook.DefaultTolerance},
+
+		ReadTimeout:  Duration{15 * time.Second},
+		WriteTimeout: Duration{time.Minute},
+	}
+}
+
+func (c *Server) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "Address to listen on")
+	fs.StringVar(&c.GatewayURL, "gateway-url", c.GatewayURL, "Base URL of the gateway")
+	fs.StringVar(&c.APIKey, "api-key", c.APIKey, "Merchant or admin API key sent to the gateway")
+	fs.BoolVar(&c.SyncCatalog, "sync-catalog", c.SyncCatalog, "Put the server offers in the gateway catalog")
+	fs.DurationVar(&c.GatewayTimeout.Duration, "gateway-timeout", c.GatewayTimeout.Duration, "Timeout of calls to the gateway")
+	fs.Var(&c.WebhookSecrets, "webhook-secrets", "Comma separated secrets payment webhooks may be signed with")
+	fs.DurationVar(&c.WebhookTolerance.Duration, "webhook-tolerance", c.WebhookTolerance.Duration, "How old a payment webhook may be")
+	fs.DurationVar(&c.ReadTimeout.Duration, "read-timeout", c.ReadTimeout.Duration, "Maximum duration for reading a request")
+	fs.DurationVar(&c.WriteTimeout.Duration, "write-timeout", c.WriteTimeout.Duration, "Maximum duration for writing a response")
+}
+
+func (c *Server) Validate() error {
+	if c.ListenAddr == "" {
+		return errNoListenAddr
+	}
+	if err := checkURL("gateway_url", c.GatewayURL); err != nil {
+		return err
+	}
+	if len(c.WebhookSecrets) == 0 {
+		return errors.New("at least one webhook secret is required")
+	}
+
+	durations := []struct {
+		name string
+		d    Duration
+	}{
+		{"gateway_timeout", c.GatewayTimeout},
+		{"webhook_tolerance", c.WebhookTolerance},
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+	}
+	for _, d := range durations {
+		if d.d.Duration < 0 {
+			return fmt.Errorf("invalid %s: must not be negative", d.name)
+		}
+	}
+	return nil
+}
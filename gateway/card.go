@@ -0,0 +1,369 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/l402-protocol/go-example/cardproc"
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// CardProcessor charges tokenized cards, see cardproc for a mock
+type CardProcessor interface {
+	CreateCharge(ctx context.Context, token string, amount int, currency, description string, metadata map[string]string) (*cardproc.Charge, error)
+	CompleteChallenge(ctx context.Context, chargeID, code string) (*cardproc.Charge, error)
+	Charge(ctx context.Context, chargeID string) (*cardproc.Charge, error)
+	Refund(ctx context.Context, chargeID string, amount int) (*cardproc.Refund, error)
+}
+
+// WithCardProcessor enables credit card payments through a hosted checkout
+func WithCardProcessor(p CardProcessor) Option {
+	return func(g *Gateway) {
+		g.cards = p
+		g.providers.Register(&cardProvider{g})
+	}
+}
+
+// cardCheckoutResponse is returned to clients asking for JSON
+type cardCheckoutResponse struct {
+	Status       cardproc.Status `json:"status"`
+	ChargeID     string          `json:"charge_id,omitempty"`
+	ChallengeURL string          `json:"challenge_url,omitempty"`
+	Message      string          `json:"message,omitempty"`
+}
+
+// cardProvider takes tokenized cards on the gateway card checkout
+type cardProvider struct {
+	g *Gateway
+}
+
+func (p *cardProvider) Method() l402.PaymentMethods {
+	return l402.CreditCard
+}
+
+func (p *cardProvider) Capabilities() Capabilities {
+	return Capabilities{HostedCheckout: true, Refunds: true, PartialRefunds: true}
+}
+
+func (p *cardProvider) RequestPayment(ctx context.Context, pc *PaymentContext, offer l402.Offer, req l402.PaymentRequestRequest) (l402.PayReq, error) {
+	return l402.PayReq{
+		CheckoutURL: p.g.url("/card-checkout", url.Values{
+			"payment_context_token": {pc.Token},
+			"offer_id":              {offer.ID},
+		}),
+	}, nil
+}
+
+// Status looks up the last card charge of pc
+func (p *cardProvider) Status(ctx context.Context, pc *PaymentContext) (ContextStatus, error) {
+	if pc.ChargeID == "" {
+		return pc.Status, nil
+	}
+	charge, err := p.g.cards.Charge(ctx, pc.ChargeID)
+	if err != nil {
+		return "", err
+	}
+	switch charge.Status {
+	case cardproc.StatusSucceeded:
+		return StatusPaid, nil
+	case cardproc.StatusRequiresAction:
+		return StatusPending, nil
+	case cardproc.StatusDeclined, cardproc.StatusFailed:
+		return StatusFailed, nil
+	}
+	return pc.Status, nil
+}
+
+// Cancel leaves open charges alone, abandoned challenges fail on expiry
+func (p *cardProvider) Cancel(ctx context.Context, pc *PaymentContext) error {
+	return nil
+}
+
+// Refund refunds the card charge that paid pc
+func (p *cardProvider) Refund(ctx context.Context, pc *PaymentContext, amount int) (string, error) {
+	if pc.ChargeID == "" {
+		return "", fmt.Errorf("no card charge for payment context %s", pc.Token)
+	}
+	refund, err := p.g.cards.Refund(ctx, pc.ChargeID, amount)
+	if err != nil {
+		return "", err
+	}
+	return refund.ID, nil
+}
+
+// handleCardCheckoutPage shows the hosted card form
+func (g *Gateway) handleCardCheckoutPage(w http.ResponseWriter, r *http.Request) {
+	paymentContext := r.URL.Query().Get("payment_context_token")
+	offerID := r.URL.Query().Get("offer_id")
+
+	pc, offer, err := g.selectedOffer(r.Context(), paymentContext, offerID, l402.CreditCard)
+	if err != nil {
+		g.writePageError(w, r, paymentContext, offerID, err)
+		return
+	}
+	data := g.newPageData(pc, offer)
+	data.CSRFToken = g.csrfToken(w, r, pc.Token)
+	g.render(w, pc.MerchantID, pageCard, http.StatusOK, data)
+}
+
+// handleCardCheckout charges the submitted card
+func (g *Gateway) handleCardCheckout(w http.ResponseWriter, r *http.Request) {
+	paymentContext := r.FormValue("payment_context_token")
+	offerID := r.FormValue("offer_id")
+	cardToken := r.FormValue("card_token")
+
+	if !g.checkCSRF(r, paymentContext) {
+		g.logger.Warn("card checkout without a valid CSRF token",
+			"payment_context", paymentContext,
+			"remote_addr", r.RemoteAddr,
+		)
+		http.Error(w, errInvalidCSRF.Error(), http.StatusForbidden)
+		return
+	}
+
+	_, offer, err := g.selectedOffer(r.Context(), paymentContext, offerID, l402.CreditCard)
+	if err != nil {
+		writeContextError(w, err)
+		return
+	}
+	if cardToken == "" {
+		http.Error(w, "missing card token", http.StatusBadRequest)
+		return
+	}
+
+	// Reserve the payment context before charging the card, so a second
+	// submit finds it pending instead of charging twice. The charge of an
+	// earlier, failed attempt is dropped.
+	var prev ContextStatus
+	if _, err := g.update(r.Context(), paymentContext, func(pc *PaymentContext) error {
+		if pc.PaymentMethod != "" && pc.PaymentMethod != l402.CreditCard {
+			return errMethodMismatch
+		}
+		prev = pc.Status
+		if err := pc.Transition(StatusPending, "card charge started", g.clock.Now()); err != nil {
+			return err
+		}
+		pc.ChargeID = ""
+		return nil
+	}); err != nil {
+		writeContextError(w, err)
+		return
+	}
+
+	// Finish what was started with the card even if the client went away
+	ctx := context.WithoutCancel(r.Context())
+	charge, err := g.cards.CreateCharge(ctx, cardToken, offer.Amount, offer.Currency, offer.Title,
+		map[string]string{
+			"payment_context_token": paymentContext,
+			"offer_id":              offerID,
+		})
+	if err != nil {
+		g.logger.Warn("card charge failed",
+			"error", err,
+			"payment_context", paymentContext,
+		)
+		g.releaseCardCheckout(ctx, paymentContext, prev, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := g.update(ctx, paymentContext, func(pc *PaymentContext) error {
+		if pc.Status != StatusPending || pc.ChargeID != "" {
+			return fmt.Errorf("payment context %s is no longer reserved for charge %s", pc.Token, charge.ID)
+		}
+		pc.ChargeID = charge.ID
+		return nil
+	}); err != nil {
+		g.logger.Error("failed to store charge",
+			"error", err,
+			"charge_id", charge.ID,
+		)
+	}
+
+	g.logger.Info("card charge created",
+		"charge_id", charge.ID,
+		"status", charge.Status,
+		"payment_context", paymentContext,
+		"offer_id", offerID,
+	)
+
+	g.writeCardResult(w, r, charge)
+}
+
+// releaseCardCheckout puts a payment context reserved for a card charge
+// back in the status it had before, when the charge could not be made
+func (g *Gateway) releaseCardCheckout(ctx context.Context, token string, prev ContextStatus, chargeErr error) {
+	_, err := g.update(ctx, token, func(pc *PaymentContext) error {
+		if pc.Status != StatusPending || pc.ChargeID != "" {
+			return nil
+		}
+		pc.History = append(pc.History, Transition{
+			From:   pc.Status,
+			To:     prev,
+			Reason: "card charge failed: " + chargeErr.Error(),
+			At:     g.clock.Now().UTC(),
+		})
+		pc.Status = prev
+		return nil
+	})
+	if err != nil {
+		g.logger.Error("failed to release card checkout",
+			"error", err,
+			"payment_context", token,
+		)
+	}
+}
+
+// handleCardChallengePage shows the simulated 3-D Secure challenge
+func (g *Gateway) handleCardChallengePage(w http.ResponseWriter, r *http.Request) {
+	chargeID := r.URL.Query().Get("charge_id")
+	paymentContext := r.URL.Query().Get("payment_context_token")
+
+	pc, err := g.get(r.Context(), paymentContext)
+	if err != nil {
+		g.writePageError(w, r, paymentContext, "", err)
+		return
+	}
+	offer, _ := pc.Offer(pc.OfferID)
+	data := g.newPageData(pc, offer)
+	data.ChargeID = chargeID
+	data.CSRFToken = g.csrfToken(w, r, pc.Token)
+	g.render(w, pc.MerchantID, pageChallenge, http.StatusOK, data)
+}
+
+// handleCardChallenge completes a 3-D Secure challenge
+func (g *Gateway) handleCardChallenge(w http.ResponseWriter, r *http.Request) {
+	chargeID := r.FormValue("charge_id")
+	paymentContext := r.FormValue("payment_context_token")
+	code := r.FormValue("code")
+
+	if !g.checkCSRF(r, paymentContext) {
+		g.logger.Warn("card challenge without a valid CSRF token",
+			"payment_context", paymentContext,
+			"remote_addr", r.RemoteAddr,
+		)
+		http.Error(w, errInvalidCSRF.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Only the open challenge of a pending payment can be answered
+	pc, err := g.get(r.Context(), paymentContext)
+	if err != nil {
+		writeContextError(w, err)
+		return
+	}
+	if pc.ChargeID != chargeID || pc.Status != StatusPending {
+		http.Error(w, "no open challenge for this charge", http.StatusConflict)
+		return
+	}
+
+	// Like the charge, a completed challenge must be recorded even if the
+	// client goes away
+	charge, err := g.cards.CompleteChallenge(context.WithoutCancel(r.Context()), chargeID, code)
+	if err != nil {
+		g.logger.Warn("card challenge failed",
+			"error", err,
+			"charge_id", chargeID,
+		)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g.logger.Info("card challenge answered",
+		"charge_id", charge.ID,
+		"status", charge.Status,
+	)
+
+	g.writeCardResult(w, r, charge)
+}
+
+func (g *Gateway) writeCardResult(w http.ResponseWriter, r *http.Request, charge *cardproc.Charge) {
+	resp := cardCheckoutResponse{
+		Status:   charge.Status,
+		ChargeID: charge.ID,
+	}
+	code := http.StatusOK
+
+	paymentContext := charge.Metadata["payment_context_token"]
+
+	// The processor already has the outcome, record it even if the client
+	// went away
+	ctx := context.WithoutCancel(r.Context())
+
+	var err error
+	switch charge.Status {
+	case cardproc.StatusSucceeded:
+		err = g.settle(ctx, paymentContext, "card charge "+charge.ID+" succeeded")
+	case cardproc.StatusRequiresAction:
+		// Wrong challenge codes leave the charge waiting for another try
+		if pc, getErr := g.store.Get(ctx, paymentContext); getErr == nil && pc.Status != StatusPending {
+			_, err = g.transition(ctx, paymentContext, StatusPending, "card charge "+charge.ID+" requires authentication")
+		}
+	default:
+		_, err = g.transition(ctx, paymentContext, StatusFailed, "card charge "+charge.ID+" "+string(charge.Status))
+	}
+	if err != nil {
+		g.logger.Error("failed to record card charge",
+			"error", err,
+			"charge_id", charge.ID,
+		)
+		writeContextError(w, err)
+		return
+	}
+
+	switch charge.Status {
+	case cardproc.StatusSucceeded:
+		w.Header().Set(l402.PaymentStatusHeader, l402.PaymentStatusPaid)
+		resp.Message = "payment successful"
+
+	case cardproc.StatusRequiresAction:
+		q := url.Values{}
+		q.Set("charge_id", charge.ID)
+		q.Set("payment_context_token", paymentContext)
+		resp.ChallengeURL = g.url("/card-checkout/challenge", q)
+		resp.Message = "card requires authentication"
+		if !wantsJSON(r) {
+			http.Redirect(w, r, resp.ChallengeURL, http.StatusSeeOther)
+			return
+		}
+
+	default:
+		w.Header().Set(l402.PaymentStatusHeader, string(charge.Status))
+		resp.Message = "card " + string(charge.Status)
+		if charge.DeclineCode != "" {
+			resp.Message += ": " + charge.DeclineCode
+		}
+		code = http.StatusPaymentRequired
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	pc, err := g.store.Get(r.Context(), paymentContext)
+	if err != nil {
+		writeContextError(w, err)
+		return
+	}
+	offer, _ := pc.Offer(charge.Metadata["offer_id"])
+	data := g.newPageData(pc, offer)
+	data.ChargeID = charge.ID
+	data.Message = resp.Message
+
+	page := pageFailure
+	if charge.Status == cardproc.StatusSucceeded {
+		page = pageSuccess
+	}
+	g.render(w, pc.MerchantID, page, code, data)
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,356 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+var (
+	ErrInvalidOffer    = errors.New("invalid offer")
+	ErrCatalogConflict = errors.New("catalog changed since the given version")
+
+	errOfferNotInCatalog = errors.New("offer does not match the catalog")
+)
+
+// Catalog is the versioned offer catalog of a merchant. Every change bumps
+// the version, which is also the ETag of the catalog API.
+type Catalog struct {
+	MerchantID string       `json:"merchant_id"`
+	Version    int          `json:"version"`
+	Offers     []l402.Offer `json:"offers"`
+}
+
+// ValidateOffers checks offers can be put in a catalog
+func ValidateOffers(offers []l402.Offer) error {
+	seen := make(map[string]bool)
+	for _, o := range offers {
+		switch {
+		case o.ID == "":
+			return fmt.Errorf("%w: every offer needs an ID", ErrInvalidOffer)
+		case seen[o.ID]:
+			return fmt.Errorf("%w: duplicate offer %s", ErrInvalidOffer, o.ID)
+		case o.Amount <= 0:
+			return fmt.Errorf("%w: offer %s needs a positive amount", ErrInvalidOffer, o.ID)
+		case o.Currency == "":
+			return fmt.Errorf("%w: offer %s has no currency", ErrInvalidOffer, o.ID)
+		case len(o.PaymentMethods) == 0:
+			return fmt.Errorf("%w: offer %s has no payment methods", ErrInvalidOffer, o.ID)
+		}
+		seen[o.ID] = true
+	}
+	return nil
+}
+
+// ReadOffers reads a JSON array of offers
+func ReadOffers(path string) ([]l402.Offer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var offers []l402.Offer
+	if err := json.Unmarshal(data, &offers); err != nil {
+		return nil, fmt.Errorf("failed to parse offers: %w", err)
+	}
+	if err := ValidateOffers(offers); err != nil {
+		return nil, err
+	}
+	return offers, nil
+}
+
+// Catalog returns the offer catalog of the merchant
+func (m *Merchant) Catalog() Catalog {
+	offers := m.Offers
+	if offers == nil {
+		offers = []l402.Offer{}
+	}
+	return Catalog{
+		MerchantID: m.ID,
+		Version:    m.CatalogVersion,
+		Offers:     offers,
+	}
+}
+
+// SetOffers replaces the offer catalog
+func (m *Merchant) SetOffers(offers []l402.Offer) error {
+	if err := ValidateOffers(offers); err != nil {
+		return err
+	}
+	m.Offers = offers
+	m.CatalogVersion++
+	return nil
+}
+
+// PutOffer adds an offer to the catalog, replacing the one with its ID
+func (m *Merchant) PutOffer(offer l402.Offer) error {
+	offers := slices.Clone(m.Offers)
+	i := slices.IndexFunc(offers, func(o l402.Offer) bool { return o.ID == offer.ID })
+	if i < 0 {
+		offers = append(offers, offer)
+	} else {
+		offers[i] = offer
+	}
+	return m.SetOffers(offers)
+}
+
+// RemoveOffer removes an offer from the catalog. Payment contexts already
+// charging it are not affected.
+func (m *Merchant) RemoveOffer(id string) error {
+	i := slices.IndexFunc(m.Offers, func(o l402.Offer) bool { return o.ID == id })
+	if i < 0 {
+		return fmt.Errorf("%w: %s", errOfferNotFound, id)
+	}
+	return m.SetOffers(slices.Delete(slices.Clone(m.Offers), i, i+1))
+}
+
+// sameOffer reports whether two offers are identical
+func sameOffer(a, b l402.Offer) bool {
+	return a.ID == b.ID &&
+		a.Title == b.Title &&
+		a.Description == b.Description &&
+		a.Type == b.Type &&
+		a.Balance == b.Balance &&
+		a.Amount == b.Amount &&
+		a.Currency == b.Currency &&
+		slices.Equal(a.PaymentMethods, b.PaymentMethods)
+}
+
+// WithCatalog sets the offer catalog of charges made without a merchant
+func WithCatalog(offers []l402.Offer) Option {
+	return func(g *Gateway) {
+		ctx := context.Background()
+		m, err := g.defaultMerchant.Get(ctx, DefaultMerchant)
+		if err == nil {
+			err = m.SetOffers(offers)
+		}
+		if err == nil {
+			err = g.defaultMerchant.Put(ctx, m)
+		}
+		if err != nil {
+			g.logger.Error("failed to set the default catalog",
+				"error", err,
+			)
+		}
+	}
+}
+
+// WithOpenCatalog lets merchants with an empty catalog charge any offers.
+// Without merchants that is anyone, so only use it with trusted callers.
+func WithOpenCatalog() Option {
+	return func(g *Gateway) {
+		g.openCatalog = true
+	}
+}
+
+// newDefaultMerchantStore returns the store of the open merchant charges
+// are made by when merchants aren't configured
+func newDefaultMerchantStore() *MemoryMerchantStore {
+	s := NewMemoryMerchantStore()
+	s.Put(context.Background(), &Merchant{ID: DefaultMerchant})
+	return s
+}
+
+// merchantStore returns where the merchants making charges are kept
+func (g *Gateway) merchantStore() MerchantStore {
+	if g.merchants == nil {
+		return g.defaultMerchant
+	}
+	return g.merchants
+}
+
+// chargeOffers returns the offers a charge request of m is for. Offers
+// given in the request must be identical to the catalog ones, so prices
+// can't be changed per request.
+func (g *Gateway) chargeOffers(m *Merchant, req ChargeRequest) ([]l402.Offer, error) {
+	if len(req.Offers) == 0 {
+		return m.catalogOffers(req.OfferIDs)
+	}
+	if len(m.Offers) == 0 && g.openCatalog {
+		// Merchants without a catalog price every charge themselves
+		return req.Offers, nil
+	}
+
+	offers := make([]l402.Offer, 0, len(req.Offers))
+	for _, o := range req.Offers {
+		found, err := m.catalogOffers([]string{o.ID})
+		if err != nil {
+			return nil, err
+		}
+		if !sameOffer(o, found[0]) {
+			return nil, fmt.Errorf("%w: %s", errOfferNotInCatalog, o.ID)
+		}
+		offers = append(offers, found[0])
+	}
+	return offers, nil
+}
+
+// updateCatalog changes the catalog of the merchant making the request, which
+// needs its API key or the admin key. With If-Match, the change is only made
+// against that catalog version.
+func (g *Gateway) updateCatalog(r *http.Request, fn func(*Merchant) error) (*Merchant, error) {
+	merchant, err := g.authenticateKey(r)
+	if err != nil {
+		return nil, err
+	}
+
+	g.catalogMu.Lock()
+	defer g.catalogMu.Unlock()
+
+	m, err := g.merchantStore().Get(r.Context(), merchant.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !matchVersion(r.Header.Get("If-Match"), m.CatalogVersion) {
+		return nil, ErrCatalogConflict
+	}
+	if err := fn(m); err != nil {
+		return nil, err
+	}
+	if err := g.merchantStore().Put(r.Context(), m); err != nil {
+		return nil, err
+	}
+
+	g.logger.Info("catalog updated",
+		"merchant_id", m.ID,
+		"version", m.CatalogVersion,
+		"num_offers", len(m.Offers),
+	)
+	return m, nil
+}
+
+// catalogETag is the ETag of a catalog version
+func catalogETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// matchVersion reports whether an If-Match header matches a catalog version
+func matchVersion(ifMatch string, version int) bool {
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == catalogETag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCatalog answers with the catalog of m
+func writeCatalog(w http.ResponseWriter, m *Merchant) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", catalogETag(m.CatalogVersion))
+	json.NewEncoder(w).Encode(m.Catalog())
+}
+
+// writeCatalogError answers a catalog request that failed
+func (g *Gateway) writeCatalogError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidAPIKey), errors.Is(err, ErrMerchantNotFound):
+		writeAuthError(w)
+	case errors.Is(err, ErrCatalogConflict):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, errOfferNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidOffer):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		g.logger.Error("catalog request failed",
+			"error", err,
+		)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// handleGetCatalog returns the offer catalog of the merchant
+func (g *Gateway) handleGetCatalog(w http.ResponseWriter, r *http.Request) {
+	m, err := g.authenticate(r)
+	if err != nil {
+		writeAuthError(w)
+		return
+	}
+	writeCatalog(w, m)
+}
+
+// handlePutCatalog replaces the offer catalog of the merchant
+func (g *Gateway) handlePutCatalog(w http.ResponseWriter, r *http.Request) {
+	var req Catalog
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	m, err := g.updateCatalog(r, func(m *Merchant) error {
+		return m.SetOffers(req.Offers)
+	})
+	if err != nil {
+		g.writeCatalogError(w, err)
+		return
+	}
+	writeCatalog(w, m)
+}
+
+// handleGetOffer returns an offer of the merchant catalog
+func (g *Gateway) handleGetOffer(w http.ResponseWriter, r *http.Request) {
+	m, err := g.authenticate(r)
+	if err != nil {
+		writeAuthError(w)
+		return
+	}
+	offers, err := m.catalogOffers([]string{r.PathValue("id")})
+	if err != nil {
+		g.writeCatalogError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", catalogETag(m.CatalogVersion))
+	json.NewEncoder(w).Encode(offers[0])
+}
+
+// handlePutOffer adds or replaces an offer of the merchant catalog
+func (g *Gateway) handlePutOffer(w http.ResponseWriter, r *http.Request) {
+	var offer l402.Offer
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	if offer.ID == "" {
+		offer.ID = id
+	}
+	if offer.ID != id {
+		http.Error(w, "offer ID does not match the URL", http.StatusBadRequest)
+		return
+	}
+
+	m, err := g.updateCatalog(r, func(m *Merchant) error {
+		return m.PutOffer(offer)
+	})
+	if err != nil {
+		g.writeCatalogError(w, err)
+		return
+	}
+	writeCatalog(w, m)
+}
+
+// handleDeleteOffer removes an offer from the merchant catalog
+func (g *Gateway) handleDeleteOffer(w http.ResponseWriter, r *http.Request) {
+	m, err := g.updateCatalog(r, func(m *Merchant) error {
+		return m.RemoveOffer(r.PathValue("id"))
+	})
+	if err != nil {
+		g.writeCatalogError(w, err)
+		return
+	}
+	writeCatalog(w, m)
+}
@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the gateway the time. Expiry decisions go through it so they
+// can be tested without waiting.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock that only moves when told to
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// WithClock makes the gateway use c instead of the system clock
+func WithClock(c Clock) Option {
+	return func(g *Gateway) {
+		g.clock = c
+	}
+}
@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// CSRF protection of the checkout forms. The browser gets a random secret in
+// a cookie, and forms carry an HMAC of it and the payment context. Another
+// site can make the browser post a form but can't read the cookie to build a
+// valid token.
+const (
+	csrfCookie = "l402_csrf"
+	csrfField  = "csrf_token"
+)
+
+var errInvalidCSRF = errors.New("invalid or missing CSRF token, reload the checkout page")
+
+func newCSRFKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// csrfToken returns the token forms about the payment context must carry,
+// giving the browser a CSRF cookie first if it has none
+func (g *Gateway) csrfToken(w http.ResponseWriter, r *http.Request, token string) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return g.signCSRF(c.Value, token)
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	secret := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    secret,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(g.publicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return g.signCSRF(secret, token)
+}
+
+func (g *Gateway) signCSRF(secret, token string) string {
+	mac := hmac.New(sha256.New, g.csrfKey)
+	mac.Write([]byte(secret))
+	mac.Write([]byte{0})
+	mac.Write([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF reports whether a posted form carries the CSRF token of the
+// payment context
+func (g *Gateway) checkCSRF(r *http.Request, token string) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return hmac.Equal([]byte(r.PostFormValue(csrfField)), []byte(g.signCSRF(c.Value, token)))
+}
@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/l402-protocol/go-example/l402"
+	"github.com/l402-protocol/go-example/webhook"
+)
+
+// Event types sent to the backend
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentExpired   = "payment.expired"
+	EventPaymentRefunded  = "payment.refunded"
+
+	// EventPaymentLateFunds flags funds received after the payment context
+	// expired, which must be refunded by hand
+	EventPaymentLateFunds = "payment.late_funds"
+)
+
+// EventTypeHeader tells the backend what kind of event it receives
+const EventTypeHeader = "X-Event-Type"
+
+// DeliveryAttemptHeader counts the attempts to deliver an event, from 1.
+// Backends must expect the same event ID more than once.
+const DeliveryAttemptHeader = "X-Delivery-Attempt"
+
+// Event is sent to the backend when something happens to a payment context
+type Event struct {
+	ID                  string              `json:"id"`
+	Type                string              `json:"type"`
+	PaymentContextToken string              `json:"payment_context_token"`
+	MerchantID          string              `json:"merchant_id"`
+	OfferID             string              `json:"offer_id,omitempty"`
+	PaymentMethod       l402.PaymentMethods `json:"payment_method,omitempty"`
+	Status              ContextStatus       `json:"status"`
+
+	// Amount paid and how much of it was refunded so far. Refund events
+	// also carry the refund.
+	Amount         int     `json:"amount,omitempty"`
+	Currency       string  `json:"currency,omitempty"`
+	RefundedAmount int     `json:"refunded_amount,omitempty"`
+	Refund         *Refund `json:"refund,omitempty"`
+
+	// On-chain funds received after the context expired
+	LateFunds int64 `json:"late_funds,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newEvent returns an event of the given type about pc
+func (g *Gateway) newEvent(eventType string, pc *PaymentContext) Event {
+	event := Event{
+		ID:                  "evt_" + uuid.New().String(),
+		Type:                eventType,
+		PaymentContextToken: pc.Token,
+		MerchantID:          pc.MerchantID,
+		OfferID:             pc.OfferID,
+		PaymentMethod:       pc.PaymentMethod,
+		Status:              pc.Status,
+		RefundedAmount:      pc.RefundedAmount(),
+		LateFunds:           pc.LateFunds,
+		CreatedAt:           g.clock.Now().UTC(),
+	}
+	if offer, ok := pc.PaidOffer(); ok {
+		event.Amount = offer.Amount
+		event.Currency = offer.Currency
+	}
+	return event
+}
+
+// send posts an event to the webhook of the merchant, signed with its
+// secrets. The payment context and offer are also sent as headers for
+// backends that only look at those.
+func (g *Gateway) send(ctx context.Context, event Event, attempt int) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	webhookURL, secrets, err := g.merchantWebhook(ctx, event.MerchantID)
+	if err != nil {
+		return fmt.Errorf("failed to find webhook of merchant %s: %w", event.MerchantID, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create backend request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventTypeHeader, event.Type)
+	req.Header.Set(DeliveryAttemptHeader, strconv.Itoa(attempt))
+	if len(secrets) > 0 {
+		req.Header.Set(webhook.SignatureHeader, webhook.Header(secrets, g.clock.Now(), body))
+	} else {
+		g.logger.Warn("sending unsigned webhook, no secret configured",
+			"merchant_id", event.MerchantID,
+		)
+	}
+	req.Header.Set("X-Payment-Context", event.PaymentContextToken)
+	req.Header.Set("X-Offer-ID", event.OfferID)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backend failed to process %s event: status %d", event.Type, resp.StatusCode)
+	}
+
+	g.logger.Info("event sent to backend",
+		"event_id", event.ID,
+		"attempt", attempt,
+		"type", event.Type,
+		"merchant_id", event.MerchantID,
+		"payment_context", event.PaymentContextToken,
+	)
+	return nil
+}
@@ -0,0 +1,270 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// DefaultContextTTL is how long a charge waits for a payment request
+const DefaultContextTTL = time.Hour
+
+// DefaultPaymentTTLs is how long a payment request stays open, per method
+var DefaultPaymentTTLs = map[l402.PaymentMethods]time.Duration{
+	l402.FakePay:    15 * time.Minute,
+	l402.Lightning:  10 * time.Minute,
+	l402.CreditCard: 30 * time.Minute,
+	l402.Onchain:    time.Hour,
+}
+
+// DefaultSweepInterval is how often expired payment contexts are looked for
+const DefaultSweepInterval = 10 * time.Second
+
+// WithTTLs sets how long charges and payment requests stay open. Methods
+// missing from paymentTTLs keep their default.
+func WithTTLs(contextTTL time.Duration, paymentTTLs map[l402.PaymentMethods]time.Duration) Option {
+	return func(g *Gateway) {
+		if contextTTL > 0 {
+			g.contextTTL = contextTTL
+		}
+		for m, ttl := range paymentTTLs {
+			g.paymentTTLs[m] = ttl
+		}
+	}
+}
+
+// WithSweepInterval sets how often the expiry sweeper runs
+func WithSweepInterval(d time.Duration) Option {
+	return func(g *Gateway) {
+		if d > 0 {
+			g.sweepInterval = d
+		}
+	}
+}
+
+func (g *Gateway) paymentTTL(method l402.PaymentMethods) time.Duration {
+	if ttl, ok := g.paymentTTLs[method]; ok {
+		return ttl
+	}
+	return g.contextTTL
+}
+
+// due reports whether pc is past its expiry and can still expire. Card
+// payments waiting on an abandoned challenge can, on-chain payments already
+// seen on chain are left to confirm until the confirm timeout.
+func (g *Gateway) due(pc *PaymentContext) bool {
+	if pc.ExpiresAt.IsZero() || !g.clock.Now().After(pc.ExpiresAt) {
+		return false
+	}
+	if pc.Status == StatusPending {
+		return g.abandoned(pc)
+	}
+	return CanTransition(pc.Status, StatusExpired)
+}
+
+// abandoned reports whether the pending payment of a context past its
+// expiry won't complete anymore
+func (g *Gateway) abandoned(pc *PaymentContext) bool {
+	switch pc.PaymentMethod {
+	case l402.CreditCard:
+		return true
+	case l402.Onchain:
+		return g.clock.Now().After(pc.ExpiresAt.Add(g.confirmTimeout))
+	}
+	return false
+}
+
+// expireIfDue expires pc if it is due. Abandoned pending payments fail
+// first.
+func (g *Gateway) expireIfDue(pc *PaymentContext) bool {
+	if !g.due(pc) {
+		return false
+	}
+
+	now := g.clock.Now()
+	if pc.Status == StatusPending {
+		reason := "card challenge abandoned"
+		if pc.PaymentMethod == l402.Onchain {
+			reason = "on-chain payment not confirmed in time"
+		}
+		if err := pc.Transition(StatusFailed, reason, now); err != nil {
+			return false
+		}
+	}
+	return pc.Transition(StatusExpired, "expired at "+pc.ExpiresAt.Format(time.RFC3339), now) == nil
+}
+
+// update applies fn to a live payment context. A context past its expiry is
+// expired instead and ErrContextExpired is returned.
+func (g *Gateway) update(ctx context.Context, token string, fn func(pc *PaymentContext) error) (*PaymentContext, error) {
+	return g.updateEvents(ctx, token, func(pc *PaymentContext) ([]Event, error) {
+		return nil, fn(pc)
+	})
+}
+
+// updateEvents is update, also queuing the events fn returns with the change
+func (g *Gateway) updateEvents(ctx context.Context, token string, fn func(pc *PaymentContext) ([]Event, error)) (*PaymentContext, error) {
+	expired := false
+	pc, err := g.write(ctx, token, func(pc *PaymentContext) ([]Event, error) {
+		if g.expireIfDue(pc) {
+			expired = true
+			return []Event{g.newEvent(EventPaymentExpired, pc)}, nil
+		}
+		return fn(pc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		g.expired(ctx, pc)
+		return nil, fmt.Errorf("%w at %s", ErrContextExpired, pc.ExpiresAt.Format(time.RFC3339))
+	}
+	g.subscribers.notify(token)
+	return pc, nil
+}
+
+// write applies fn to a stored payment context, stamps the change with the
+// gateway clock and queues the events fn returns. A store keeping the outbox
+// writes the change and the events in one transaction.
+func (g *Gateway) write(ctx context.Context, token string, fn func(pc *PaymentContext) ([]Event, error)) (*PaymentContext, error) {
+	var deliveries []*Delivery
+	change := func(pc *PaymentContext) error {
+		events, err := fn(pc)
+		if err != nil {
+			return err
+		}
+		now := g.clock.Now().UTC()
+		pc.UpdatedAt = now
+		deliveries = nil
+		for _, event := range events {
+			deliveries = append(deliveries, newDelivery(event, now))
+		}
+		return nil
+	}
+
+	var pc *PaymentContext
+	var err error
+	if es, ok := g.store.(EventStore); ok && es.Outbox() == g.outbox {
+		pc, err = es.UpdateAndEnqueue(ctx, token, func(pc *PaymentContext) ([]*Delivery, error) {
+			if err := change(pc); err != nil {
+				return nil, err
+			}
+			return deliveries, nil
+		})
+	} else {
+		pc, err = g.store.Update(ctx, token, change)
+		for i := 0; err == nil && i < len(deliveries); i++ {
+			if qerr := g.outbox.Enqueue(ctx, deliveries[i]); qerr != nil {
+				g.logger.Error("failed to queue event",
+					"error", qerr,
+					"type", deliveries[i].Event.Type,
+					"payment_context", token,
+				)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) > 0 {
+		g.wakeDispatcher()
+	}
+	return pc, nil
+}
+
+// get returns a payment context, expiring it first if it is past its expiry
+func (g *Gateway) get(ctx context.Context, token string) (*PaymentContext, error) {
+	pc, err := g.store.Get(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !g.due(pc) {
+		return pc, nil
+	}
+	return g.update(ctx, token, func(pc *PaymentContext) error {
+		return nil
+	})
+}
+
+// expired releases what was reserved for an expired payment context. The
+// event telling the backend is queued with the expiry.
+func (g *Gateway) expired(ctx context.Context, pc *PaymentContext) {
+	g.logger.Info("payment context expired",
+		"payment_context", pc.Token,
+		"offer_id", pc.OfferID,
+		"payment_method", pc.PaymentMethod,
+	)
+
+	g.cancel(ctx, pc)
+	g.subscribers.notify(pc.Token)
+}
+
+// Sweep expires every payment context past its expiry and returns how many
+// were expired
+func (g *Gateway) Sweep(ctx context.Context) (int, error) {
+	contexts, err := g.store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, pc := range contexts {
+		if !g.due(pc) {
+			continue
+		}
+
+		// Expiry is checked again under the store lock
+		expired := false
+		updated, err := g.write(ctx, pc.Token, func(pc *PaymentContext) ([]Event, error) {
+			if expired = g.expireIfDue(pc); expired {
+				return []Event{g.newEvent(EventPaymentExpired, pc)}, nil
+			}
+			return nil, nil
+		})
+		if err != nil {
+			g.logger.Error("failed to expire payment context",
+				"error", err,
+				"payment_context", pc.Token,
+			)
+			continue
+		}
+		if expired {
+			g.expired(ctx, updated)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// runSweeper sweeps every interval until ctx is done, forgetting expired
+// idempotency keys and looking for late on-chain funds on the way
+func (g *Gateway) runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(g.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		g.forgetIdempotencyKeys(ctx)
+		g.checkLateFunds(ctx)
+
+		n, err := g.Sweep(ctx)
+		if err != nil {
+			g.logger.Error("expiry sweep failed",
+				"error", err,
+			)
+			continue
+		}
+		if n > 0 {
+			g.logger.Info("expired payment contexts",
+				"count", n,
+			)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// fakeProvider takes test payments. No money moves: the customer confirms
+// the payment on the gateway checkout page.
+type fakeProvider struct {
+	g *Gateway
+}
+
+func (p *fakeProvider) Method() l402.PaymentMethods {
+	return l402.FakePay
+}
+
+func (p *fakeProvider) Capabilities() Capabilities {
+	return Capabilities{
+		HostedCheckout: true,
+		Refunds:        true,
+		PartialRefunds: true,
+	}
+}
+
+func (p *fakeProvider) RequestPayment(ctx context.Context, pc *PaymentContext, offer l402.Offer, req l402.PaymentRequestRequest) (l402.PayReq, error) {
+	return l402.PayReq{
+		CheckoutURL: p.g.url("/checkout", url.Values{
+			"payment_context_token": {pc.Token},
+			"offer_id":              {offer.ID},
+		}),
+	}, nil
+}
+
+// Status is the one of pc, only the checkout settles fake payments
+func (p *fakeProvider) Status(ctx context.Context, pc *PaymentContext) (ContextStatus, error) {
+	return pc.Status, nil
+}
+
+func (p *fakeProvider) Cancel(ctx context.Context, pc *PaymentContext) error {
+	return nil
+}
+
+func (p *fakeProvider) Refund(ctx context.Context, pc *PaymentContext, amount int) (string, error) {
+	return "", nil
+}
+
+// handleCheckout shows the checkout of a fake payment. It has no side
+// effects, so prefetching or reloading it is safe; once paid it shows the
+// success page.
+func (g *Gateway) handleCheckout(w http.ResponseWriter, r *http.Request) {
+	paymentContext := r.URL.Query().Get("payment_context_token")
+	offerID := r.URL.Query().Get("offer_id")
+
+	if paymentContext == "" || offerID == "" {
+		http.Error(w, "missing payment context or offer ID", http.StatusBadRequest)
+		return
+	}
+
+	pc, offer, err := g.selectedOffer(r.Context(), paymentContext, offerID, l402.FakePay)
+	if err != nil {
+		g.writePageError(w, r, paymentContext, offerID, err)
+		return
+	}
+
+	data := g.newPageData(pc, offer)
+	if pc.Status == StatusPaid || pc.Status == StatusPartiallyRefunded {
+		w.Header().Set(l402.PaymentStatusHeader, l402.PaymentStatusPaid)
+		g.render(w, pc.MerchantID, pageSuccess, http.StatusOK, data)
+		return
+	}
+	data.CSRFToken = g.csrfToken(w, r, paymentContext)
+	g.render(w, pc.MerchantID, pageCheckout, http.StatusOK, data)
+}
+
+// handleCheckoutConfirm settles a fake payment confirmed on its checkout
+// page, then redirects back to it. Confirming twice is not an error.
+func (g *Gateway) handleCheckoutConfirm(w http.ResponseWriter, r *http.Request) {
+	paymentContext := r.PostFormValue("payment_context_token")
+	offerID := r.PostFormValue("offer_id")
+
+	g.logger.Info("received checkout confirmation",
+		"payment_context", paymentContext,
+		"offer_id", offerID,
+		"remote_addr", r.RemoteAddr,
+	)
+
+	if paymentContext == "" || offerID == "" {
+		g.logger.Warn("missing parameters in checkout request",
+			"payment_context", paymentContext,
+			"offer_id", offerID,
+		)
+		http.Error(w, "missing payment context or offer ID", http.StatusBadRequest)
+		return
+	}
+	if !g.checkCSRF(r, paymentContext) {
+		g.logger.Warn("checkout confirmation without a valid CSRF token",
+			"payment_context", paymentContext,
+			"remote_addr", r.RemoteAddr,
+		)
+		http.Error(w, errInvalidCSRF.Error(), http.StatusForbidden)
+		return
+	}
+
+	checkoutURL := g.url("/checkout", url.Values{
+		"payment_context_token": {paymentContext},
+		"offer_id":              {offerID},
+	})
+
+	_, _, err := g.selectedOffer(r.Context(), paymentContext, offerID, l402.FakePay)
+	if err == nil {
+		start := time.Now()
+		err = g.settle(r.Context(), paymentContext, "fake checkout confirmed")
+		if err == nil {
+			g.logger.Info("payment processed successfully",
+				"payment_context", paymentContext,
+				"offer_id", offerID,
+				"duration_ms", time.Since(start).Milliseconds(),
+			)
+		}
+	}
+	if errors.Is(err, ErrAlreadyPaid) {
+		err = nil
+	}
+	if err != nil {
+		g.logger.Warn("checkout rejected",
+			"error", err,
+			"payment_context", paymentContext,
+			"offer_id", offerID,
+		)
+		g.writePageError(w, r, paymentContext, offerID, err)
+		return
+	}
+
+	http.Redirect(w, r, checkoutURL, http.StatusSeeOther)
+}
@@ -1,42 +1,239 @@
 package gateway
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/l402-protocol/go-example/chain"
 	"github.com/l402-protocol/go-example/l402"
 )
 
+// Defaults for a gateway running next to the example server on localhost
+const (
+	DefaultPublicURL      = "http://localhost:8081"
+	DefaultWebhookURL     = "http://localhost:8080/payment-success"
+	DefaultWebhookTimeout = 10 * time.Second
+)
+
 type Gateway struct {
 	mux    *http.ServeMux
 	logger *slog.Logger
+
+	// Base URL clients reach the gateway at
+	publicURL string
+
+	// Backend endpoint receiving payment events and the secrets they are
+	// signed with, for charges without a merchant
+	webhookURL     string
+	webhookSecrets []string
+	client         *http.Client
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// Payment contexts of every charge, and the requests following them
+	store       Store
+	subscribers subscribers
+
+	// Merchants allowed to create charges, anyone if nil. Charges without
+	// merchants are made by the one in defaultMerchant, whose catalog and
+	// deliveries are managed with adminKey.
+	merchants       MerchantStore
+	defaultMerchant *MemoryMerchantStore
+	adminKey        string
+	catalogMu       sync.Mutex
+	openCatalog     bool
+
+	// Responses replayed for retried requests
+	idempotency    IdempotencyStore
+	idempotencyTTL time.Duration
+
+	// Events waiting to be delivered and their delivery policy
+	outbox             Outbox
+	outboxWake         chan struct{}
+	webhookWorkers     int
+	webhookMaxAttempts int
+	webhookBackoff     time.Duration
+	webhookMaxBackoff  time.Duration
+
+	// Expiry of charges and payment requests
+	clock         Clock
+	contextTTL    time.Duration
+	paymentTTLs   map[l402.PaymentMethods]time.Duration
+	sweepInterval time.Duration
+
+	// On-chain payments, only enabled when a chain is configured.
+	chain         chain.Node
+	confirmations int
+	addressSeed   []byte
+	csrfKey       []byte
+	pollInterval  time.Duration
+	mu            sync.Mutex
+	watching      map[string]context.CancelFunc // payment context -> stops its watcher
+
+	// How long seen payments may wait for confirmations past their expiry,
+	// and how long addresses of expired contexts are checked for late funds
+	confirmTimeout  time.Duration
+	lateFundsWindow time.Duration
+
+	// Card payments, only enabled when a processor is configured.
+	cards CardProcessor
+
+	// Providers taking payments, by method
+	providers Providers
+
+	// Directory with checkout templates overriding the built-in ones
+	templatesDir string
+}
+
+// Option configures optional gateway features
+type Option func(*Gateway)
+
+// WithChain enables on-chain payments against node. A payment is
+// considered settled once it has the given number of confirmations.
+func WithChain(node chain.Node, confirmations int) Option {
+	return func(g *Gateway) {
+		g.chain = node
+		g.confirmations = confirmations
+		g.providers.Register(&onchainProvider{g})
+	}
+}
+
+// WithPublicURL sets the base URL clients reach the gateway at, e.g. when it
+// runs behind a reverse proxy
+func WithPublicURL(u string) Option {
+	return func(g *Gateway) {
+		g.publicURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithWebhook sends payment events to webhookURL, giving up after timeout
+func WithWebhook(webhookURL string, timeout time.Duration) Option {
+	return func(g *Gateway) {
+		g.webhookURL = webhookURL
+		g.client = &http.Client{Timeout: timeout}
+	}
+}
+
+// WithWebhookSecrets signs the events of charges without a merchant with
+// every one of secrets
+func WithWebhookSecrets(secrets ...string) Option {
+	return func(g *Gateway) {
+		g.webhookSecrets = secrets
+	}
+}
+
+// WithHTTPTimeouts bounds how long reading a request and writing a response
+// may take. Zero means no limit.
+func WithHTTPTimeouts(read, write time.Duration) Option {
+	return func(g *Gateway) {
+		g.readTimeout = read
+		g.writeTimeout = write
+	}
+}
+
+// WithStore keeps payment contexts in s instead of memory
+func WithStore(s Store) Option {
+	return func(g *Gateway) {
+		g.store = s
+	}
 }
 
-func NewGateway() *Gateway {
+func NewGateway(opts ...Option) *Gateway {
 	// Create a JSON logger with timestamp and caller info
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	}))
 
 	g := &Gateway{
-		mux:    http.NewServeMux(),
-		logger: logger,
+		mux:        http.NewServeMux(),
+		logger:     logger,
+		publicURL:  DefaultPublicURL,
+		webhookURL: DefaultWebhookURL,
+		client:     &http.Client{Timeout: DefaultWebhookTimeout},
+		store:      NewMemoryStore(),
+		outboxWake: make(chan struct{}, 1),
+
+		defaultMerchant: newDefaultMerchantStore(),
+
+		idempotency:    NewMemoryIdempotencyStore(),
+		idempotencyTTL: DefaultIdempotencyTTL,
+
+		webhookWorkers:     DefaultWebhookWorkers,
+		webhookMaxAttempts: DefaultWebhookMaxAttempts,
+		webhookBackoff:     DefaultWebhookBackoff,
+		webhookMaxBackoff:  DefaultWebhookMaxBackoff,
+
+		clock:         realClock{},
+		contextTTL:    DefaultContextTTL,
+		paymentTTLs:   maps.Clone(DefaultPaymentTTLs),
+		sweepInterval: DefaultSweepInterval,
+		addressSeed:   newAddressSeed(),
+		csrfKey:       newCSRFKey(),
+		pollInterval:  time.Second,
+		watching:      make(map[string]context.CancelFunc),
+		providers:     Providers{},
+
+		confirmTimeout:  DefaultConfirmTimeout,
+		lateFundsWindow: DefaultLateFundsWindow,
+	}
+	g.providers.Register(&fakeProvider{g})
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.outbox == nil {
+		g.outbox = NewMemoryOutbox()
+		if es, ok := g.store.(EventStore); ok {
+			g.outbox = es.Outbox()
+		}
 	}
 	g.routes()
+	g.resumeWatches()
 	return g
 }
 
 func (g *Gateway) routes() {
-	g.mux.HandleFunc("POST /payment-request", g.handlePaymentRequest)
-	g.mux.HandleFunc("POST /charge", g.handleCharge)
+	g.mux.HandleFunc("POST /payment-request", g.idempotent(g.paymentRequestScope, g.handlePaymentRequest))
+	g.mux.HandleFunc("POST /charge", g.idempotent(g.merchantScope, g.handleCharge))
+	g.mux.HandleFunc("GET /payment-methods", g.handlePaymentMethods)
+	g.mux.HandleFunc("GET /payments/{token}", g.handlePaymentStatus)
+	g.mux.HandleFunc("GET /payments/{token}/events", g.handlePaymentEvents)
+	g.mux.HandleFunc("POST /payments/{token}/refunds", g.idempotent(g.keyScope, g.handleRefund))
+	g.mux.HandleFunc("GET /payments/{token}/refunds", g.handleListRefunds)
+	g.mux.HandleFunc("GET /pay", g.handlePayPage)
+	g.mux.HandleFunc("POST /pay", g.handlePayMethod)
 	g.mux.HandleFunc("GET /checkout", g.handleCheckout)
+	g.mux.HandleFunc("POST /checkout", g.handleCheckoutConfirm)
+	g.mux.HandleFunc("GET /card-checkout", g.handleCardCheckoutPage)
+	g.mux.HandleFunc("POST /card-checkout", g.handleCardCheckout)
+	g.mux.HandleFunc("GET /card-checkout/challenge", g.handleCardChallengePage)
+	g.mux.HandleFunc("POST /card-checkout/challenge", g.handleCardChallenge)
+	g.mux.HandleFunc("GET /catalog", g.handleGetCatalog)
+	g.mux.HandleFunc("PUT /catalog", g.handlePutCatalog)
+	g.mux.HandleFunc("GET /catalog/offers/{id}", g.handleGetOffer)
+	g.mux.HandleFunc("PUT /catalog/offers/{id}", g.handlePutOffer)
+	g.mux.HandleFunc("DELETE /catalog/offers/{id}", g.handleDeleteOffer)
+	g.mux.HandleFunc("GET /deliveries", g.handleListDeliveries)
+	g.mux.HandleFunc("POST /deliveries/{id}/redeliver", g.handleRedeliver)
 }
 
+var (
+	errOfferNotFound     = errors.New("unknown offer")
+	errMethodNotAccepted = errors.New("offer does not accept this payment method")
+	errOfferMismatch     = errors.New("payment context already has a payment request for another offer")
+	errMethodMismatch    = errors.New("payment context already has a payment request for another payment method")
+)
+
 func (g *Gateway) handlePaymentRequest(w http.ResponseWriter, r *http.Request) {
 	var req l402.PaymentRequestRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -54,51 +251,97 @@ func (g *Gateway) handlePaymentRequest(w http.ResponseWriter, r *http.Request) {
 		"payment_context", req.PaymentContextToken,
 	)
 
-	// For demo purposes, we'll just handle the fake payment method
-	if req.PaymentMethod != string(l402.FakePay) {
+	method := l402.PaymentMethods(req.PaymentMethod)
+	provider, ok := g.providers.Get(method)
+	if !ok {
 		g.logger.Warn("unsupported payment method",
 			"payment_method", req.PaymentMethod,
 			"offer_id", req.OfferID,
 		)
-		http.Error(w, "only fake payments are supported in demo", http.StatusBadRequest)
+		http.Error(w, "payment method not supported", http.StatusBadRequest)
 		return
 	}
 
-	// Create checkout URL with payment context and offer ID
-	checkoutURL := url.URL{
-		Scheme: "http",
-		Host:   "localhost:8081",
-		Path:   "/checkout",
+	pc, offer, err := g.requestPayment(r.Context(), req.PaymentContextToken, req.OfferID, method)
+	if err == nil {
+		var payReq l402.PayReq
+		payReq, err = provider.RequestPayment(r.Context(), pc, offer, req)
+		if err == nil {
+			resp := l402.NewPayReqResponse(payReq, pc.ExpiresAt)
+
+			g.logger.Info("payment request processed",
+				"offer_id", offer.ID,
+				"payment_context", pc.Token,
+				"payment_method", method,
+				"expires_at", resp.ExpiresAt,
+			)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
 	}
-	q := checkoutURL.Query()
-	q.Set("payment_context_token", req.PaymentContextToken)
-	q.Set("offer_id", req.OfferID)
-	checkoutURL.RawQuery = q.Encode()
 
-	// Return payment request response with checkout URL
-	resp := l402.PaymentRequestResponse{
-		Version:   l402.L402_VERSION,
-		ExpiresAt: "2025-12-31T23:59:59Z",
-		PaymentRequest: l402.PayReq{
-			CheckoutURL: checkoutURL.String(),
-		},
-	}
-
-	g.logger.Info("payment request processed",
+	g.logger.Warn("payment request rejected",
+		"error", err,
+		"payment_context", req.PaymentContextToken,
 		"offer_id", req.OfferID,
-		"checkout_url", checkoutURL.String(),
-		"expires_at", resp.ExpiresAt,
+		"payment_method", method,
 	)
+	writeContextError(w, err)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+// requestPayment records that the client asked to pay offerID with method.
+// A payment context can only be paid for one offer but the client may switch
+// methods, e.g. when a wallet runs out of funds.
+func (g *Gateway) requestPayment(ctx context.Context, token, offerID string, method l402.PaymentMethods) (*PaymentContext, l402.Offer, error) {
+	var offer l402.Offer
+	pc, err := g.update(ctx, token, func(pc *PaymentContext) error {
+		var ok bool
+		offer, ok = pc.Offer(offerID)
+		switch {
+		case !ok:
+			return errOfferNotFound
+		case !slices.Contains(offer.PaymentMethods, method):
+			return errMethodNotAccepted
+		case pc.OfferID != "" && pc.OfferID != offerID:
+			return errOfferMismatch
+		}
+
+		now := g.clock.Now()
+		if err := pc.Transition(StatusPaymentRequested, "payment requested with "+string(method), now); err != nil {
+			return err
+		}
+		pc.OfferID = offerID
+		pc.PaymentMethod = method
+		pc.ExpiresAt = now.Add(g.paymentTTL(method)).UTC()
+		return nil
+	})
+	if err != nil {
+		return nil, l402.Offer{}, err
+	}
+	return pc, offer, nil
 }
 
+// ChargeRequest creates a payment context for the merchant catalog offers
+// named by OfferIDs, or the whole catalog. Offers given instead must match
+// the catalog, unless the merchant has none.
 type ChargeRequest struct {
-	Offers []l402.Offer `json:"offers"`
+	Offers   []l402.Offer `json:"offers,omitempty"`
+	OfferIDs []string     `json:"offer_ids,omitempty"`
 }
 
 func (g *Gateway) handleCharge(w http.ResponseWriter, r *http.Request) {
+	merchant, err := g.authenticate(r)
+	if err != nil {
+		g.logger.Warn("unauthenticated charge request",
+			"error", err,
+			"remote_addr", r.RemoteAddr,
+		)
+		writeAuthError(w)
+		return
+	}
+
 	var req ChargeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		g.logger.Error("failed to decode charge request",
@@ -109,8 +352,19 @@ func (g *Gateway) handleCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.Offers, err = g.chargeOffers(merchant, req)
+	if err != nil {
+		g.logger.Warn("charge request rejected by the catalog",
+			"error", err,
+			"merchant_id", merchant.ID,
+			"catalog_version", merchant.CatalogVersion,
+		)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if len(req.Offers) == 0 {
 		g.logger.Warn("no offers in charge request",
+			"merchant_id", merchant.ID,
 			"remote_addr", r.RemoteAddr,
 		)
 		http.Error(w, "no offers provided", http.StatusBadRequest)
@@ -118,20 +372,34 @@ func (g *Gateway) handleCharge(w http.ResponseWriter, r *http.Request) {
 	}
 
 	g.logger.Info("received charge request",
+		"merchant_id", merchant.ID,
 		"num_offers", len(req.Offers),
 		"offer_ids", getOfferIDs(req.Offers),
 	)
 
-	// In a real implementation, this would validate the payment
-	// For demo purposes, we'll just return a successful L402 response with the received offers
+	pc := newPaymentContext(merchant.ID, req.Offers, g.clock.Now(), g.contextTTL)
+	if len(merchant.Offers) > 0 {
+		pc.CatalogVersion = merchant.CatalogVersion
+	}
+	if err := g.store.Create(r.Context(), pc); err != nil {
+		g.logger.Error("failed to store payment context",
+			"error", err,
+		)
+		http.Error(w, "failed to create payment context", http.StatusInternalServerError)
+		return
+	}
+
 	l402Response := l402.L402Response{
 		Version:             l402.L402_VERSION,
-		PaymentRequestURL:   "http://localhost:8081/payment-request",
-		PaymentContextToken: "demo-token-123",
+		PaymentRequestURL:   g.url("/payment-request", nil),
+		PaymentContextToken: pc.Token,
 		Offers:              req.Offers,
+		TermsURL:            "https://example.com/terms",
+		PaymentStatusURL:    g.url("/payments/"+pc.Token, nil),
 	}
 
 	g.logger.Info("charge request processed",
+		"merchant_id", merchant.ID,
 		"payment_context", l402Response.PaymentContextToken,
 	)
 
@@ -139,78 +407,88 @@ func (g *Gateway) handleCharge(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(l402Response)
 }
 
-func (g *Gateway) handleCheckout(w http.ResponseWriter, r *http.Request) {
-	// Get payment context and offer ID from URL parameters
-	paymentContext := r.URL.Query().Get("payment_context_token")
-	offerID := r.URL.Query().Get("offer_id")
-
-	g.logger.Info("received checkout request",
-		"payment_context", paymentContext,
-		"offer_id", offerID,
-		"remote_addr", r.RemoteAddr,
-	)
-
-	if paymentContext == "" || offerID == "" {
-		g.logger.Warn("missing parameters in checkout request",
-			"payment_context", paymentContext,
-			"offer_id", offerID,
-		)
-		http.Error(w, "missing payment context or offer ID", http.StatusBadRequest)
-		return
-	}
-
-	// Notify the backend server that payment was successful
-	backendReq, err := http.NewRequest("POST", "http://localhost:8080/payment-success", nil)
+// selectedOffer returns a payment context and the offer a payment request
+// was made for with method
+func (g *Gateway) selectedOffer(ctx context.Context, token, offerID string, method l402.PaymentMethods) (*PaymentContext, l402.Offer, error) {
+	pc, err := g.get(ctx, token)
 	if err != nil {
-		g.logger.Error("failed to create backend request",
-			"error", err,
-		)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
+		return nil, l402.Offer{}, err
+	}
+	offer, ok := pc.Offer(offerID)
+	if !ok {
+		return nil, l402.Offer{}, errOfferNotFound
+	}
+	if pc.OfferID != offerID {
+		return nil, l402.Offer{}, errOfferMismatch
 	}
+	if !slices.Contains(offer.PaymentMethods, method) {
+		return nil, l402.Offer{}, errMethodNotAccepted
+	}
+	// Paying with another method would leave the payment to a provider
+	// that didn't take it, e.g. for refunds
+	if pc.PaymentMethod != "" && pc.PaymentMethod != method {
+		return nil, l402.Offer{}, errMethodMismatch
+	}
+	return pc, offer, nil
+}
 
-	// Add payment context and offer info
-	backendReq.Header.Set("X-Payment-Context", paymentContext)
-	backendReq.Header.Set("X-Offer-ID", offerID)
+// settle marks the payment context as paid and queues the event telling the
+// backend with it. The transition guarantees one event per payment. The
+// payment stands even if the backend is down, the event is retried.
+func (g *Gateway) settle(ctx context.Context, token, reason string) error {
+	_, err := g.transitionEvent(ctx, token, StatusPaid, reason, EventPaymentSucceeded)
+	return err
+}
 
-	start := time.Now()
-	resp, err := http.DefaultClient.Do(backendReq)
-	if err != nil {
-		g.logger.Error("failed to notify backend",
-			"error", err,
-			"duration_ms", time.Since(start).Milliseconds(),
-		)
-		http.Error(w, "failed to notify backend", http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
+// transition moves a stored payment context to status
+func (g *Gateway) transition(ctx context.Context, token string, status ContextStatus, reason string) (*PaymentContext, error) {
+	return g.transitionEvent(ctx, token, status, reason, "")
+}
 
-	if resp.StatusCode != http.StatusOK {
-		g.logger.Error("backend failed to process payment",
-			"status_code", resp.StatusCode,
-			"duration_ms", time.Since(start).Milliseconds(),
-		)
-		http.Error(w, "backend failed to process payment", http.StatusInternalServerError)
-		return
+// transitionEvent moves a stored payment context to status, queuing an event
+// of eventType with it unless eventType is empty
+func (g *Gateway) transitionEvent(ctx context.Context, token string, status ContextStatus, reason, eventType string) (*PaymentContext, error) {
+	pc, err := g.updateEvents(ctx, token, func(pc *PaymentContext) ([]Event, error) {
+		if err := pc.Transition(status, reason, g.clock.Now()); err != nil {
+			return nil, err
+		}
+		if eventType == "" {
+			return nil, nil
+		}
+		return []Event{g.newEvent(eventType, pc)}, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	g.logger.Info("payment processed successfully",
-		"payment_context", paymentContext,
-		"offer_id", offerID,
-		"duration_ms", time.Since(start).Milliseconds(),
+	g.logger.Info("payment context transitioned",
+		"payment_context", token,
+		"status", pc.Status,
+		"reason", reason,
 	)
+	return pc, nil
+}
 
-	// Return a nice HTML page indicating success
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprintf(w, `
-		<html>
-			<body style="font-family: Arial, sans-serif; max-width: 600px; margin: 40px auto; text-align: center;">
-				<h1 style="color: #4CAF50;">Payment Successful!</h1>
-				<p>Your payment for offer %s has been processed.</p>
-				<p>You can now return to the application and access your content.</p>
-			</body>
-		</html>
-	`, offerID)
+// writeContextError maps payment context errors to HTTP errors
+func writeContextError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrContextNotFound), errors.Is(err, errOfferNotFound):
+		http.Error(w, "unknown payment context or offer", http.StatusNotFound)
+	case errors.Is(err, errMethodNotAccepted), errors.Is(err, errBadPaymentRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrUnsupported):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrProviderUnavailable):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case errors.Is(err, ErrContextExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, errOfferMismatch), errors.Is(err, errMethodMismatch), errors.Is(err, ErrAlreadyPaid),
+		errors.Is(err, ErrContextRefunded), errors.Is(err, ErrPaymentPending),
+		errors.Is(err, ErrInvalidTransition):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
 }
 
 // Helper function to extract offer IDs for logging
@@ -226,8 +504,31 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	g.mux.ServeHTTP(w, r)
 }
 
-// Start starts the gateway server on the specified port
-func (g *Gateway) Start(port string) error {
-	g.logger.Info("starting gateway server", "port", port)
-	return http.ListenAndServe(port, g)
+// Start starts the gateway server on the specified address, along with the
+// expiry sweeper and the webhook dispatcher
+func (g *Gateway) Start(addr string) error {
+	go g.runSweeper(context.Background())
+	go g.runDispatcher(context.Background())
+
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      g,
+		ReadTimeout:  g.readTimeout,
+		WriteTimeout: g.writeTimeout,
+	}
+	g.logger.Info("starting gateway server",
+		"addr", addr,
+		"public_url", g.publicURL,
+		"webhook_url", g.webhookURL,
+	)
+	return srv.ListenAndServe()
+}
+
+// url returns the public URL of path with the given query
+func (g *Gateway) url(path string, query url.Values) string {
+	u := g.publicURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
 }
@@ -0,0 +1,439 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// IdempotencyKeyHeader lets clients retry write requests without repeating
+// their effect. The first response per key and merchant is replayed.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set on replayed responses
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// DefaultIdempotencyTTL is how long an idempotency key is remembered
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyLease is how long a key is held for its first request at
+// least. A request still running after it, e.g. because the gateway stopped,
+// no longer blocks the key.
+const idempotencyLease = time.Minute
+
+const (
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBodySize   = 1 << 20
+)
+
+var (
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+	ErrIdempotencyKeyInUse  = errors.New("a request with this idempotency key is in progress")
+)
+
+// IdempotencyRecord is the response to the first request made with a key.
+// It has no status while that request is in progress, and expires when its
+// lease is over.
+type IdempotencyRecord struct {
+	MerchantID  string    `json:"merchant_id"`
+	Key         string    `json:"key"`
+	RequestHash string    `json:"request_hash"`
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// IdempotencyStore keeps idempotency records. Like Store, implementations
+// return copies.
+type IdempotencyStore interface {
+	// Reserve stores rec unless a record with its merchant and key is live
+	// at now, in which case that record is returned and rec is not stored
+	Reserve(ctx context.Context, rec *IdempotencyRecord, now time.Time) (*IdempotencyRecord, error)
+
+	// Complete saves the response of a reserved record, kept until expiresAt
+	Complete(ctx context.Context, merchantID, key string, status int, contentType string, body []byte, expiresAt time.Time) error
+
+	// Release deletes a reserved record so its request can be retried
+	Release(ctx context.Context, merchantID, key string) error
+
+	// DeleteExpired deletes the records expired at now and returns how many
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+type idempotencyScope struct {
+	merchantID string
+	key        string
+}
+
+// MemoryIdempotencyStore keeps idempotency records in memory
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[idempotencyScope]*IdempotencyRecord
+
+	// onChange is called with the lock held after every change
+	onChange func() error
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		records: make(map[idempotencyScope]*IdempotencyRecord),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(ctx context.Context, rec *IdempotencyRecord, now time.Time) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scope := idempotencyScope{rec.MerchantID, rec.Key}
+	old, ok := s.records[scope]
+	if ok && now.Before(old.ExpiresAt) {
+		return cloneIdempotencyRecord(old), nil
+	}
+
+	s.records[scope] = cloneIdempotencyRecord(rec)
+	if err := s.changed(); err != nil {
+		if ok {
+			s.records[scope] = old
+		} else {
+			delete(s.records, scope)
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, merchantID, key string, status int, contentType string, body []byte, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scope := idempotencyScope{merchantID, key}
+	old, ok := s.records[scope]
+	if !ok {
+		return fmt.Errorf("no idempotency record for key %s", key)
+	}
+
+	rec := cloneIdempotencyRecord(old)
+	rec.Status = status
+	rec.ContentType = contentType
+	rec.Body = bytes.Clone(body)
+	rec.ExpiresAt = expiresAt
+	s.records[scope] = rec
+
+	if err := s.changed(); err != nil {
+		s.records[scope] = old
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, merchantID, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scope := idempotencyScope{merchantID, key}
+	old, ok := s.records[scope]
+	if !ok {
+		return nil
+	}
+	delete(s.records, scope)
+
+	if err := s.changed(); err != nil {
+		s.records[scope] = old
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := make(map[idempotencyScope]*IdempotencyRecord)
+	for scope, rec := range s.records {
+		if !now.Before(rec.ExpiresAt) {
+			expired[scope] = rec
+			delete(s.records, scope)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	if err := s.changed(); err != nil {
+		for scope, rec := range expired {
+			s.records[scope] = rec
+		}
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+func (s *MemoryIdempotencyStore) changed() error {
+	if s.onChange == nil {
+		return nil
+	}
+	return s.onChange()
+}
+
+// cloneIdempotencyRecord returns a deep copy of rec
+func cloneIdempotencyRecord(rec *IdempotencyRecord) *IdempotencyRecord {
+	c := *rec
+	c.Body = bytes.Clone(rec.Body)
+	return &c
+}
+
+// FileIdempotencyStore is a MemoryIdempotencyStore persisted to a JSON
+// file, so retries across gateway restarts are still recognized
+type FileIdempotencyStore struct {
+	*MemoryIdempotencyStore
+	path string
+}
+
+// NewFileIdempotencyStore opens the records at path, creating the file on
+// first write
+func NewFileIdempotencyStore(path string) (*FileIdempotencyStore, error) {
+	s := &FileIdempotencyStore{
+		MemoryIdempotencyStore: NewMemoryIdempotencyStore(),
+		path:                   path,
+	}
+	s.onChange = s.save
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotency records: %w", err)
+	}
+	var records []*IdempotencyRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse idempotency records: %w", err)
+	}
+	for _, rec := range records {
+		s.records[idempotencyScope{rec.MerchantID, rec.Key}] = rec
+	}
+	return s, nil
+}
+
+func (s *FileIdempotencyStore) save() error {
+	records := make([]*IdempotencyRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		records = append(records, rec)
+	}
+	return saveJSON(s.path, records)
+}
+
+// WithIdempotencyStore keeps idempotency records in s instead of memory
+func WithIdempotencyStore(s IdempotencyStore) Option {
+	return func(g *Gateway) {
+		g.idempotency = s
+	}
+}
+
+// WithIdempotencyTTL sets how long idempotency keys are remembered
+func WithIdempotencyTTL(ttl time.Duration) Option {
+	return func(g *Gateway) {
+		if ttl > 0 {
+			g.idempotencyTTL = ttl
+		}
+	}
+}
+
+// idempotent lets requests to next carry an Idempotency-Key. scope returns
+// the merchant a request belongs to; requests it cannot place are passed to
+// next, which rejects them.
+func (g *Gateway) idempotent(scope func(r *http.Request, body []byte) (string, error), next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "idempotency key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		merchantID, err := scope(r, body)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		// The key is leased while the request runs, at least as long as
+		// the gateway may take to answer
+		now := g.clock.Now().UTC()
+		rec := &IdempotencyRecord{
+			MerchantID:  merchantID,
+			Key:         key,
+			RequestHash: requestHash(r, body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(max(idempotencyLease, 2*g.writeTimeout)),
+		}
+		existing, err := g.idempotency.Reserve(r.Context(), rec, now)
+		if err != nil {
+			g.logger.Error("failed to reserve idempotency key",
+				"error", err,
+				"merchant_id", merchantID,
+			)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			g.replay(w, r, rec, existing)
+			return
+		}
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rw, r)
+
+		// Failures of the gateway itself are not remembered so the request
+		// can be retried, nor are rejected credentials
+		if rw.status >= 500 || rw.status == http.StatusUnauthorized || rw.status == http.StatusForbidden {
+			err = g.idempotency.Release(context.WithoutCancel(r.Context()), merchantID, key)
+		} else {
+			err = g.idempotency.Complete(context.WithoutCancel(r.Context()), merchantID, key,
+				rw.status, rw.Header().Get("Content-Type"), rw.body.Bytes(), now.Add(g.idempotencyTTL))
+		}
+		if err != nil {
+			g.logger.Error("failed to save idempotent response",
+				"error", err,
+				"merchant_id", merchantID,
+				"idempotency_key", key,
+			)
+		}
+	}
+}
+
+// forgetIdempotencyKeys deletes the idempotency records past their TTL
+func (g *Gateway) forgetIdempotencyKeys(ctx context.Context) {
+	n, err := g.idempotency.DeleteExpired(ctx, g.clock.Now())
+	if err != nil {
+		g.logger.Error("failed to delete expired idempotency keys",
+			"error", err,
+		)
+		return
+	}
+	if n > 0 {
+		g.logger.Debug("deleted expired idempotency keys",
+			"count", n,
+		)
+	}
+}
+
+// replay answers a request whose key was already used
+func (g *Gateway) replay(w http.ResponseWriter, r *http.Request, rec, existing *IdempotencyRecord) {
+	switch {
+	case existing.RequestHash != rec.RequestHash:
+		g.logger.Warn("idempotency key reused with a different request",
+			"merchant_id", rec.MerchantID,
+			"idempotency_key", rec.Key,
+			"path", r.URL.Path,
+		)
+		http.Error(w, ErrIdempotencyKeyReused.Error(), http.StatusUnprocessableEntity)
+	case existing.Status == 0:
+		http.Error(w, ErrIdempotencyKeyInUse.Error(), http.StatusConflict)
+	default:
+		g.logger.Info("replaying idempotent response",
+			"merchant_id", rec.MerchantID,
+			"idempotency_key", rec.Key,
+			"path", r.URL.Path,
+			"status", existing.Status,
+		)
+		if existing.ContentType != "" {
+			w.Header().Set("Content-Type", existing.ContentType)
+		}
+		w.Header().Set(IdempotentReplayedHeader, "true")
+		w.WriteHeader(existing.Status)
+		w.Write(existing.Body)
+	}
+}
+
+// requestHash identifies the payload of a request
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// merchantScope places requests under the authenticated merchant
+func (g *Gateway) merchantScope(r *http.Request, body []byte) (string, error) {
+	m, err := g.authenticate(r)
+	if err != nil {
+		return "", err
+	}
+	return m.ID, nil
+}
+
+// keyScope places requests under the merchant whose API key, or the admin
+// key, they carry. Requests without one aren't kept, so they can't use or
+// take the keys of the requests that have it.
+func (g *Gateway) keyScope(r *http.Request, body []byte) (string, error) {
+	m, err := g.authenticateKey(r)
+	if err != nil {
+		return "", err
+	}
+	return m.ID, nil
+}
+
+// paymentRequestScope places payment requests under the merchant of their
+// payment context
+func (g *Gateway) paymentRequestScope(r *http.Request, body []byte) (string, error) {
+	var req l402.PaymentRequestRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", err
+	}
+	pc, err := g.store.Get(r.Context(), req.PaymentContextToken)
+	if err != nil {
+		return "", err
+	}
+	return pc.MerchantID, nil
+}
+
+// responseRecorder writes a response through while keeping a copy
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
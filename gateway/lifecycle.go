@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+type ContextStatus string
+
+const (
+	StatusCreated          ContextStatus = "created"
+	StatusPaymentRequested ContextStatus = "payment_requested"
+	StatusPending          ContextStatus = "pending"
+	StatusPaid             ContextStatus = "paid"
+	StatusExpired          ContextStatus = "expired"
+	StatusFailed           ContextStatus = "failed"
+	StatusRefunded         ContextStatus = "refunded"
+
+	// StatusPartiallyRefunded is paid with part of the amount refunded
+	StatusPartiallyRefunded ContextStatus = "partially_refunded"
+)
+
+// transitions lists the legal next states of every state. A payment request
+// can be repeated to switch methods, and a failed payment attempt can be
+// retried. A pending payment, e.g. an unconfirmed transaction, can't expire.
+// A paid payment can be refunded in several parts.
+var transitions = map[ContextStatus][]ContextStatus{
+	StatusCreated:           {StatusPaymentRequested, StatusExpired},
+	StatusPaymentRequested:  {StatusPaymentRequested, StatusPending, StatusPaid, StatusFailed, StatusExpired},
+	StatusPending:           {StatusPaid, StatusFailed},
+	StatusFailed:            {StatusPaymentRequested, StatusPending, StatusPaid, StatusFailed, StatusExpired},
+	StatusPaid:              {StatusRefunded, StatusPartiallyRefunded},
+	StatusPartiallyRefunded: {StatusRefunded, StatusPartiallyRefunded},
+	StatusExpired:           {},
+	StatusRefunded:          {},
+}
+
+var (
+	ErrInvalidTransition = errors.New("invalid payment context transition")
+	ErrAlreadyPaid       = errors.New("payment context is already paid")
+	ErrContextExpired    = errors.New("payment context has expired")
+	ErrContextRefunded   = errors.New("payment context has been refunded")
+	ErrPaymentPending    = errors.New("a payment is already in progress")
+)
+
+// TransitionError is returned for illegal transitions. It unwraps to the
+// most specific error for the current state, or ErrInvalidTransition.
+type TransitionError struct {
+	From ContextStatus
+	To   ContextStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s: %s -> %s", e.Unwrap(), e.From, e.To)
+}
+
+func (e *TransitionError) Unwrap() error {
+	switch e.From {
+	case StatusPaid, StatusPartiallyRefunded:
+		return ErrAlreadyPaid
+	case StatusExpired:
+		return ErrContextExpired
+	case StatusRefunded:
+		return ErrContextRefunded
+	case StatusPending:
+		return ErrPaymentPending
+	}
+	return ErrInvalidTransition
+}
+
+// Transition is an entry of the history of a payment context
+type Transition struct {
+	From   ContextStatus `json:"from,omitempty"`
+	To     ContextStatus `json:"to"`
+	Reason string        `json:"reason,omitempty"`
+	At     time.Time     `json:"at"`
+}
+
+// CanTransition reports whether a payment context can move from one status
+// to another
+func CanTransition(from, to ContextStatus) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+// Transition moves the payment context to status at the given time and
+// records it in its history. Use it inside Store.Update so the check and the
+// change are applied atomically.
+func (pc *PaymentContext) Transition(to ContextStatus, reason string, at time.Time) error {
+	if !CanTransition(pc.Status, to) {
+		return &TransitionError{From: pc.Status, To: to}
+	}
+
+	now := at.UTC()
+	pc.History = append(pc.History, Transition{
+		From:   pc.Status,
+		To:     to,
+		Reason: reason,
+		At:     now,
+	})
+	pc.Status = to
+	if to == StatusPaid {
+		pc.PaidAt = &now
+	}
+	return nil
+}
@@ -0,0 +1,485 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// apiKeyPrefix starts every merchant API key
+const apiKeyPrefix = "sk_"
+
+var (
+	ErrMerchantNotFound = errors.New("merchant not found")
+	ErrMerchantExists   = errors.New("merchant already exists")
+	ErrInvalidAPIKey    = errors.New("invalid API key")
+)
+
+// Merchant is a tenant of the gateway. Its charges are created with one of
+// its API keys and their events are sent to its webhook.
+type Merchant struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+
+	// Only hashes of the keys are kept
+	APIKeys []APIKey `json:"api_keys"`
+
+	// Endpoint receiving payment events, the gateway default if empty
+	WebhookURL string `json:"webhook_url,omitempty"`
+
+	// Secrets webhooks are signed with, newest last. Every active secret
+	// signs, so the backend can switch secrets without missing events.
+	WebhookSecrets []WebhookSecret `json:"webhook_secrets,omitempty"`
+
+	// Offer catalog charges are made from, and its version
+	Offers         []l402.Offer `json:"offers,omitempty"`
+	CatalogVersion int          `json:"catalog_version,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey is the stored form of an API key
+type APIKey struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookSecret is a secret shared with the backend of a merchant
+type WebhookSecret struct {
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Secrets returns the active webhook secrets
+func (m *Merchant) Secrets() []string {
+	secrets := make([]string, len(m.WebhookSecrets))
+	for i, s := range m.WebhookSecrets {
+		secrets[i] = s.Secret
+	}
+	return secrets
+}
+
+// RotateWebhookSecret adds a new webhook secret and returns it. Older
+// secrets stay active until RetireWebhookSecrets.
+func (m *Merchant) RotateWebhookSecret() string {
+	secret := NewWebhookSecret()
+	m.WebhookSecrets = append(m.WebhookSecrets, WebhookSecret{
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	})
+	return secret
+}
+
+// RetireWebhookSecrets keeps only the newest webhook secret
+func (m *Merchant) RetireWebhookSecrets() {
+	if n := len(m.WebhookSecrets); n > 1 {
+		m.WebhookSecrets = m.WebhookSecrets[n-1:]
+	}
+}
+
+// NewAPIKey generates an API key. The key is only returned here, the APIKey
+// keeps its hash.
+func NewAPIKey() (string, APIKey) {
+	id := make([]byte, 6)
+	rand.Read(id)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	keyID := hex.EncodeToString(id)
+	key := apiKeyPrefix + keyID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, APIKey{
+		ID:        keyID,
+		Hash:      hashAPIKey(key),
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// NewWebhookSecret generates a webhook secret
+func NewWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// API keys are random, a plain hash is enough to keep them safe at rest
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyID returns the ID part of an API key
+func apiKeyID(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	return id, ok && id != ""
+}
+
+// checkAPIKey reports whether key is one of the merchant keys
+func (m *Merchant) checkAPIKey(key string) bool {
+	id, ok := apiKeyID(key)
+	if !ok {
+		return false
+	}
+	hash := hashAPIKey(key)
+	for _, k := range m.APIKeys {
+		if k.ID == id && subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// RevokeAPIKey removes the API key with the given ID
+func (m *Merchant) RevokeAPIKey(id string) error {
+	for i, k := range m.APIKeys {
+		if k.ID == id {
+			m.APIKeys = append(m.APIKeys[:i], m.APIKeys[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no key %s", ErrInvalidAPIKey, id)
+}
+
+// catalogOffers returns the catalog offers with the given IDs, or the whole
+// catalog if ids is empty
+func (m *Merchant) catalogOffers(ids []string) ([]l402.Offer, error) {
+	if len(ids) == 0 {
+		return m.Offers, nil
+	}
+
+	offers := make([]l402.Offer, 0, len(ids))
+	for _, id := range ids {
+		found := false
+		for _, o := range m.Offers {
+			if o.ID == id {
+				offers = append(offers, o)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", errOfferNotFound, id)
+		}
+	}
+	return offers, nil
+}
+
+// MerchantStore keeps merchants. Like Store, implementations return copies.
+type MerchantStore interface {
+	// Get returns the merchant with the given ID
+	Get(ctx context.Context, id string) (*Merchant, error)
+
+	// Authenticate returns the merchant owning the API key
+	Authenticate(ctx context.Context, key string) (*Merchant, error)
+
+	// Put creates or replaces a merchant
+	Put(ctx context.Context, m *Merchant) error
+
+	// Delete removes a merchant
+	Delete(ctx context.Context, id string) error
+
+	// List returns every merchant sorted by ID
+	List(ctx context.Context) ([]*Merchant, error)
+}
+
+// MemoryMerchantStore keeps merchants in memory
+type MemoryMerchantStore struct {
+	mu        sync.Mutex
+	merchants map[string]*Merchant
+
+	// onChange is called with the lock held after every change
+	onChange func() error
+}
+
+func NewMemoryMerchantStore() *MemoryMerchantStore {
+	return &MemoryMerchantStore{
+		merchants: make(map[string]*Merchant),
+	}
+}
+
+func (s *MemoryMerchantStore) Get(ctx context.Context, id string) (*Merchant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.merchants[id]
+	if !ok {
+		return nil, ErrMerchantNotFound
+	}
+	return cloneMerchant(m), nil
+}
+
+func (s *MemoryMerchantStore) Authenticate(ctx context.Context, key string) (*Merchant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.merchants {
+		if m.checkAPIKey(key) {
+			return cloneMerchant(m), nil
+		}
+	}
+	return nil, ErrInvalidAPIKey
+}
+
+func (s *MemoryMerchantStore) Put(ctx context.Context, m *Merchant) error {
+	if m.ID == "" {
+		return errors.New("merchant ID is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, existed := s.merchants[m.ID]
+	stored := cloneMerchant(m)
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now().UTC()
+	}
+	s.merchants[m.ID] = stored
+
+	if err := s.changed(); err != nil {
+		if existed {
+			s.merchants[m.ID] = old
+		} else {
+			delete(s.merchants, m.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryMerchantStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.merchants[id]
+	if !ok {
+		return ErrMerchantNotFound
+	}
+	delete(s.merchants, id)
+
+	if err := s.changed(); err != nil {
+		s.merchants[id] = old
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryMerchantStore) List(ctx context.Context) ([]*Merchant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*Merchant, 0, len(s.merchants))
+	for _, m := range s.merchants {
+		list = append(list, cloneMerchant(m))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+func (s *MemoryMerchantStore) changed() error {
+	if s.onChange == nil {
+		return nil
+	}
+	return s.onChange()
+}
+
+// FileMerchantStore is a MemoryMerchantStore persisted to a JSON file. The
+// file is read again when it changes, so keys and secrets can be managed
+// with cmd/merchant while the gateway runs.
+type FileMerchantStore struct {
+	*MemoryMerchantStore
+	path    string
+	modTime time.Time
+}
+
+// NewFileMerchantStore opens the merchants file at path, creating it on
+// first write
+func NewFileMerchantStore(path string) (*FileMerchantStore, error) {
+	s := &FileMerchantStore{
+		MemoryMerchantStore: NewMemoryMerchantStore(),
+		path:                path,
+	}
+	s.onChange = s.save
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the file if it changed since it was last read or written
+func (s *FileMerchantStore) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read merchants: %w", err)
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read merchants: %w", err)
+	}
+	merchants := make(map[string]*Merchant)
+	if err := json.Unmarshal(data, &merchants); err != nil {
+		return fmt.Errorf("failed to parse merchants: %w", err)
+	}
+	if merchants == nil {
+		merchants = make(map[string]*Merchant)
+	}
+	s.merchants = merchants
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// refresh reloads the file, keeping the last good copy if it can't be read
+func (s *FileMerchantStore) refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+}
+
+func (s *FileMerchantStore) Get(ctx context.Context, id string) (*Merchant, error) {
+	s.refresh()
+	return s.MemoryMerchantStore.Get(ctx, id)
+}
+
+func (s *FileMerchantStore) Authenticate(ctx context.Context, key string) (*Merchant, error) {
+	s.refresh()
+	return s.MemoryMerchantStore.Authenticate(ctx, key)
+}
+
+func (s *FileMerchantStore) Put(ctx context.Context, m *Merchant) error {
+	s.refresh()
+	return s.MemoryMerchantStore.Put(ctx, m)
+}
+
+func (s *FileMerchantStore) Delete(ctx context.Context, id string) error {
+	s.refresh()
+	return s.MemoryMerchantStore.Delete(ctx, id)
+}
+
+func (s *FileMerchantStore) List(ctx context.Context) ([]*Merchant, error) {
+	s.refresh()
+	return s.MemoryMerchantStore.List(ctx)
+}
+
+func (s *FileMerchantStore) save() error {
+	if err := saveJSON(s.path, s.merchants); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// cloneMerchant returns a deep copy of m
+func cloneMerchant(m *Merchant) *Merchant {
+	c := *m
+	c.APIKeys = append([]APIKey(nil), m.APIKeys...)
+	c.WebhookSecrets = append([]WebhookSecret(nil), m.WebhookSecrets...)
+	c.Offers = make([]l402.Offer, len(m.Offers))
+	for i, o := range m.Offers {
+		o.PaymentMethods = append([]l402.PaymentMethods(nil), o.PaymentMethods...)
+		c.Offers[i] = o
+	}
+	return &c
+}
+
+// WithMerchants requires charges to be made with the API key of a merchant
+// in s. Without it every charge belongs to DefaultMerchant.
+func WithMerchants(s MerchantStore) Option {
+	return func(g *Gateway) {
+		g.merchants = s
+	}
+}
+
+// DevAdminKey is the admin key shared by the example gateway and server so
+// the server can sync its catalog out of the box. Never use it outside
+// development.
+const DevAdminKey = "sk_l402_example_development_only"
+
+// WithAdminKey sets the API key managing a gateway without merchants. It is
+// needed to change the catalog and to list and redeliver events. Without it
+// they can't be managed.
+func WithAdminKey(key string) Option {
+	return func(g *Gateway) {
+		g.adminKey = key
+	}
+}
+
+// authenticate returns the merchant making the request
+func (g *Gateway) authenticate(r *http.Request) (*Merchant, error) {
+	if g.merchants == nil {
+		return g.defaultMerchant.Get(r.Context(), DefaultMerchant)
+	}
+
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		return nil, ErrInvalidAPIKey
+	}
+	return g.merchants.Authenticate(r.Context(), key)
+}
+
+// authenticateKey returns the merchant making a request that needs a real
+// credential: a merchant API key, or the admin key without merchants
+func (g *Gateway) authenticateKey(r *http.Request) (*Merchant, error) {
+	if g.merchants != nil {
+		return g.authenticate(r)
+	}
+
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || g.adminKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(g.adminKey)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	return g.defaultMerchant.Get(r.Context(), DefaultMerchant)
+}
+
+// writeAuthError answers requests without a valid API key
+func writeAuthError(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="gateway"`)
+	http.Error(w, ErrInvalidAPIKey.Error(), http.StatusUnauthorized)
+}
+
+// merchantWebhook returns where the events of a merchant are sent and the
+// secrets they are signed with
+func (g *Gateway) merchantWebhook(ctx context.Context, merchantID string) (string, []string, error) {
+	if g.merchants == nil || merchantID == DefaultMerchant {
+		return g.webhookURL, g.webhookSecrets, nil
+	}
+
+	m, err := g.merchants.Get(ctx, merchantID)
+	if err != nil {
+		return "", nil, err
+	}
+	if m.WebhookURL == "" {
+		return g.webhookURL, m.Secrets(), nil
+	}
+	return m.WebhookURL, m.Secrets(), nil
+}
@@ -0,0 +1,334 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/l402-protocol/go-example/chain"
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// DefaultConfirmTimeout is how long an on-chain payment seen before its
+// payment request expired may wait for its confirmations after the expiry.
+// Transactions that never confirm fail the payment then.
+const DefaultConfirmTimeout = 24 * time.Hour
+
+// DefaultLateFundsWindow is how long the addresses of expired payment
+// contexts are still checked for funds
+const DefaultLateFundsWindow = 7 * 24 * time.Hour
+
+// WithOnchainTimeouts sets how long seen payments may wait for confirmations
+// past their expiry, and how long expired addresses are checked for late
+// funds
+func WithOnchainTimeouts(confirm, lateFunds time.Duration) Option {
+	return func(g *Gateway) {
+		if confirm > 0 {
+			g.confirmTimeout = confirm
+		}
+		if lateFunds > 0 {
+			g.lateFundsWindow = lateFunds
+		}
+	}
+}
+
+func newAddressSeed() []byte {
+	seed := make([]byte, 32)
+	rand.Read(seed)
+	return seed
+}
+
+// onchainProvider takes payments to an address of the payment context,
+// watched until they have enough confirmations
+type onchainProvider struct {
+	g *Gateway
+}
+
+func (p *onchainProvider) Method() l402.PaymentMethods {
+	return l402.Onchain
+}
+
+func (p *onchainProvider) Capabilities() Capabilities {
+	return Capabilities{HostedCheckout: true}
+}
+
+func (p *onchainProvider) RequestPayment(ctx context.Context, pc *PaymentContext, offer l402.Offer, req l402.PaymentRequestRequest) (l402.PayReq, error) {
+	info, err := p.g.chain.Info(ctx)
+	if err != nil {
+		return l402.PayReq{}, fmt.Errorf("%w: %w", ErrProviderUnavailable, err)
+	}
+
+	// The asset is the offer currency, e.g. a USD stablecoin
+	if req.Chain != "" && req.Chain != info.Chain {
+		return l402.PayReq{}, fmt.Errorf("%w: unsupported chain", errBadPaymentRequest)
+	}
+	if req.Asset != "" && req.Asset != offer.Currency {
+		return l402.PayReq{}, fmt.Errorf("%w: unsupported asset", errBadPaymentRequest)
+	}
+
+	pc, err = p.g.reserveAddress(ctx, pc, offer)
+	if err != nil {
+		return l402.PayReq{}, err
+	}
+
+	p.g.logger.Info("on-chain address reserved",
+		"offer_id", offer.ID,
+		"payment_context", pc.Token,
+		"address", pc.Address,
+		"asset", offer.Currency,
+		"amount", offer.Amount,
+		"confirmations", p.g.confirmations,
+	)
+
+	return l402.PayReq{
+		Address: pc.Address,
+		Asset:   offer.Currency,
+		Chain:   info.Chain,
+	}, nil
+}
+
+// Status looks at what the address of pc received
+func (p *onchainProvider) Status(ctx context.Context, pc *PaymentContext) (ContextStatus, error) {
+	offer, ok := pc.Offer(pc.OfferID)
+	if pc.Address == "" || !ok {
+		return pc.Status, nil
+	}
+
+	confirmed, err := p.g.chain.Received(ctx, pc.Address, offer.Currency, p.g.confirmations)
+	if err != nil {
+		return "", err
+	}
+	if confirmed >= int64(offer.Amount) {
+		return StatusPaid, nil
+	}
+	seen, err := p.g.chain.Received(ctx, pc.Address, offer.Currency, 0)
+	if err != nil {
+		return "", err
+	}
+	if seen >= int64(offer.Amount) {
+		return StatusPending, nil
+	}
+	return pc.Status, nil
+}
+
+// Cancel stops watching the address, it's no longer reserved
+func (p *onchainProvider) Cancel(ctx context.Context, pc *PaymentContext) error {
+	p.g.unwatch(pc.Token)
+	return nil
+}
+
+func (p *onchainProvider) Refund(ctx context.Context, pc *PaymentContext, amount int) (string, error) {
+	return "", fmt.Errorf("%w: on-chain payments can't be refunded", ErrUnsupported)
+}
+
+// reserveAddress gives the payment context its own address, kept across
+// requests, and watches it for the payment of offer
+func (g *Gateway) reserveAddress(ctx context.Context, pc *PaymentContext, offer l402.Offer) (*PaymentContext, error) {
+	pc, err := g.update(ctx, pc.Token, func(pc *PaymentContext) error {
+		if pc.Address == "" {
+			pc.Address = chain.DeriveAddress(g.addressSeed, pc.Token)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	g.watch(pc, offer)
+	return pc, nil
+}
+
+// watch starts watching the address of a payment context unless it is
+// already watched
+func (g *Gateway) watch(pc *PaymentContext, offer l402.Offer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.watching[pc.Token]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g.watching[pc.Token] = cancel
+	go g.watchAddress(ctx, pc.Token, offer, pc.Address)
+}
+
+// unwatch stops watching the address of a payment context
+func (g *Gateway) unwatch(token string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if cancel, ok := g.watching[token]; ok {
+		cancel()
+		delete(g.watching, token)
+	}
+}
+
+// resumeWatches restarts the watchers of stored on-chain payments that were
+// still open when the gateway stopped
+func (g *Gateway) resumeWatches() {
+	if g.chain == nil {
+		return
+	}
+
+	contexts, err := g.store.List(context.Background())
+	if err != nil {
+		g.logger.Error("failed to list payment contexts",
+			"error", err,
+		)
+		return
+	}
+
+	for _, pc := range contexts {
+		open := pc.Status == StatusPending ||
+			(CanTransition(pc.Status, StatusPending) && g.clock.Now().Before(pc.ExpiresAt))
+		if pc.Address == "" || !open {
+			continue
+		}
+		offer, ok := pc.Offer(pc.OfferID)
+		if !ok {
+			continue
+		}
+
+		g.logger.Info("resuming on-chain payment watch",
+			"payment_context", pc.Token,
+			"address", pc.Address,
+		)
+		g.watch(pc, offer)
+	}
+}
+
+// watchAddress waits for address to receive the offer amount with enough
+// confirmations and then settles the payment. Once the payment is seen the
+// context is pending and only fails if it doesn't confirm in time. It stops
+// when ctx is cancelled, e.g. when the payment context expires; the sweeper
+// then looks for late funds.
+func (g *Gateway) watchAddress(ctx context.Context, paymentContext string, offer l402.Offer, address string) {
+	defer g.unwatch(paymentContext)
+
+	ticker := time.NewTicker(g.pollInterval)
+	defer ticker.Stop()
+
+	seen := false
+	for {
+		select {
+		case <-ctx.Done():
+			g.logger.Info("stopped watching address",
+				"payment_context", paymentContext,
+				"address", address,
+			)
+			return
+		case <-ticker.C:
+		}
+
+		if !seen {
+			received, err := g.chain.Received(ctx, address, offer.Currency, 0)
+			if err != nil {
+				g.logger.Error("failed to check address",
+					"error", err,
+					"address", address,
+				)
+				continue
+			}
+			if received < int64(offer.Amount) {
+				continue
+			}
+
+			_, err = g.transition(ctx, paymentContext, StatusPending, "on-chain payment seen at "+address)
+			if err != nil && !errors.Is(err, ErrPaymentPending) {
+				g.logger.Warn("stopped watching address",
+					"error", err,
+					"payment_context", paymentContext,
+				)
+				return
+			}
+			seen = true
+		}
+
+		received, err := g.chain.Received(ctx, address, offer.Currency, g.confirmations)
+		if err != nil {
+			g.logger.Error("failed to check address",
+				"error", err,
+				"address", address,
+			)
+			continue
+		}
+		if received < int64(offer.Amount) {
+			continue
+		}
+
+		g.logger.Info("on-chain payment confirmed",
+			"payment_context", paymentContext,
+			"offer_id", offer.ID,
+			"address", address,
+			"received", received,
+		)
+
+		if err := g.settle(ctx, paymentContext, "on-chain payment confirmed"); err != nil {
+			g.logger.Error("failed to settle payment",
+				"error", err,
+				"payment_context", paymentContext,
+			)
+		}
+		return
+	}
+}
+
+// checkLateFunds looks for funds received at the addresses of expired
+// payment contexts, e.g. a transaction broadcast after the expiry or one
+// that confirmed too late. They can't pay the context anymore, so the
+// context is flagged and the backend told to refund them by hand.
+func (g *Gateway) checkLateFunds(ctx context.Context) {
+	if g.chain == nil {
+		return
+	}
+	contexts, err := g.store.List(ctx)
+	if err != nil {
+		g.logger.Error("failed to list payment contexts",
+			"error", err,
+		)
+		return
+	}
+
+	now := g.clock.Now()
+	for _, pc := range contexts {
+		if pc.Status != StatusExpired || pc.Address == "" || now.After(pc.ExpiresAt.Add(g.lateFundsWindow)) {
+			continue
+		}
+		offer, ok := pc.Offer(pc.OfferID)
+		if !ok {
+			continue
+		}
+		received, err := g.chain.Received(ctx, pc.Address, offer.Currency, g.confirmations)
+		if err != nil {
+			g.logger.Error("failed to check address",
+				"error", err,
+				"address", pc.Address,
+			)
+			continue
+		}
+		if received <= pc.LateFunds {
+			continue
+		}
+
+		pc, err := g.write(ctx, pc.Token, func(pc *PaymentContext) ([]Event, error) {
+			pc.LateFunds = received
+			return []Event{g.newEvent(EventPaymentLateFunds, pc)}, nil
+		})
+		if err != nil {
+			g.logger.Error("failed to flag late funds",
+				"error", err,
+				"payment_context", pc.Token,
+			)
+			continue
+		}
+
+		g.logger.Warn("late on-chain funds need a manual refund",
+			"payment_context", pc.Token,
+			"address", pc.Address,
+			"late_funds", received,
+			"asset", offer.Currency,
+		)
+		g.subscribers.notify(pc.Token)
+	}
+}
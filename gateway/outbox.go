@@ -0,0 +1,624 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Defaults of webhook delivery
+const (
+	DefaultWebhookWorkers     = 4
+	DefaultWebhookMaxAttempts = 10
+	DefaultWebhookBackoff     = 5 * time.Second
+	DefaultWebhookMaxBackoff  = time.Hour
+)
+
+// deliveryLeaseMargin is how much longer than its longest possible send a
+// claimed delivery is reserved for
+const deliveryLeaseMargin = time.Minute
+
+// outboxPollInterval is how often the dispatcher looks for due deliveries
+// when nothing wakes it up
+const outboxPollInterval = time.Second
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryDead      DeliveryStatus = "dead"
+)
+
+var (
+	ErrDeliveryNotFound = errors.New("delivery not found")
+	ErrDeliveryInFlight = errors.New("delivery is being sent")
+)
+
+// Delivery is an event waiting in the outbox to be sent to its webhook, or
+// the record of how it was sent. Dead deliveries gave up after the maximum
+// attempts and wait for a manual redelivery.
+type Delivery struct {
+	ID            string         `json:"id"`
+	Event         Event          `json:"event"`
+	Status        DeliveryStatus `json:"status"`
+	Attempts      int            `json:"attempts"`
+	NextAttemptAt time.Time      `json:"next_attempt_at"`
+	LeasedUntil   *time.Time     `json:"leased_until,omitempty"`
+	LastError     string         `json:"last_error,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	DeliveredAt   *time.Time     `json:"delivered_at,omitempty"`
+}
+
+// Outbox keeps deliveries. Like Store, implementations return copies.
+type Outbox interface {
+	// Enqueue adds a delivery
+	Enqueue(ctx context.Context, d *Delivery) error
+
+	// Claim returns up to limit pending deliveries due at now, and leases
+	// them until now+lease so they aren't claimed twice. The lease is kept
+	// in LeasedUntil and NextAttemptAt.
+	Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error)
+
+	// Get returns the delivery with the given ID
+	Get(ctx context.Context, id string) (*Delivery, error)
+
+	// Update applies fn to a delivery atomically
+	Update(ctx context.Context, id string, fn func(d *Delivery) error) (*Delivery, error)
+
+	// List returns the deliveries with status, or all if status is empty,
+	// oldest first
+	List(ctx context.Context, status DeliveryStatus) ([]*Delivery, error)
+}
+
+// MemoryOutbox keeps deliveries in memory
+type MemoryOutbox struct {
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{
+		deliveries: make(map[string]*Delivery),
+	}
+}
+
+func (o *MemoryOutbox) Enqueue(ctx context.Context, d *Delivery) error {
+	return o.enqueue(d)
+}
+
+// enqueue adds all deliveries or none
+func (o *MemoryOutbox) enqueue(deliveries ...*Delivery) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, d := range deliveries {
+		if _, ok := o.deliveries[d.ID]; ok {
+			return fmt.Errorf("delivery %s already exists", d.ID)
+		}
+	}
+	for _, d := range deliveries {
+		stored := *d
+		o.deliveries[d.ID] = &stored
+	}
+	return nil
+}
+
+func (o *MemoryOutbox) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var due []*Delivery
+	for _, d := range o.deliveries {
+		if d.Status == DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	claimed := make([]*Delivery, len(due))
+	for i, d := range due {
+		d.lease(now, lease)
+		c := *d
+		claimed[i] = &c
+	}
+	return claimed, nil
+}
+
+func (o *MemoryOutbox) Get(ctx context.Context, id string) (*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	d, ok := o.deliveries[id]
+	if !ok {
+		return nil, ErrDeliveryNotFound
+	}
+	c := *d
+	return &c, nil
+}
+
+func (o *MemoryOutbox) Update(ctx context.Context, id string, fn func(d *Delivery) error) (*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	old, ok := o.deliveries[id]
+	if !ok {
+		return nil, ErrDeliveryNotFound
+	}
+
+	d := *old
+	if err := fn(&d); err != nil {
+		return nil, err
+	}
+	d.ID = old.ID
+	o.deliveries[id] = &d
+	c := d
+	return &c, nil
+}
+
+func (o *MemoryOutbox) List(ctx context.Context, status DeliveryStatus) ([]*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var list []*Delivery
+	for _, d := range o.deliveries {
+		if status == "" || d.Status == status {
+			c := *d
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+// FileOutbox is the outbox of a FileStore, kept in its database file
+type FileOutbox struct {
+	db *bolt.DB
+}
+
+func (o *FileOutbox) Enqueue(ctx context.Context, d *Delivery) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return addDelivery(tx.Bucket(deliveriesBucket), d)
+	})
+}
+
+func (o *FileOutbox) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	var claimed []*Delivery
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+		due, err := listDeliveries(b, func(d *Delivery) bool {
+			return d.Status == DeliveryPending && !d.NextAttemptAt.After(now)
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(due, func(i, j int) bool {
+			return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+		})
+		if len(due) > limit {
+			due = due[:limit]
+		}
+		for _, d := range due {
+			d.lease(now, lease)
+			if err := putDelivery(b, d); err != nil {
+				return err
+			}
+		}
+		claimed = due
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (o *FileOutbox) Get(ctx context.Context, id string) (*Delivery, error) {
+	var d *Delivery
+	err := o.db.View(func(tx *bolt.Tx) error {
+		var err error
+		d, err = getDelivery(tx.Bucket(deliveriesBucket), id)
+		return err
+	})
+	return d, err
+}
+
+func (o *FileOutbox) Update(ctx context.Context, id string, fn func(d *Delivery) error) (*Delivery, error) {
+	var d *Delivery
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+		var err error
+		if d, err = getDelivery(b, id); err != nil {
+			return err
+		}
+		if err := fn(d); err != nil {
+			return err
+		}
+		d.ID = id
+		return putDelivery(b, d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (o *FileOutbox) List(ctx context.Context, status DeliveryStatus) ([]*Delivery, error) {
+	var list []*Delivery
+	err := o.db.View(func(tx *bolt.Tx) error {
+		var err error
+		list, err = listDeliveries(tx.Bucket(deliveriesBucket), func(d *Delivery) bool {
+			return status == "" || d.Status == status
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+// addDelivery stores a new delivery
+func addDelivery(b *bolt.Bucket, d *Delivery) error {
+	if b.Get([]byte(d.ID)) != nil {
+		return fmt.Errorf("delivery %s already exists", d.ID)
+	}
+	return putDelivery(b, d)
+}
+
+func getDelivery(b *bolt.Bucket, id string) (*Delivery, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, ErrDeliveryNotFound
+	}
+	var d Delivery
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("failed to parse delivery %s: %w", id, err)
+	}
+	return &d, nil
+}
+
+func putDelivery(b *bolt.Bucket, d *Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(d.ID), data)
+}
+
+// listDeliveries returns the deliveries of b matching keep
+func listDeliveries(b *bolt.Bucket, keep func(d *Delivery) bool) ([]*Delivery, error) {
+	var list []*Delivery
+	err := b.ForEach(func(k, v []byte) error {
+		var d Delivery
+		if err := json.Unmarshal(v, &d); err != nil {
+			return fmt.Errorf("failed to parse delivery %s: %w", k, err)
+		}
+		if keep(&d) {
+			list = append(list, &d)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// WithOutbox keeps undelivered events in o instead of the outbox of the
+// store. Events are then written after the change causing them, not with it.
+func WithOutbox(o Outbox) Option {
+	return func(g *Gateway) {
+		g.outbox = o
+	}
+}
+
+// WithWebhookRetries sets how many workers deliver events and how failed
+// deliveries are retried: after backoff, doubling up to maxBackoff, at most
+// maxAttempts times before the delivery is dead.
+func WithWebhookRetries(workers, maxAttempts int, backoff, maxBackoff time.Duration) Option {
+	return func(g *Gateway) {
+		if workers > 0 {
+			g.webhookWorkers = workers
+		}
+		if maxAttempts > 0 {
+			g.webhookMaxAttempts = maxAttempts
+		}
+		if backoff > 0 {
+			g.webhookBackoff = backoff
+		}
+		if maxBackoff > 0 {
+			g.webhookMaxBackoff = maxBackoff
+		}
+	}
+}
+
+// lease reserves a delivery for the worker claiming it at now
+func (d *Delivery) lease(now time.Time, lease time.Duration) {
+	until := now.Add(lease).UTC()
+	d.LeasedUntil = &until
+	d.NextAttemptAt = until
+}
+
+// leased reports whether a worker may be sending the delivery at now
+func (d *Delivery) leased(now time.Time) bool {
+	return d.Status == DeliveryPending && d.LeasedUntil != nil && d.LeasedUntil.After(now)
+}
+
+// deliveryLease returns how long a claimed delivery is reserved for. It may
+// wait for a busy worker, then be sent, each taking up to the webhook
+// timeout. A gateway stopping mid-delivery retries it after the lease.
+func (g *Gateway) deliveryLease() time.Duration {
+	return 2*g.client.Timeout + deliveryLeaseMargin
+}
+
+// newDelivery returns the delivery of an event, due right away
+func newDelivery(event Event, now time.Time) *Delivery {
+	return &Delivery{
+		ID:            event.ID,
+		Event:         event,
+		Status:        DeliveryPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+}
+
+// deliver makes one attempt to send a delivery and records the outcome. The
+// attempt gives up before the lease ends, so no other worker sends it too.
+func (g *Gateway) deliver(ctx context.Context, d *Delivery) {
+	sendCtx := ctx
+	if d.LeasedUntil != nil {
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithDeadline(ctx, d.LeasedUntil.Add(-deliveryLeaseMargin/2))
+		defer cancel()
+	}
+	err := g.send(sendCtx, d.Event, d.Attempts+1)
+
+	updated, updateErr := g.outbox.Update(ctx, d.ID, func(d *Delivery) error {
+		now := g.clock.Now().UTC()
+		d.LeasedUntil = nil
+		d.Attempts++
+		d.UpdatedAt = now
+		if err == nil {
+			d.Status = DeliveryDelivered
+			d.DeliveredAt = &now
+			d.LastError = ""
+			return nil
+		}
+
+		d.LastError = err.Error()
+		if d.Attempts >= g.webhookMaxAttempts {
+			d.Status = DeliveryDead
+			return nil
+		}
+		d.NextAttemptAt = now.Add(g.retryDelay(d.Attempts))
+		return nil
+	})
+	if updateErr != nil {
+		g.logger.Error("failed to record delivery attempt",
+			"error", updateErr,
+			"event_id", d.ID,
+		)
+		return
+	}
+
+	switch {
+	case updated.Status == DeliveryDead:
+		g.logger.Error("event delivery failed for good",
+			"error", err,
+			"event_id", d.ID,
+			"type", d.Event.Type,
+			"merchant_id", d.Event.MerchantID,
+			"attempts", updated.Attempts,
+		)
+	case err != nil:
+		g.logger.Warn("event delivery failed, will retry",
+			"error", err,
+			"event_id", d.ID,
+			"type", d.Event.Type,
+			"attempts", updated.Attempts,
+			"next_attempt_at", updated.NextAttemptAt,
+		)
+	}
+}
+
+// retryDelay returns the delay before the next attempt after attempts
+// failures, with some jitter so retries of many events spread out
+func (g *Gateway) retryDelay(attempts int) time.Duration {
+	delay := g.webhookBackoff
+	for i := 1; i < attempts && delay < g.webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, g.webhookMaxBackoff)
+	return delay - time.Duration(rand.Int64N(int64(delay)/5+1))
+}
+
+// runDispatcher delivers due events with a pool of workers until ctx is done
+func (g *Gateway) runDispatcher(ctx context.Context) {
+	jobs := make(chan *Delivery)
+	var wg sync.WaitGroup
+	for i := 0; i < g.webhookWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range jobs {
+				g.deliver(ctx, d)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-g.outboxWake:
+		}
+
+		due, err := g.outbox.Claim(ctx, g.clock.Now(), g.deliveryLease(), g.webhookWorkers)
+		if err != nil {
+			g.logger.Error("failed to claim deliveries",
+				"error", err,
+			)
+			continue
+		}
+		for _, d := range due {
+			select {
+			case jobs <- d:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// A full batch means more may be due right away
+		if len(due) == g.webhookWorkers {
+			g.wakeDispatcher()
+		}
+	}
+}
+
+// wakeDispatcher makes the dispatcher look for due deliveries now
+func (g *Gateway) wakeDispatcher() {
+	select {
+	case g.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// Redeliver schedules a delivery, typically a dead one, to be sent again
+// right away with a fresh attempt budget. Deliveries a worker is sending
+// can't be redelivered until it is done.
+func (g *Gateway) Redeliver(ctx context.Context, id string) (*Delivery, error) {
+	d, err := g.outbox.Update(ctx, id, func(d *Delivery) error {
+		now := g.clock.Now().UTC()
+		if d.leased(now) {
+			return ErrDeliveryInFlight
+		}
+		d.Status = DeliveryPending
+		d.Attempts = 0
+		d.LeasedUntil = nil
+		d.NextAttemptAt = now
+		d.UpdatedAt = now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	g.logger.Info("event redelivery scheduled",
+		"event_id", d.ID,
+		"type", d.Event.Type,
+		"merchant_id", d.Event.MerchantID,
+	)
+	g.wakeDispatcher()
+	return d, nil
+}
+
+// handleListDeliveries lists the deliveries of the merchant, e.g.
+// ?status=dead for the dead letters
+func (g *Gateway) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	merchant, err := g.authenticateKey(r)
+	if err != nil {
+		writeAuthError(w)
+		return
+	}
+
+	status := DeliveryStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryDead:
+	default:
+		http.Error(w, "unknown delivery status", http.StatusBadRequest)
+		return
+	}
+
+	all, err := g.outbox.List(r.Context(), status)
+	if err != nil {
+		g.logger.Error("failed to list deliveries",
+			"error", err,
+		)
+		http.Error(w, "failed to list deliveries", http.StatusInternalServerError)
+		return
+	}
+	deliveries := make([]*Delivery, 0, len(all))
+	for _, d := range all {
+		if d.Event.MerchantID == merchant.ID {
+			deliveries = append(deliveries, d)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// handleRedeliver sends an event of the merchant again
+func (g *Gateway) handleRedeliver(w http.ResponseWriter, r *http.Request) {
+	merchant, err := g.authenticateKey(r)
+	if err != nil {
+		writeAuthError(w)
+		return
+	}
+
+	// Deliveries of other merchants look like missing ones
+	id := r.PathValue("id")
+	d, err := g.outbox.Get(r.Context(), id)
+	if err == nil && d.Event.MerchantID != merchant.ID {
+		err = ErrDeliveryNotFound
+	}
+	if errors.Is(err, ErrDeliveryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		g.logger.Error("failed to find delivery",
+			"error", err,
+			"event_id", id,
+		)
+		http.Error(w, "failed to find delivery", http.StatusInternalServerError)
+		return
+	}
+
+	d, err = g.Redeliver(r.Context(), id)
+	if errors.Is(err, ErrDeliveryInFlight) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		g.logger.Error("failed to schedule redelivery",
+			"error", err,
+			"event_id", id,
+		)
+		http.Error(w, "failed to schedule redelivery", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,357 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+
+	"github.com/l402-protocol/go-example/cardproc"
+	"github.com/l402-protocol/go-example/l402"
+)
+
+//go:embed templates/*.html
+var builtinTemplates embed.FS
+
+// Checkout pages. Each is parsed with the shared templates and rendered
+// through the "layout" template.
+const (
+	pageCheckout  = "checkout.html"
+	pageCard      = "card.html"
+	pageChallenge = "challenge.html"
+	pageSuccess   = "success.html"
+	pageFailure   = "failure.html"
+	pageExpired   = "expired.html"
+)
+
+// sharedTemplates are parsed before every page, which may redefine their
+// blocks
+var sharedTemplates = []string{"layout.html", "partials.html"}
+
+// methodLabels are the names customers see for payment methods
+var methodLabels = map[l402.PaymentMethods]string{
+	l402.FakePay:    "Test payment",
+	l402.CreditCard: "Card",
+	l402.Onchain:    "On-chain",
+	l402.Lightning:  "Lightning",
+}
+
+// WithTemplates renders checkout pages with the templates in dir. A file
+// there replaces the built-in template of the same name, and a file in
+// dir/<merchant ID> replaces it for that merchant only. Templates are read
+// on every render so edits show up without a restart.
+func WithTemplates(dir string) Option {
+	return func(g *Gateway) {
+		g.templatesDir = dir
+	}
+}
+
+// pageData is what checkout templates are rendered with
+type pageData struct {
+	Token   string
+	Offer   l402.Offer
+	Price   string
+	Status  ContextStatus
+	Message string
+
+	// Methods the customer can choose from and the one chosen
+	Methods []methodOption
+	Method  l402.PaymentMethods
+
+	// Method specific details
+	Address          string
+	Asset            string
+	Chain            string
+	Confirmations    int
+	QR               template.URL
+	ChargeID         string
+	CardTokenExample string
+
+	ExpiresAt time.Time
+	StatusURL string
+	RetryURL  string
+
+	// Where the forms of the page post to, under the public URL
+	PayURL          string
+	CheckoutURL     string
+	CardCheckoutURL string
+	ChallengeURL    string
+
+	// Refresh reloads the page when the payment status changes
+	Refresh bool
+
+	// CSRFToken must be posted with forms that change the payment
+	CSRFToken string
+}
+
+type methodOption struct {
+	Method   l402.PaymentMethods
+	Label    string
+	Selected bool
+}
+
+// newPageData describes pc and the offer being paid to templates
+func (g *Gateway) newPageData(pc *PaymentContext, offer l402.Offer) *pageData {
+	data := &pageData{
+		Token:            pc.Token,
+		Offer:            offer,
+		Status:           pc.Status,
+		Method:           pc.PaymentMethod,
+		ExpiresAt:        pc.ExpiresAt,
+		StatusURL:        g.url("/payments/"+pc.Token, nil),
+		CardTokenExample: cardproc.TokenSuccess,
+		PayURL:           g.url("/pay", nil),
+		CheckoutURL:      g.url("/checkout", nil),
+		CardCheckoutURL:  g.url("/card-checkout", nil),
+		ChallengeURL:     g.url("/card-checkout/challenge", nil),
+	}
+	if offer.ID != "" {
+		data.Price = l402.FormatPrice(offer.Amount, offer.Currency)
+		data.RetryURL = g.payURL(pc.Token, offer.ID)
+	}
+	for _, m := range offer.PaymentMethods {
+		if !g.supports(m) {
+			continue
+		}
+		label, ok := methodLabels[m]
+		if !ok {
+			label = string(m)
+		}
+		data.Methods = append(data.Methods, methodOption{
+			Method:   m,
+			Label:    label,
+			Selected: m == pc.PaymentMethod,
+		})
+	}
+	return data
+}
+
+// payURL returns the hosted checkout of an offer
+func (g *Gateway) payURL(token, offerID string) string {
+	return g.url("/pay", url.Values{
+		"payment_context_token": {token},
+		"offer_id":              {offerID},
+	})
+}
+
+// templateSource returns the template file name of merchantID, looking in
+// the merchant directory, the templates directory and the built-ins
+func (g *Gateway) templateSource(merchantID, name string) ([]byte, error) {
+	if g.templatesDir != "" {
+		var dirs []string
+		if merchantID != "" && filepath.IsLocal(merchantID) {
+			dirs = append(dirs, filepath.Join(g.templatesDir, merchantID))
+		}
+		dirs = append(dirs, g.templatesDir)
+
+		for _, dir := range dirs {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				return data, nil
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	return builtinTemplates.ReadFile("templates/" + name)
+}
+
+// parsePage parses a page of merchantID with the shared templates
+func (g *Gateway) parsePage(merchantID, name string) (*template.Template, error) {
+	t := template.New("page")
+	for _, file := range slices.Concat(sharedTemplates, []string{name}) {
+		src, err := g.templateSource(merchantID, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template %s: %w", file, err)
+		}
+		if _, err := t.New(file).Parse(string(src)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// render writes a checkout page. It is rendered in full before anything is
+// written, so a broken template gives a clean error.
+func (g *Gateway) render(w http.ResponseWriter, merchantID, name string, status int, data *pageData) {
+	var buf bytes.Buffer
+	t, err := g.parsePage(merchantID, name)
+	if err == nil {
+		err = t.ExecuteTemplate(&buf, "layout", data)
+	}
+	if err != nil {
+		g.logger.Error("failed to render page",
+			"error", err,
+			"page", name,
+			"merchant_id", merchantID,
+		)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// writePageError answers a checkout page request that failed. An expired
+// payment context gets the expired page.
+func (g *Gateway) writePageError(w http.ResponseWriter, r *http.Request, token, offerID string, err error) {
+	if errors.Is(err, ErrContextExpired) {
+		if pc, getErr := g.store.Get(r.Context(), token); getErr == nil {
+			offer, _ := pc.Offer(offerID)
+			g.render(w, pc.MerchantID, pageExpired, http.StatusGone, g.newPageData(pc, offer))
+			return
+		}
+	}
+	writeContextError(w, err)
+}
+
+// qrDataURL returns a QR code of content as a data URL for img tags
+func qrDataURL(content string) template.URL {
+	png, err := qrcode.Encode(content, qrcode.Medium, 256)
+	if err != nil {
+		return ""
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+}
+
+// lastReason returns why a payment context reached its status
+func lastReason(pc *PaymentContext) string {
+	if len(pc.History) == 0 {
+		return ""
+	}
+	return pc.History[len(pc.History)-1].Reason
+}
+
+// handlePayPage shows the hosted checkout of an offer. The customer picks
+// one of its payment methods and gets the details to pay with it.
+func (g *Gateway) handlePayPage(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("payment_context_token")
+	offerID := r.URL.Query().Get("offer_id")
+
+	pc, err := g.current(r.Context(), token)
+	if err != nil {
+		writeContextError(w, err)
+		return
+	}
+	offer, ok := pc.Offer(offerID)
+	if !ok {
+		writeContextError(w, errOfferNotFound)
+		return
+	}
+	if pc.OfferID != "" && pc.OfferID != offerID {
+		writeContextError(w, errOfferMismatch)
+		return
+	}
+
+	data := g.newPageData(pc, offer)
+	switch pc.Status {
+	case StatusPaid, StatusPartiallyRefunded:
+		w.Header().Set(l402.PaymentStatusHeader, l402.PaymentStatusPaid)
+		g.render(w, pc.MerchantID, pageSuccess, http.StatusOK, data)
+		return
+	case StatusExpired:
+		g.render(w, pc.MerchantID, pageExpired, http.StatusGone, data)
+		return
+	case StatusRefunded:
+		data.Message = "This payment was refunded."
+		data.RetryURL = ""
+		g.render(w, pc.MerchantID, pageFailure, http.StatusOK, data)
+		return
+	case StatusFailed:
+		data.Message = "The last payment attempt failed"
+		if reason := lastReason(pc); reason != "" {
+			data.Message += " (" + reason + ")"
+		}
+		data.Message += ". Choose a payment method to try again."
+		data.Method = ""
+	case StatusPending:
+		data.Refresh = true
+	}
+
+	if err := g.methodDetails(r.Context(), pc, offer, data); err != nil {
+		g.logger.Error("failed to get payment details",
+			"error", err,
+			"payment_context", token,
+			"payment_method", pc.PaymentMethod,
+		)
+		data.Message = "Payment details are unavailable right now, try again later."
+	}
+	data.CSRFToken = g.csrfToken(w, r, token)
+	g.render(w, pc.MerchantID, pageCheckout, http.StatusOK, data)
+}
+
+// methodDetails adds what the customer needs to pay with the chosen method
+func (g *Gateway) methodDetails(ctx context.Context, pc *PaymentContext, offer l402.Offer, data *pageData) error {
+	switch data.Method {
+	case l402.Onchain:
+		info, err := g.chain.Info(ctx)
+		if err != nil {
+			return err
+		}
+		data.Address = pc.Address
+		data.Asset = offer.Currency
+		data.Chain = info.Chain
+		data.Confirmations = g.confirmations
+		data.QR = qrDataURL(pc.Address)
+		data.Refresh = true
+	}
+	return nil
+}
+
+// handlePayMethod asks for payment with the method the customer picked on
+// the hosted checkout, then shows its details
+func (g *Gateway) handlePayMethod(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("payment_context_token")
+	offerID := r.PostFormValue("offer_id")
+	method := l402.PaymentMethods(r.PostFormValue("payment_method"))
+
+	if !g.checkCSRF(r, token) {
+		http.Error(w, errInvalidCSRF.Error(), http.StatusForbidden)
+		return
+	}
+	if !g.supports(method) {
+		http.Error(w, "payment method not supported", http.StatusBadRequest)
+		return
+	}
+
+	pc, offer, err := g.requestPayment(r.Context(), token, offerID, method)
+	if err == nil {
+		provider, _ := g.providers.Get(method)
+		_, err = provider.RequestPayment(r.Context(), pc, offer, l402.PaymentRequestRequest{
+			OfferID:             offerID,
+			PaymentMethod:       string(method),
+			PaymentContextToken: token,
+		})
+	}
+	if err != nil {
+		g.logger.Warn("checkout method rejected",
+			"error", err,
+			"payment_context", token,
+			"offer_id", offerID,
+			"payment_method", method,
+		)
+		g.writePageError(w, r, token, offerID, err)
+		return
+	}
+
+	g.logger.Info("checkout method chosen",
+		"payment_context", token,
+		"offer_id", offerID,
+		"payment_method", method,
+	)
+	http.Redirect(w, r, g.payURL(token, offerID), http.StatusSeeOther)
+}
@@ -0,0 +1,169 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+var (
+	ErrUnsupported         = errors.New("not supported by the payment provider")
+	ErrProviderUnavailable = errors.New("payment provider unavailable")
+
+	errBadPaymentRequest = errors.New("invalid payment request")
+)
+
+// PaymentProvider takes payments with one payment method. The gateway keeps
+// the payment context and its lifecycle; providers move the money and say
+// how the payment is going.
+type PaymentProvider interface {
+	// Method is the payment method the provider takes
+	Method() l402.PaymentMethods
+
+	// Capabilities advertises what the provider can do
+	Capabilities() Capabilities
+
+	// RequestPayment returns what the client needs to pay offer. pc already
+	// records the payment request.
+	RequestPayment(ctx context.Context, pc *PaymentContext, offer l402.Offer, req l402.PaymentRequestRequest) (l402.PayReq, error)
+
+	// Status checks the payment of pc with the provider and returns the
+	// status pc should have, or its current one when nothing changed
+	Status(ctx context.Context, pc *PaymentContext) (ContextStatus, error)
+
+	// Cancel releases what was reserved for the payment of pc, e.g. when it
+	// expires
+	Cancel(ctx context.Context, pc *PaymentContext) error
+
+	// Refund gives amount of the paid payment of pc back to the customer and
+	// returns the ID of the refund at the provider, if it has one. The ID is
+	// kept even when an error is returned too.
+	Refund(ctx context.Context, pc *PaymentContext, amount int) (string, error)
+}
+
+// Capabilities is what a payment provider can do
+type Capabilities struct {
+	// The customer pays on a page hosted by the gateway
+	HostedCheckout bool `json:"hosted_checkout"`
+
+	// Paid payments can be refunded, in full or in part
+	Refunds        bool `json:"refunds"`
+	PartialRefunds bool `json:"partial_refunds"`
+}
+
+// Providers is a registry of payment providers keyed by payment method
+type Providers map[l402.PaymentMethods]PaymentProvider
+
+// Register adds p, replacing the provider of its method
+func (ps Providers) Register(p PaymentProvider) {
+	ps[p.Method()] = p
+}
+
+// Get returns the provider of method
+func (ps Providers) Get(method l402.PaymentMethods) (PaymentProvider, bool) {
+	p, ok := ps[method]
+	return p, ok
+}
+
+// Methods returns the payment methods with a provider, sorted
+func (ps Providers) Methods() []l402.PaymentMethods {
+	methods := make([]l402.PaymentMethods, 0, len(ps))
+	for m := range ps {
+		methods = append(methods, m)
+	}
+	slices.Sort(methods)
+	return methods
+}
+
+// WithProvider takes payments with p, replacing the provider of its method
+func WithProvider(p PaymentProvider) Option {
+	return func(g *Gateway) {
+		g.providers.Register(p)
+	}
+}
+
+// supports reports whether the gateway can take payments with method
+func (g *Gateway) supports(method l402.PaymentMethods) bool {
+	_, ok := g.providers.Get(method)
+	return ok
+}
+
+// cancel tells the provider of pc its payment won't happen
+func (g *Gateway) cancel(ctx context.Context, pc *PaymentContext) {
+	p, ok := g.providers.Get(pc.PaymentMethod)
+	if !ok {
+		return
+	}
+	if err := p.Cancel(ctx, pc); err != nil {
+		g.logger.Error("failed to cancel payment",
+			"error", err,
+			"payment_context", pc.Token,
+			"payment_method", pc.PaymentMethod,
+		)
+	}
+}
+
+// syncStatus asks the provider of pc how its payment is going and records
+// what changed
+func (g *Gateway) syncStatus(ctx context.Context, pc *PaymentContext) *PaymentContext {
+	p, ok := g.providers.Get(pc.PaymentMethod)
+	if !ok || final(pc.Status) {
+		return pc
+	}
+	status, err := p.Status(ctx, pc)
+	if err != nil {
+		g.logger.Warn("failed to check payment status",
+			"error", err,
+			"payment_context", pc.Token,
+			"payment_method", pc.PaymentMethod,
+		)
+		return pc
+	}
+	if status == pc.Status || !CanTransition(pc.Status, status) {
+		return pc
+	}
+
+	reason := "reported by the " + string(pc.PaymentMethod) + " provider"
+	if status == StatusPaid {
+		err = g.settle(ctx, pc.Token, reason)
+	} else {
+		_, err = g.transition(ctx, pc.Token, status, reason)
+	}
+	if err != nil {
+		g.logger.Warn("failed to record payment status",
+			"error", err,
+			"payment_context", pc.Token,
+			"status", status,
+		)
+	}
+	if updated, err := g.current(ctx, pc.Token); err == nil {
+		return updated
+	}
+	return pc
+}
+
+// methodCapabilities advertises a payment method
+type methodCapabilities struct {
+	Method l402.PaymentMethods `json:"payment_method"`
+	Capabilities
+}
+
+// handlePaymentMethods lists the payment methods of the gateway and what
+// their providers can do
+func (g *Gateway) handlePaymentMethods(w http.ResponseWriter, r *http.Request) {
+	methods := []methodCapabilities{}
+	for _, m := range g.providers.Methods() {
+		p, _ := g.providers.Get(m)
+		methods = append(methods, methodCapabilities{
+			Method:       m,
+			Capabilities: p.Capabilities(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(methods)
+}
@@ -0,0 +1,300 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// RefundStatus is the state of a refund
+type RefundStatus string
+
+const (
+	RefundPending   RefundStatus = "pending"
+	RefundSucceeded RefundStatus = "succeeded"
+	RefundFailed    RefundStatus = "failed"
+)
+
+var (
+	ErrRefundAmount = errors.New("invalid refund amount")
+	ErrRefundFailed = errors.New("refund failed")
+)
+
+// Refund gives part or all of a payment back to the customer. A refund is
+// pending while the provider makes it, so refunds made at the same time
+// can't give back more than was paid.
+type Refund struct {
+	ID       string       `json:"id"`
+	Amount   int          `json:"amount"`
+	Currency string       `json:"currency"`
+	Reason   string       `json:"reason,omitempty"`
+	Status   RefundStatus `json:"status"`
+	Error    string       `json:"error,omitempty"`
+
+	// ID of the refund at the payment provider, to reconcile with it
+	ProviderRefundID string `json:"provider_refund_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RefundRequest asks for a refund. Without an amount, what is left of the
+// payment is refunded.
+type RefundRequest struct {
+	Amount int    `json:"amount,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// PaidOffer returns the offer the payment context was paid for
+func (pc *PaymentContext) PaidOffer() (l402.Offer, bool) {
+	if pc.PaidAt == nil {
+		return l402.Offer{}, false
+	}
+	return pc.Offer(pc.OfferID)
+}
+
+// RefundedAmount returns how much of the payment was given back
+func (pc *PaymentContext) RefundedAmount() int {
+	total := 0
+	for _, r := range pc.Refunds {
+		if r.Status == RefundSucceeded {
+			total += r.Amount
+		}
+	}
+	return total
+}
+
+// refundLeft returns how much of the payment can still be refunded. Refunds
+// in progress count as made.
+func (pc *PaymentContext) refundLeft() int {
+	offer, ok := pc.PaidOffer()
+	if !ok {
+		return 0
+	}
+	left := offer.Amount
+	for _, r := range pc.Refunds {
+		if r.Status != RefundFailed {
+			left -= r.Amount
+		}
+	}
+	return left
+}
+
+// refundable reports whether a payment context in status can be refunded
+func refundable(status ContextStatus) bool {
+	return status == StatusPaid || status == StatusPartiallyRefunded
+}
+
+// findRefund returns the refund of pc with the given ID
+func (pc *PaymentContext) findRefund(id string) *Refund {
+	for i := range pc.Refunds {
+		if pc.Refunds[i].ID == id {
+			return &pc.Refunds[i]
+		}
+	}
+	return nil
+}
+
+// Refund gives amount of the payment of a paid payment context back through
+// the provider of its payment method, all of what is left with amount 0.
+// The backend is told with a payment.refunded event, queued with the refund.
+func (g *Gateway) Refund(ctx context.Context, token string, amount int, reason string) (*PaymentContext, Refund, error) {
+	pc, err := g.current(ctx, token)
+	if err != nil {
+		return nil, Refund{}, err
+	}
+	if !refundable(pc.Status) {
+		return nil, Refund{}, &TransitionError{From: pc.Status, To: StatusRefunded}
+	}
+	p, ok := g.providers.Get(pc.PaymentMethod)
+	if !ok || !p.Capabilities().Refunds {
+		return nil, Refund{}, fmt.Errorf("%w: %s payments can't be refunded", ErrUnsupported, pc.PaymentMethod)
+	}
+	partial := p.Capabilities().PartialRefunds
+
+	// Reserve the amount first so concurrent refunds can't exceed the payment
+	now := g.clock.Now().UTC()
+	refund := Refund{
+		ID:        "re_" + uuid.New().String(),
+		Reason:    reason,
+		Status:    RefundPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	pc, err = g.update(ctx, token, func(pc *PaymentContext) error {
+		if !refundable(pc.Status) {
+			return &TransitionError{From: pc.Status, To: StatusRefunded}
+		}
+		offer, _ := pc.PaidOffer()
+		left := pc.refundLeft()
+		refund.Amount = amount
+		if refund.Amount == 0 {
+			refund.Amount = left
+		}
+		switch {
+		case refund.Amount <= 0 || refund.Amount > left:
+			return fmt.Errorf("%w: %d %s left to refund", ErrRefundAmount, left, offer.Currency)
+		case refund.Amount < offer.Amount && !partial:
+			return fmt.Errorf("%w: %s payments can only be refunded in full", ErrUnsupported, pc.PaymentMethod)
+		}
+		refund.Currency = offer.Currency
+		pc.Refunds = append(pc.Refunds, refund)
+		return nil
+	})
+	if err != nil {
+		return nil, Refund{}, err
+	}
+
+	// Once asked, the provider may refund even if the caller goes away, so
+	// neither the call nor recording its outcome is cancelled
+	ctx = context.WithoutCancel(ctx)
+	providerID, refundErr := p.Refund(ctx, pc, refund.Amount)
+
+	pc, err = g.updateEvents(ctx, token, func(pc *PaymentContext) ([]Event, error) {
+		r := pc.findRefund(refund.ID)
+		if r == nil {
+			return nil, fmt.Errorf("refund %s not found", refund.ID)
+		}
+		r.UpdatedAt = g.clock.Now().UTC()
+		r.ProviderRefundID = providerID
+		if refundErr != nil {
+			r.Status = RefundFailed
+			r.Error = refundErr.Error()
+			return nil, nil
+		}
+		r.Status = RefundSucceeded
+
+		status := StatusPartiallyRefunded
+		if offer, _ := pc.PaidOffer(); pc.RefundedAmount() >= offer.Amount {
+			status = StatusRefunded
+		}
+		why := fmt.Sprintf("refund %s of %d %s", r.ID, r.Amount, r.Currency)
+		if reason != "" {
+			why += ": " + reason
+		}
+		if err := pc.Transition(status, why, r.UpdatedAt); err != nil {
+			return nil, err
+		}
+
+		event := g.newEvent(EventPaymentRefunded, pc)
+		refunded := *r
+		event.Refund = &refunded
+		return []Event{event}, nil
+	})
+	if err != nil {
+		g.logger.Error("failed to record refund",
+			"error", err,
+			"payment_context", token,
+			"refund_id", refund.ID,
+			"provider_refund_id", providerID,
+			"refund_error", refundErr,
+		)
+		return nil, Refund{}, err
+	}
+	refund = *pc.findRefund(refund.ID)
+
+	if refundErr != nil {
+		g.logger.Warn("refund failed",
+			"error", refundErr,
+			"payment_context", token,
+			"refund_id", refund.ID,
+			"provider_refund_id", refund.ProviderRefundID,
+			"payment_method", pc.PaymentMethod,
+		)
+		return pc, refund, fmt.Errorf("%w: %w", ErrRefundFailed, refundErr)
+	}
+
+	g.logger.Info("payment refunded",
+		"payment_context", token,
+		"refund_id", refund.ID,
+		"provider_refund_id", refund.ProviderRefundID,
+		"amount", refund.Amount,
+		"currency", refund.Currency,
+		"status", pc.Status,
+	)
+	return pc, refund, nil
+}
+
+// merchantContext returns a payment context of the merchant making the
+// request with its API key, or the admin key without merchants. Contexts of
+// other merchants are reported as not found.
+func (g *Gateway) merchantContext(r *http.Request) (*PaymentContext, error) {
+	merchant, err := g.authenticateKey(r)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := g.current(r.Context(), r.PathValue("token"))
+	if err != nil {
+		return nil, err
+	}
+	if pc.MerchantID != merchant.ID {
+		return nil, ErrContextNotFound
+	}
+	return pc, nil
+}
+
+// writeRefundError answers a refund request that failed
+func (g *Gateway) writeRefundError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidAPIKey), errors.Is(err, ErrMerchantNotFound):
+		writeAuthError(w)
+	case errors.Is(err, ErrRefundAmount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrRefundFailed):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		writeContextError(w, err)
+	}
+}
+
+// handleRefund refunds a payment of the merchant
+func (g *Gateway) handleRefund(w http.ResponseWriter, r *http.Request) {
+	// An empty body refunds everything left
+	var req RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Amount < 0 {
+		http.Error(w, ErrRefundAmount.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pc, err := g.merchantContext(r)
+	if err != nil {
+		g.writeRefundError(w, err)
+		return
+	}
+	_, refund, err := g.Refund(r.Context(), pc.Token, req.Amount, req.Reason)
+	if err != nil {
+		g.writeRefundError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(refund)
+}
+
+// handleListRefunds lists the refunds of a payment of the merchant
+func (g *Gateway) handleListRefunds(w http.ResponseWriter, r *http.Request) {
+	pc, err := g.merchantContext(r)
+	if err != nil {
+		g.writeRefundError(w, err)
+		return
+	}
+	refunds := pc.Refunds
+	if refunds == nil {
+		refunds = []Refund{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refunds)
+}
@@ -0,0 +1,243 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// maxStatusWait bounds how long a long-poll status request is held
+const maxStatusWait = time.Minute
+
+// statusKeepAlive is how often an idle status stream sends a comment so
+// proxies keep it open
+const statusKeepAlive = 15 * time.Second
+
+// subscribers wakes up the requests following payment contexts
+type subscribers struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{} // payment context -> waiters
+}
+
+// subscribe returns a channel receiving a value whenever the payment context
+// changes, and a function to stop
+func (s *subscribers) subscribe(token string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[string]map[chan struct{}]struct{})
+	}
+	if s.subs[token] == nil {
+		s.subs[token] = make(map[chan struct{}]struct{})
+	}
+	s.subs[token][ch] = struct{}{}
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subs[token], ch)
+		if len(s.subs[token]) == 0 {
+			delete(s.subs, token)
+		}
+	}
+}
+
+// notify wakes up everyone following the payment context. Changes made
+// while a waiter is busy are coalesced, it rereads the context anyway.
+func (s *subscribers) notify(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs[token] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// final reports whether a payment context can't change anymore
+func final(status ContextStatus) bool {
+	return len(transitions[status]) == 0
+}
+
+// current returns a payment context, expiring it first if it is due.
+// Unlike get, an expired context is returned rather than an error.
+func (g *Gateway) current(ctx context.Context, token string) (*PaymentContext, error) {
+	pc, err := g.get(ctx, token)
+	if errors.Is(err, ErrContextExpired) {
+		return g.store.Get(ctx, token)
+	}
+	return pc, err
+}
+
+// paymentStatus describes pc as it was after its nth transition
+func paymentStatus(pc *PaymentContext, n int) l402.PaymentStatus {
+	s := l402.PaymentStatus{
+		PaymentContextToken: pc.Token,
+		Status:              string(pc.Status),
+		OfferID:             pc.OfferID,
+		PaymentMethod:       pc.PaymentMethod,
+		UpdatedAt:           pc.UpdatedAt.Format(time.RFC3339),
+	}
+	if n > 0 && n <= len(pc.History) {
+		t := pc.History[n-1]
+		s.Status = string(t.To)
+		s.Reason = t.Reason
+		s.UpdatedAt = t.At.Format(time.RFC3339)
+	}
+	if !pc.ExpiresAt.IsZero() {
+		s.ExpiresAt = pc.ExpiresAt.Format(time.RFC3339)
+	}
+	if pc.PaidAt != nil {
+		s.PaidAt = pc.PaidAt.Format(time.RFC3339)
+	}
+	s.LateFunds = pc.LateFunds
+	if offer, ok := pc.PaidOffer(); ok {
+		s.Amount = offer.Amount
+		s.Currency = offer.Currency
+		s.RefundedAmount = pc.RefundedAmount()
+	}
+	for _, r := range pc.Refunds {
+		s.Refunds = append(s.Refunds, l402.Refund{
+			ID:        r.ID,
+			Amount:    r.Amount,
+			Currency:  r.Currency,
+			Status:    string(r.Status),
+			CreatedAt: r.CreatedAt.Format(time.RFC3339),
+			UpdatedAt: r.UpdatedAt.Format(time.RFC3339),
+		})
+	}
+	return s
+}
+
+// handlePaymentStatus returns the status of a payment context. With
+// ?wait=30s it is held until the status is no longer ?status=, the status
+// the caller already knows, or the wait is over.
+func (g *Gateway) handlePaymentStatus(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxStatusWait)
+	}
+
+	// Subscribe before reading so no change is missed in between
+	changed, stop := g.subscribers.subscribe(token)
+	defer stop()
+
+	pc, err := g.current(r.Context(), token)
+	if err != nil {
+		writeContextError(w, err)
+		return
+	}
+	pc = g.syncStatus(r.Context(), pc)
+
+	known := ContextStatus(r.URL.Query().Get("status"))
+	if known == "" {
+		known = pc.Status
+	}
+	if wait > 0 && pc.Status == known && !final(pc.Status) {
+		// The wait may outlast the server write timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+	loop:
+		for pc.Status == known {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-timer.C:
+				break loop
+			case <-changed:
+			}
+			if pc, err = g.current(r.Context(), token); err != nil {
+				writeContextError(w, err)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(paymentStatus(pc, len(pc.History)))
+}
+
+// handlePaymentEvents streams the transitions of a payment context as
+// Server-Sent Events, starting with its current status. Each event ID is the
+// number of the transition, so a reconnecting client sending Last-Event-ID
+// gets the ones it missed. The stream ends once the context can't change.
+func (g *Gateway) handlePaymentEvents(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+
+	changed, stop := g.subscribers.subscribe(token)
+	defer stop()
+
+	pc, err := g.current(r.Context(), token)
+	if err != nil {
+		writeContextError(w, err)
+		return
+	}
+
+	sent := len(pc.History) - 1
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		sent = min(n, len(pc.History))
+	}
+
+	// Streams are long lived, unlike the requests the write timeout is for
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(statusKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		for ; sent < len(pc.History); sent++ {
+			data, err := json.Marshal(paymentStatus(pc, sent+1))
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", sent+1, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if final(pc.Status) {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			continue
+		case <-changed:
+		}
+		if pc, err = g.current(r.Context(), token); err != nil {
+			return
+		}
+	}
+}
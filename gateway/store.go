@@ -0,0 +1,435 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/l402-protocol/go-example/l402"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultMerchant owns the payment contexts of charges made without a
+// merchant.
+const DefaultMerchant = "default"
+
+var (
+	ErrContextNotFound = errors.New("payment context not found")
+	ErrContextExists   = errors.New("payment context already exists")
+)
+
+// PaymentContext is everything the gateway knows about a charge
+type PaymentContext struct {
+	Token      string        `json:"token"`
+	MerchantID string        `json:"merchant_id"`
+	Offers     []l402.Offer  `json:"offers"`
+	Status     ContextStatus `json:"status"`
+
+	// Version of the merchant catalog the offers come from, if any
+	CatalogVersion int `json:"catalog_version,omitempty"`
+
+	// Offer and method the client asked payment details for
+	OfferID       string              `json:"offer_id,omitempty"`
+	PaymentMethod l402.PaymentMethods `json:"payment_method,omitempty"`
+
+	// Method specific details
+	Address  string `json:"address,omitempty"`
+	ChargeID string `json:"charge_id,omitempty"`
+
+	// Funds the address received after the context expired. They are
+	// refunded by hand.
+	LateFunds int64 `json:"late_funds,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	PaidAt    *time.Time `json:"paid_at,omitempty"`
+
+	// Every status change, oldest first
+	History []Transition `json:"history"`
+
+	// Refunds of the payment, oldest first
+	Refunds []Refund `json:"refunds,omitempty"`
+}
+
+// newPaymentContext returns a payment context for a new charge
+func newPaymentContext(merchantID string, offers []l402.Offer, now time.Time, ttl time.Duration) *PaymentContext {
+	now = now.UTC()
+	return &PaymentContext{
+		Token:      uuid.New().String(),
+		MerchantID: merchantID,
+		Offers:     offers,
+		Status:     StatusCreated,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+		History: []Transition{
+			{To: StatusCreated, Reason: "charge created", At: now},
+		},
+	}
+}
+
+// Offer returns the offer with the given ID
+func (pc *PaymentContext) Offer(offerID string) (l402.Offer, bool) {
+	for _, o := range pc.Offers {
+		if o.ID == offerID {
+			return o, true
+		}
+	}
+	return l402.Offer{}, false
+}
+
+// Store keeps payment contexts. Implementations must be safe for concurrent
+// use and return copies, callers change contexts through Update only.
+type Store interface {
+	// Create stores a new payment context
+	Create(ctx context.Context, pc *PaymentContext) error
+
+	// Get returns the payment context with the given token
+	Get(ctx context.Context, token string) (*PaymentContext, error)
+
+	// Update applies fn to the payment context atomically. Nothing is
+	// changed if fn returns an error. fn sets UpdatedAt.
+	Update(ctx context.Context, token string, fn func(pc *PaymentContext) error) (*PaymentContext, error)
+
+	// List returns every payment context, oldest first
+	List(ctx context.Context) ([]*PaymentContext, error)
+}
+
+// EventStore is a Store keeping the outbox as well, so a change of a payment
+// context and the events it causes are written in one transaction
+type EventStore interface {
+	Store
+
+	// Outbox returns the outbox kept with the payment contexts
+	Outbox() Outbox
+
+	// UpdateAndEnqueue is Update, also enqueuing the deliveries fn returns
+	UpdateAndEnqueue(ctx context.Context, token string, fn func(pc *PaymentContext) ([]*Delivery, error)) (*PaymentContext, error)
+}
+
+// MemoryStore keeps payment contexts and their outbox in memory
+type MemoryStore struct {
+	mu       sync.Mutex
+	contexts map[string]*PaymentContext
+	outbox   *MemoryOutbox
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		contexts: make(map[string]*PaymentContext),
+		outbox:   NewMemoryOutbox(),
+	}
+}
+
+func (s *MemoryStore) Create(ctx context.Context, pc *PaymentContext) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.contexts[pc.Token]; ok {
+		return ErrContextExists
+	}
+
+	s.contexts[pc.Token] = stamped(pc)
+	return nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, token string) (*PaymentContext, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pc, ok := s.contexts[token]
+	if !ok {
+		return nil, ErrContextNotFound
+	}
+	return clonePaymentContext(pc), nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, token string, fn func(pc *PaymentContext) error) (*PaymentContext, error) {
+	return s.UpdateAndEnqueue(ctx, token, func(pc *PaymentContext) ([]*Delivery, error) {
+		return nil, fn(pc)
+	})
+}
+
+func (s *MemoryStore) Outbox() Outbox {
+	return s.outbox
+}
+
+func (s *MemoryStore) UpdateAndEnqueue(ctx context.Context, token string, fn func(pc *PaymentContext) ([]*Delivery, error)) (*PaymentContext, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.contexts[token]
+	if !ok {
+		return nil, ErrContextNotFound
+	}
+
+	pc := clonePaymentContext(old)
+	deliveries, err := fn(pc)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.outbox.enqueue(deliveries...); err != nil {
+		return nil, err
+	}
+	pc.Token = old.Token
+	s.contexts[token] = pc
+	return clonePaymentContext(pc), nil
+}
+
+func (s *MemoryStore) List(ctx context.Context) ([]*PaymentContext, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*PaymentContext, 0, len(s.contexts))
+	for _, pc := range s.contexts {
+		list = append(list, clonePaymentContext(pc))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+// Buckets of a FileStore, holding payment contexts by token and deliveries
+// by event ID
+var (
+	contextsBucket   = []byte("payment_contexts")
+	deliveriesBucket = []byte("deliveries")
+)
+
+// FileStore keeps payment contexts and their outbox in a bbolt database
+// file, so they survive gateway restarts. Every change is a transaction of
+// its own that only writes the payment context it changes.
+type FileStore struct {
+	db     *bolt.DB
+	outbox *FileOutbox
+}
+
+// NewFileStore opens the store at path, creating it if missing. A store
+// saved as JSON by older gateways is imported, and kept at path.json.
+func NewFileStore(path string) (*FileStore, error) {
+	legacy, err := importJSONStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(deliveriesBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(contextsBucket)
+		if err != nil {
+			return err
+		}
+		for token, pc := range legacy {
+			if err := putContext(b, token, pc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	return &FileStore{db: db, outbox: &FileOutbox{db: db}}, nil
+}
+
+// importJSONStore moves a JSON store at path out of the way and returns its
+// payment contexts
+func importJSONStore(path string) (map[string]*PaymentContext, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil, nil
+	}
+
+	var contexts map[string]*PaymentContext
+	if err := json.Unmarshal(data, &contexts); err != nil {
+		return nil, fmt.Errorf("failed to parse store: %w", err)
+	}
+	if err := os.Rename(path, path+".json"); err != nil {
+		return nil, fmt.Errorf("failed to import store: %w", err)
+	}
+	return contexts, nil
+}
+
+// Close closes the database file
+func (s *FileStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *FileStore) Create(ctx context.Context, pc *PaymentContext) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(contextsBucket)
+		if b.Get([]byte(pc.Token)) != nil {
+			return ErrContextExists
+		}
+		return putContext(b, pc.Token, stamped(pc))
+	})
+}
+
+func (s *FileStore) Get(ctx context.Context, token string) (*PaymentContext, error) {
+	var pc *PaymentContext
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		pc, err = getContext(tx.Bucket(contextsBucket), token)
+		return err
+	})
+	return pc, err
+}
+
+func (s *FileStore) Update(ctx context.Context, token string, fn func(pc *PaymentContext) error) (*PaymentContext, error) {
+	return s.UpdateAndEnqueue(ctx, token, func(pc *PaymentContext) ([]*Delivery, error) {
+		return nil, fn(pc)
+	})
+}
+
+func (s *FileStore) Outbox() Outbox {
+	return s.outbox
+}
+
+func (s *FileStore) UpdateAndEnqueue(ctx context.Context, token string, fn func(pc *PaymentContext) ([]*Delivery, error)) (*PaymentContext, error) {
+	var pc *PaymentContext
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(contextsBucket)
+		var err error
+		if pc, err = getContext(b, token); err != nil {
+			return err
+		}
+		deliveries, err := fn(pc)
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			if err := addDelivery(tx.Bucket(deliveriesBucket), d); err != nil {
+				return err
+			}
+		}
+		pc.Token = token
+		return putContext(b, token, pc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clonePaymentContext(pc), nil
+}
+
+func (s *FileStore) List(ctx context.Context) ([]*PaymentContext, error) {
+	var list []*PaymentContext
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(contextsBucket).ForEach(func(k, v []byte) error {
+			var pc PaymentContext
+			if err := json.Unmarshal(v, &pc); err != nil {
+				return fmt.Errorf("failed to parse payment context %s: %w", k, err)
+			}
+			list = append(list, &pc)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+func getContext(b *bolt.Bucket, token string) (*PaymentContext, error) {
+	data := b.Get([]byte(token))
+	if data == nil {
+		return nil, ErrContextNotFound
+	}
+	var pc PaymentContext
+	if err := json.Unmarshal(data, &pc); err != nil {
+		return nil, fmt.Errorf("failed to parse payment context %s: %w", token, err)
+	}
+	return &pc, nil
+}
+
+func putContext(b *bolt.Bucket, token string, pc *PaymentContext) error {
+	data, err := json.Marshal(pc)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(token), data)
+}
+
+// stamped returns a copy of a new payment context with its creation time set
+func stamped(pc *PaymentContext) *PaymentContext {
+	stored := clonePaymentContext(pc)
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now().UTC()
+	}
+	if stored.UpdatedAt.IsZero() {
+		stored.UpdatedAt = stored.CreatedAt
+	}
+	return stored
+}
+
+// saveJSON atomically replaces the file at path with v as JSON. The file is
+// only readable by its owner.
+func saveJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	return nil
+}
+
+// clonePaymentContext returns a deep copy of pc
+func clonePaymentContext(pc *PaymentContext) *PaymentContext {
+	c := *pc
+	c.Offers = make([]l402.Offer, len(pc.Offers))
+	for i, o := range pc.Offers {
+		o.PaymentMethods = append([]l402.PaymentMethods(nil), o.PaymentMethods...)
+		c.Offers[i] = o
+	}
+	if pc.PaidAt != nil {
+		t := *pc.PaidAt
+		c.PaidAt = &t
+	}
+	c.History = append([]Transition(nil), pc.History...)
+	c.Refunds = append([]Refund(nil), pc.Refunds...)
+	return &c
+}
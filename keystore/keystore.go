@@ -0,0 +1,431 @@
+// Package keystore keeps wallet secrets (seeds, macaroons, NWC secrets, API
+// keys...) encrypted at rest.
+//
+// Secrets are encrypted with AES-256-GCM under a random data key. The data
+// key itself is stored wrapped under a key derived from the passphrase with
+// scrypt, so rotating the passphrase or the data key never leaves a secret in
+// plaintext on disk.
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// FormatVersion is the version of the keystore file format written by this
+// package. Files with another version are refused.
+const FormatVersion = 1
+
+// Default scrypt parameters, as recommended for interactive logins
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	keyLen       = 32
+	saltLen      = 16
+	kdfScrypt    = "scrypt"
+	cipherAESGCM = "aes-256-gcm"
+)
+
+var (
+	ErrExists             = errors.New("keystore already exists")
+	ErrLocked             = errors.New("keystore is locked")
+	ErrWrongPassphrase    = errors.New("wrong passphrase")
+	ErrNotFound           = errors.New("secret not found")
+	ErrUnsupportedVersion = errors.New("unsupported keystore version")
+)
+
+type kdfParams struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+type sealed struct {
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type entry struct {
+	sealed
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// file is the on-disk format
+type file struct {
+	Version   int              `json:"version"`
+	Cipher    string           `json:"cipher"`
+	KDF       kdfParams        `json:"kdf"`
+	DataKey   sealed           `json:"data_key"`
+	CreatedAt time.Time        `json:"created_at"`
+	RotatedAt *time.Time       `json:"rotated_at,omitempty"`
+	Secrets   map[string]entry `json:"secrets"`
+}
+
+// Keystore is an encrypted secret store backed by a file. It starts locked;
+// names can be listed while locked but secrets can only be read or written
+// after Unlock.
+type Keystore struct {
+	path string
+
+	mu      sync.Mutex
+	file    file
+	dataKey []byte
+}
+
+// Create creates a new keystore at path protected by passphrase. The returned
+// keystore is unlocked.
+func Create(path string, passphrase string) (*Keystore, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, ErrExists
+	}
+
+	ks := &Keystore{
+		path: path,
+		file: file{
+			Version:   FormatVersion,
+			Cipher:    cipherAESGCM,
+			CreatedAt: time.Now().UTC(),
+			Secrets:   make(map[string]entry),
+		},
+	}
+
+	dataKey := make([]byte, keyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if err := ks.wrap(dataKey, passphrase); err != nil {
+		return nil, err
+	}
+	if err := ks.save(); err != nil {
+		return nil, err
+	}
+
+	ks.dataKey = dataKey
+	return ks, nil
+}
+
+// Open loads the keystore at path. The keystore is locked.
+func Open(path string) (*Keystore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse keystore: %w", err)
+	}
+	if f.Version != FormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, f.Version)
+	}
+	if f.Cipher != cipherAESGCM || f.KDF.Name != kdfScrypt {
+		return nil, fmt.Errorf("unsupported keystore cipher %q or kdf %q", f.Cipher, f.KDF.Name)
+	}
+	if f.Secrets == nil {
+		f.Secrets = make(map[string]entry)
+	}
+
+	return &Keystore{path: path, file: f}, nil
+}
+
+// OpenUnlocked opens the keystore at path and unlocks it
+func OpenUnlocked(path string, passphrase string) (*Keystore, error) {
+	ks, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Unlock decrypts the data key with passphrase
+func (ks *Keystore) Unlock(passphrase string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	dataKey, err := ks.unwrap(passphrase)
+	if err != nil {
+		return err
+	}
+	ks.dataKey = dataKey
+	return nil
+}
+
+// Lock forgets the data key. Secrets can't be read until the next Unlock.
+func (ks *Keystore) Lock() {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	clear(ks.dataKey)
+	ks.dataKey = nil
+}
+
+// Locked reports whether the keystore is locked
+func (ks *Keystore) Locked() bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.dataKey == nil
+}
+
+// Names returns the names of the stored secrets, sorted
+func (ks *Keystore) Names() []string {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	names := make([]string, 0, len(ks.file.Secrets))
+	for name := range ks.file.Secrets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Get returns the secret stored under name
+func (ks *Keystore) Get(name string) ([]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.dataKey == nil {
+		return nil, ErrLocked
+	}
+	e, ok := ks.file.Secrets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	secret, err := open(ks.dataKey, e.sealed, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret %s: %w", name, err)
+	}
+	return secret, nil
+}
+
+// Put stores secret under name, replacing any previous value
+func (ks *Keystore) Put(name string, secret []byte) error {
+	if name == "" {
+		return errors.New("secret name is required")
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.dataKey == nil {
+		return ErrLocked
+	}
+
+	s, err := seal(ks.dataKey, secret, []byte(name))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	e := entry{sealed: s, CreatedAt: now, UpdatedAt: now}
+	if old, ok := ks.file.Secrets[name]; ok {
+		e.CreatedAt = old.CreatedAt
+	}
+	ks.file.Secrets[name] = e
+	return ks.save()
+}
+
+// Delete removes the secret stored under name
+func (ks *Keystore) Delete(name string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.dataKey == nil {
+		return ErrLocked
+	}
+	if _, ok := ks.file.Secrets[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	delete(ks.file.Secrets, name)
+	return ks.save()
+}
+
+// Rotate re-encrypts every secret under a fresh data key wrapped with
+// newPassphrase. oldPassphrase must be the current passphrase, even if the
+// keystore is unlocked. Pass the same passphrase twice to only rotate the
+// data key.
+func (ks *Keystore) Rotate(oldPassphrase, newPassphrase string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	oldKey, err := ks.unwrap(oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	newKey := make([]byte, keyLen)
+	if _, err := rand.Read(newKey); err != nil {
+		return err
+	}
+
+	secrets := make(map[string]entry, len(ks.file.Secrets))
+	for name, e := range ks.file.Secrets {
+		secret, err := open(oldKey, e.sealed, []byte(name))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt secret %s: %w", name, err)
+		}
+		s, err := seal(newKey, secret, []byte(name))
+		clear(secret)
+		if err != nil {
+			return err
+		}
+		e.sealed = s
+		secrets[name] = e
+	}
+
+	// Only touch the keystore once everything was re-encrypted
+	prev := ks.file
+	ks.file.Secrets = secrets
+	if err := ks.wrap(newKey, newPassphrase); err != nil {
+		ks.file = prev
+		return err
+	}
+	now := time.Now().UTC()
+	ks.file.RotatedAt = &now
+	if err := ks.save(); err != nil {
+		ks.file = prev
+		return err
+	}
+
+	clear(oldKey)
+	ks.dataKey = newKey
+	return nil
+}
+
+// wrap derives a key from passphrase with a fresh salt and seals dataKey
+// with it
+func (ks *Keystore) wrap(dataKey []byte, passphrase string) error {
+	params := kdfParams{
+		Name: kdfScrypt,
+		Salt: make([]byte, saltLen),
+		N:    scryptN,
+		R:    scryptR,
+		P:    scryptP,
+	}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return err
+	}
+
+	kek, err := deriveKey(passphrase, params)
+	if err != nil {
+		return err
+	}
+	s, err := seal(kek, dataKey, dataKeyAAD(FormatVersion))
+	if err != nil {
+		return err
+	}
+
+	ks.file.KDF = params
+	ks.file.DataKey = s
+	return nil
+}
+
+// unwrap returns the data key sealed under passphrase
+func (ks *Keystore) unwrap(passphrase string) ([]byte, error) {
+	kek, err := deriveKey(passphrase, ks.file.KDF)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := open(kek, ks.file.DataKey, dataKeyAAD(ks.file.Version))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return dataKey, nil
+}
+
+func (ks *Keystore) save() error {
+	data, err := json.MarshalIndent(ks.file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(ks.path), filepath.Base(ks.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save keystore: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save keystore: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save keystore: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save keystore: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save keystore: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), ks.path); err != nil {
+		return fmt.Errorf("failed to save keystore: %w", err)
+	}
+	return nil
+}
+
+func deriveKey(passphrase string, params kdfParams) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), params.Salt, params.N, params.R, params.P, keyLen)
+}
+
+// dataKeyAAD binds the wrapped data key to the file format version
+func dataKeyAAD(version int) []byte {
+	return fmt.Appendf(nil, "l402-keystore-v%d", version)
+}
+
+// seal encrypts plaintext with key. aad is authenticated but not encrypted,
+// it ties a secret to its name so ciphertexts can't be swapped.
+func seal(key, plaintext, aad []byte) (sealed, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return sealed{}, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return sealed{}, err
+	}
+	return sealed{
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, aad),
+	}, nil
+}
+
+func open(key []byte, s sealed, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	return gcm.Open(nil, s.Nonce, s.Ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
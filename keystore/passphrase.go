@@ -0,0 +1,37 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// PassphraseEnv is the environment variable checked by ReadPassphrase before
+// prompting, for scripts and services.
+const PassphraseEnv = "L402_KEYSTORE_PASSPHRASE"
+
+// ReadPassphrase returns the passphrase from env, or asks for it on the
+// terminal without echoing it.
+func ReadPassphrase(env string, prompt string) (string, error) {
+	if p, ok := os.LookupEnv(env); ok {
+		return p, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("no terminal to ask for the passphrase, set %s", env)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(p) == 0 {
+		return "", errors.New("empty passphrase")
+	}
+	return string(p), nil
+}
@@ -1,9 +1,12 @@
 package l402
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Wallet represents the minimum interface needed to handle L402 payments
@@ -12,20 +15,160 @@ type Wallet interface {
 	Pay(response *L402Response) error
 }
 
+type SettlementStatus string
+
+const (
+	// SettlementUnknown is used when the wallet can't tell, e.g. v1 wallets.
+	SettlementUnknown SettlementStatus = "unknown"
+	// SettlementPending means the payment was sent but is not final yet
+	// (unconfirmed transaction, checkout not completed...).
+	SettlementPending SettlementStatus = "pending"
+	// SettlementSettled means the payment is final.
+	SettlementSettled SettlementStatus = "settled"
+	// SettlementFailed means the payment did not go through.
+	SettlementFailed SettlementStatus = "failed"
+)
+
+// PaymentResult is the proof of a payment made by a wallet.
+type PaymentResult struct {
+	// Offer and payment context that were paid.
+	OfferID             string `json:"offer_id"`
+	PaymentContextToken string `json:"payment_context_token"`
+
+	// Method used to pay.
+	Method PaymentMethods `json:"method"`
+
+	// Amount actually paid, in the smallest unit of Currency.
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+
+	// Method specific proofs, only one is usually set.
+	// Preimage of a lightning payment (hex).
+	Preimage string `json:"preimage,omitempty"`
+	// TxID of an on-chain payment.
+	TxID string `json:"txid,omitempty"`
+	// ReceiptID of a card or checkout based payment.
+	ReceiptID string `json:"receipt_id,omitempty"`
+
+	Status SettlementStatus `json:"status"`
+
+	// Where the gateway reports the payment, including its refunds
+	StatusURL string `json:"status_url,omitempty"`
+}
+
+// ProofWallet is the v2 wallet contract. Unlike Wallet it returns what was
+// paid so the client can present it and keep track of it.
+type ProofWallet interface {
+	// PayWithProof processes the payment required by the L402
+	PayWithProof(ctx context.Context, response *L402Response) (*PaymentResult, error)
+}
+
+// AdaptWallet turns a Wallet into a ProofWallet. Wallets that already
+// implement ProofWallet are returned as is; for the rest the result carries
+// the payment context, an unknown status and, when the response has only
+// one, the offer.
+func AdaptWallet(w Wallet) ProofWallet {
+	return AdaptWalletForOffer(w, "")
+}
+
+// AdaptWalletForOffer is AdaptWallet for a wallet known to pay offerID
+func AdaptWalletForOffer(w Wallet, offerID string) ProofWallet {
+	if pw, ok := w.(ProofWallet); ok {
+		return pw
+	}
+	return walletAdapter{Wallet: w, offerID: offerID}
+}
+
+type walletAdapter struct {
+	Wallet
+	offerID string
+}
+
+func (a walletAdapter) PayWithProof(ctx context.Context, response *L402Response) (*PaymentResult, error) {
+	if err := a.Pay(response); err != nil {
+		return nil, err
+	}
+	result := &PaymentResult{
+		PaymentContextToken: response.PaymentContextToken,
+		Status:              SettlementUnknown,
+	}
+
+	// v1 wallets don't say what they paid, the offer tells most of it
+	if offer, ok := a.paidOffer(response); ok {
+		result.OfferID = offer.ID
+		result.Amount = offer.Amount
+		result.Currency = offer.Currency
+		if len(offer.PaymentMethods) == 1 {
+			result.Method = offer.PaymentMethods[0]
+		}
+	}
+	return result, nil
+}
+
+// paidOffer returns the offer the wallet paid: the one it is known to pay,
+// or the only one in the response
+func (a walletAdapter) paidOffer(response *L402Response) (Offer, bool) {
+	for _, o := range response.Offers {
+		if o.ID == a.offerID || (a.offerID == "" && len(response.Offers) == 1) {
+			return o, true
+		}
+	}
+	return Offer{}, false
+}
+
 // HTTP402Client is an HTTP client that automatically handles L402 payment required responses
 type HTTP402Client struct {
 	httpClient *http.Client
-	wallet     Wallet
+	wallet     ProofWallet
+
+	// How pending payments are waited for
+	wait        SettlementWait
+	waitTimeout time.Duration
+
+	mu       sync.Mutex
+	payments []PaymentResult
 }
 
 // NewHTTP402Client creates a new L402 client with the given wallet
 func NewHTTP402Client(wallet Wallet) *HTTP402Client {
+	return NewHTTP402ProofClient(AdaptWallet(wallet))
+}
+
+// NewHTTP402ProofClient creates a new L402 client with a v2 wallet
+func NewHTTP402ProofClient(wallet ProofWallet) *HTTP402Client {
 	return &HTTP402Client{
-		httpClient: http.DefaultClient,
-		wallet:     wallet,
+		httpClient:  http.DefaultClient,
+		wallet:      wallet,
+		wait:        WaitPoll,
+		waitTimeout: DefaultSettlementTimeout,
 	}
 }
 
+// SetSettlementWait sets how the client waits for payments the wallet left
+// pending, and for how long
+func (c *HTTP402Client) SetSettlementWait(wait SettlementWait, timeout time.Duration) {
+	c.wait = wait
+	if timeout > 0 {
+		c.waitTimeout = timeout
+	}
+}
+
+// Payments returns every payment made by the client so far
+func (c *HTTP402Client) Payments() []PaymentResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]PaymentResult(nil), c.payments...)
+}
+
+// PaymentStatus asks the gateway how a payment made by the client stands,
+// e.g. whether it was refunded since
+func (c *HTTP402Client) PaymentStatus(ctx context.Context, payment PaymentResult) (*PaymentStatus, error) {
+	if payment.StatusURL == "" {
+		return nil, fmt.Errorf("the gateway reports no status for payment context %s", payment.PaymentContextToken)
+	}
+	return GetPaymentStatus(ctx, c.httpClient, payment.StatusURL, "", 0)
+}
+
 // Do performs an HTTP request and automatically handles 402 Payment Required responses
 func (c *HTTP402Client) Do(req *http.Request) (*http.Response, error) {
 	// Execute the request
@@ -52,19 +195,35 @@ func (c *HTTP402Client) Do(req *http.Request) (*http.Response, error) {
 	resp.Body.Close()
 
 	// Process payment using wallet
-	err = c.wallet.Pay(response)
+	result, err := c.wallet.PayWithProof(req.Context(), response)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process L402 payment: %w", err)
 	}
 
-	// prompt user to pay
-	var yn string
-	fmt.Printf("Simulate the payment (visiting the URL) before continuing? (y/n): ")
-	fmt.Scanln(&yn)
-	if yn == "n" {
-		return nil, fmt.Errorf("the client did not pay")
+	// Wait for payments that are not final yet, e.g. a checkout the user
+	// completes in a browser or an unconfirmed transaction
+	var waitErr error
+	if result.Status != SettlementSettled && result.Status != SettlementFailed {
+		waitErr = c.waitForSettlement(req.Context(), response, result)
+	}
+
+	if result.StatusURL == "" {
+		result.StatusURL = response.PaymentStatusURL
+	}
+	c.mu.Lock()
+	c.payments = append(c.payments, *result)
+	c.mu.Unlock()
+
+	if waitErr != nil {
+		return nil, fmt.Errorf("payment for offer %s: %w", result.OfferID, waitErr)
+	}
+	if result.Status == SettlementFailed {
+		return nil, fmt.Errorf("payment for offer %s failed", result.OfferID)
 	}
 
-	// After paying we should be able to access the resource
-	return c.httpClient.Do(req)
+	// After paying we should be able to access the resource. Tell the
+	// server which payment context we paid for.
+	retry := req.Clone(req.Context())
+	retry.Header.Set("X-Payment-Context", result.PaymentContextToken)
+	return c.httpClient.Do(retry)
 }
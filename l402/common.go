@@ -4,6 +4,18 @@ const (
 	L402_VERSION = "0.2.2"
 )
 
+// PaymentStatusHeader is set by gateways with a scriptable checkout so that
+// headless wallets can tell how a checkout went. It is not part of the spec.
+const (
+	PaymentStatusHeader   = "X-Payment-Status"
+	PaymentStatusPaid     = "paid"
+	PaymentStatusFailed   = "failed"
+	PaymentStatusExpired  = "expired"
+	PaymentStatusRefunded = "refunded"
+
+	PaymentStatusPartiallyRefunded = "partially_refunded"
+)
+
 type PaymentMethods string
 
 // Payment methods can be added without breaking the spec.
@@ -76,6 +88,10 @@ type L402Response struct {
 
 	// Terms and conditions
 	TermsURL string `json:"terms_url"`
+
+	// URL where the client can follow the payment, see PaymentStatus. Not
+	// part of the spec.
+	PaymentStatusURL string `json:"payment_status_url,omitempty"`
 }
 
 type PaymentRequestRequest struct {
@@ -113,3 +129,42 @@ type PaymentRequestResponse struct {
 	// Payment Request details
 	PaymentRequest PayReq `json:"payment_request"`
 }
+
+// PaymentStatus is the state of a payment context as reported by a gateway
+// at PaymentStatusURL. It is not part of the spec.
+type PaymentStatus struct {
+	PaymentContextToken string `json:"payment_context_token"`
+
+	// Status of the payment context, e.g. PaymentStatusPaid, and why it got
+	// there
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+
+	// Offer and method the client asked payment details for
+	OfferID       string         `json:"offer_id,omitempty"`
+	PaymentMethod PaymentMethods `json:"payment_method,omitempty"`
+
+	// Amount paid and how much of it was refunded, once paid
+	Amount         int      `json:"amount,omitempty"`
+	Currency       string   `json:"currency,omitempty"`
+	RefundedAmount int      `json:"refunded_amount,omitempty"`
+	Refunds        []Refund `json:"refunds,omitempty"`
+
+	// Funds received after the payment expired, to be refunded by hand
+	LateFunds int64 `json:"late_funds,omitempty"`
+
+	ExpiresAt string `json:"expires_at,omitempty"`
+	PaidAt    string `json:"paid_at,omitempty"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// Refund is a refund of a payment, see PaymentStatus. Its status is
+// pending, succeeded or failed.
+type Refund struct {
+	ID        string `json:"id"`
+	Amount    int    `json:"amount"`
+	Currency  string `json:"currency"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
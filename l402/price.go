@@ -0,0 +1,68 @@
+package l402
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currencyFormat describes how to show amounts given in the smallest unit
+// of a currency.
+type currencyFormat struct {
+	symbol   string
+	suffix   string
+	decimals int
+}
+
+var currencyFormats = map[string]currencyFormat{
+	"USD": {symbol: "$", decimals: 2},
+	"EUR": {symbol: "€", decimals: 2},
+	"GBP": {symbol: "£", decimals: 2},
+	"JPY": {symbol: "¥", decimals: 0},
+	"BTC": {suffix: " BTC", decimals: 8},
+	"SAT": {suffix: " sats", decimals: 0},
+}
+
+// FormatPrice formats an offer amount, given in the smallest unit of
+// currency, for humans: FormatPrice(1000, "USD") returns "$10.00". Unknown
+// currencies are shown as the raw amount followed by the currency code.
+func FormatPrice(amount int, currency string) string {
+	f, ok := currencyFormats[strings.ToUpper(currency)]
+	if !ok {
+		return fmt.Sprintf("%s %s", groupThousands(strconv.Itoa(amount)), currency)
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	digits := strconv.Itoa(amount)
+	if f.decimals == 0 {
+		return sign + f.symbol + groupThousands(digits) + f.suffix
+	}
+
+	if len(digits) <= f.decimals {
+		digits = strings.Repeat("0", f.decimals-len(digits)+1) + digits
+	}
+	whole, frac := digits[:len(digits)-f.decimals], digits[len(digits)-f.decimals:]
+	return sign + f.symbol + groupThousands(whole) + "." + frac + f.suffix
+}
+
+// groupThousands inserts commas in a string of digits
+func groupThousands(digits string) string {
+	start := 0
+	if strings.HasPrefix(digits, "-") {
+		start = 1
+	}
+	var b strings.Builder
+	b.WriteString(digits[:start])
+	for i, r := range digits[start:] {
+		if i > 0 && (len(digits)-start-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
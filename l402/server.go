@@ -1,7 +1,6 @@
 package l402
 
 import (
-	"errors"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,19 +18,12 @@ func NewL402Response(url string, offers []Offer) L402Response {
 	}
 }
 
-func NewPayReqResponse(
-	paymentRequest PaymentRequestRequest) (PaymentRequestResponse, error) {
-	if paymentRequest.PaymentMethod != string(FakePay) {
-		return PaymentRequestResponse{}, errors.New("payment method not supported")
-	}
-
-	payReq := PayReq{
-		CheckoutURL: "http://localhost:8080/simulate-payment",
-	}
-
+// NewPayReqResponse returns the answer to a payment request, open until
+// expiresAt. Which payment methods are supported is up to the caller.
+func NewPayReqResponse(payReq PayReq, expiresAt time.Time) PaymentRequestResponse {
 	return PaymentRequestResponse{
 		Version:        L402_VERSION,
-		ExpiresAt:      time.Now().Add(time.Minute * 10).Format(time.RFC3339),
+		ExpiresAt:      expiresAt.Format(time.RFC3339),
 		PaymentRequest: payReq,
-	}, nil
+	}
 }
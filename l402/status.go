@@ -0,0 +1,225 @@
+package l402
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SettlementWait is how HTTP402Client waits for a pending payment to settle
+type SettlementWait string
+
+const (
+	// WaitPoll long-polls the payment status URL of the gateway
+	WaitPoll SettlementWait = "poll"
+	// WaitStream follows the Server-Sent Events of the payment status URL
+	WaitStream SettlementWait = "sse"
+	// WaitPrompt asks on the terminal whether the payment was made. It is
+	// also used with gateways without a payment status URL.
+	WaitPrompt SettlementWait = "prompt"
+)
+
+// DefaultSettlementTimeout is how long HTTP402Client waits for a payment
+const DefaultSettlementTimeout = 10 * time.Minute
+
+// statusPollWait is how long each long-poll request asks the gateway to wait
+const statusPollWait = 30 * time.Second
+
+// ErrNotSettled is returned when a payment fails or expires while waiting
+var ErrNotSettled = errors.New("payment did not settle")
+
+// GetPaymentStatus returns the status of a payment. With a wait the gateway
+// holds the request until the status is no longer known, or the wait is over.
+func GetPaymentStatus(ctx context.Context, client *http.Client, statusURL, known string, wait time.Duration) (*PaymentStatus, error) {
+	u, err := url.Parse(statusURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment status URL: %w", err)
+	}
+	if wait > 0 {
+		q := u.Query()
+		q.Set("wait", wait.String())
+		if known != "" {
+			q.Set("status", known)
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment status: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("payment status request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var status PaymentStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode payment status: %w", err)
+	}
+	return &status, nil
+}
+
+// StreamPaymentStatus follows the Server-Sent Events of a payment status
+// URL, calling fn with every status until fn returns false or the stream
+// ends
+func StreamPaymentStatus(ctx context.Context, client *http.Client, statusURL string, fn func(*PaymentStatus) bool) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(statusURL, "/")+"/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to follow payment status: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("payment status stream failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data += value
+		case "":
+			// A blank line dispatches the event, a line starting with a
+			// colon is a comment
+			if line != "" {
+				continue
+			}
+			if data != "" && (event == "" || event == "status") {
+				var status PaymentStatus
+				if err := json.Unmarshal([]byte(data), &status); err != nil {
+					return fmt.Errorf("failed to decode payment status: %w", err)
+				}
+				if !fn(&status) {
+					return nil
+				}
+			}
+			event, data = "", ""
+		}
+	}
+	return scanner.Err()
+}
+
+// settlement tells whether a payment status is final, and whether it
+// settled
+func settlement(status *PaymentStatus) (bool, error) {
+	switch status.Status {
+	case PaymentStatusPaid, PaymentStatusPartiallyRefunded:
+		return true, nil
+	case PaymentStatusFailed, PaymentStatusExpired, PaymentStatusRefunded:
+		if status.Reason != "" {
+			return true, fmt.Errorf("%w: %s (%s)", ErrNotSettled, status.Status, status.Reason)
+		}
+		return true, fmt.Errorf("%w: %s", ErrNotSettled, status.Status)
+	}
+	return false, nil
+}
+
+// waitForSettlement waits until the gateway reports the payment as settled
+// or failed, and updates the status of result
+func (c *HTTP402Client) waitForSettlement(ctx context.Context, response *L402Response, result *PaymentResult) error {
+	if c.wait == WaitPrompt || response.PaymentStatusURL == "" {
+		var yn string
+		fmt.Printf("Simulate the payment (visiting the URL) before continuing? (y/n): ")
+		fmt.Scanln(&yn)
+		if yn == "n" {
+			return fmt.Errorf("the client did not pay")
+		}
+		return nil
+	}
+
+	fmt.Printf("Waiting for the payment to settle...\n")
+	ctx, cancel := context.WithTimeout(ctx, c.waitTimeout)
+	defer cancel()
+
+	var err error
+	if c.wait == WaitStream {
+		err = c.streamSettlement(ctx, response.PaymentStatusURL)
+	} else {
+		err = c.pollSettlement(ctx, response.PaymentStatusURL)
+	}
+
+	switch {
+	case err == nil:
+		result.Status = SettlementSettled
+	case errors.Is(err, ErrNotSettled):
+		result.Status = SettlementFailed
+	case errors.Is(err, context.DeadlineExceeded):
+		err = fmt.Errorf("payment did not settle within %s", c.waitTimeout)
+	}
+	return err
+}
+
+// pollSettlement long-polls the payment status until it is final
+func (c *HTTP402Client) pollSettlement(ctx context.Context, statusURL string) error {
+	known := ""
+	for {
+		status, err := GetPaymentStatus(ctx, c.httpClient, statusURL, known, statusPollWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if done, err := settlement(status); done {
+			return err
+		}
+		known = status.Status
+	}
+}
+
+// streamSettlement follows the payment status events until one is final.
+// A dropped stream is reopened; it starts again with the current status.
+func (c *HTTP402Client) streamSettlement(ctx context.Context, statusURL string) error {
+	var result error
+	done := false
+	for !done {
+		err := StreamPaymentStatus(ctx, c.httpClient, statusURL, func(status *PaymentStatus) bool {
+			done, result = settlement(status)
+			return !done
+		})
+		if done {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return result
+}
@@ -0,0 +1,158 @@
+// Package nostr implements the parts of the Nostr protocol needed by Nostr
+// Wallet Connect: signed events (NIP-01), NIP-04 encryption, a relay client
+// and a small in-memory relay.
+package nostr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+)
+
+type Tag []string
+
+type Event struct {
+	ID        string `json:"id"`
+	PubKey    string `json:"pubkey"`
+	CreatedAt int64  `json:"created_at"`
+	Kind      int    `json:"kind"`
+	Tags      []Tag  `json:"tags"`
+	Content   string `json:"content"`
+	Sig       string `json:"sig"`
+}
+
+// TagValue returns the first value of the first tag with the given name
+func (e *Event) TagValue(name string) string {
+	for _, t := range e.Tags {
+		if len(t) >= 2 && t[0] == name {
+			return t[1]
+		}
+	}
+	return ""
+}
+
+// serialize returns the canonical form used to compute the event ID
+func (e *Event) serialize() ([]byte, error) {
+	tags := e.Tags
+	if tags == nil {
+		tags = []Tag{}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode([]any{0, e.PubKey, e.CreatedAt, e.Kind, tags, e.Content}); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (e *Event) hash() ([]byte, error) {
+	b, err := e.serialize()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(b)
+	return h[:], nil
+}
+
+// Sign sets the event public key, ID and signature
+func (e *Event) Sign(privateKey string) error {
+	priv, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	e.PubKey = hex.EncodeToString(schnorr.SerializePubKey(priv.PubKey()))
+
+	h, err := e.hash()
+	if err != nil {
+		return err
+	}
+
+	sig, err := schnorr.Sign(priv, h)
+	if err != nil {
+		return fmt.Errorf("failed to sign event: %w", err)
+	}
+	e.ID = hex.EncodeToString(h)
+	e.Sig = hex.EncodeToString(sig.Serialize())
+	return nil
+}
+
+// Verify checks the event ID and signature
+func (e *Event) Verify() error {
+	h, err := e.hash()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h) != e.ID {
+		return errors.New("event id does not match its content")
+	}
+
+	pub, err := parsePublicKey(e.PubKey)
+	if err != nil {
+		return err
+	}
+	sigBytes, err := hex.DecodeString(e.Sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	sig, err := schnorr.ParseSignature(sigBytes)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	if !sig.Verify(h, pub) {
+		return errors.New("invalid event signature")
+	}
+	return nil
+}
+
+// GeneratePrivateKey returns a new random private key, hex encoded
+func GeneratePrivateKey() string {
+	for {
+		b := make([]byte, 32)
+		rand.Read(b)
+		if _, err := parsePrivateKey(hex.EncodeToString(b)); err == nil {
+			return hex.EncodeToString(b)
+		}
+	}
+}
+
+// PublicKey returns the x-only public key of a private key, hex encoded
+func PublicKey(privateKey string) (string, error) {
+	priv, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(schnorr.SerializePubKey(priv.PubKey())), nil
+}
+
+func parsePrivateKey(s string) (*btcec.PrivateKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return nil, errors.New("invalid private key")
+	}
+	var scalar btcec.ModNScalar
+	if overflow := scalar.SetByteSlice(b); overflow || scalar.IsZero() {
+		return nil, errors.New("invalid private key")
+	}
+	return btcec.PrivKeyFromScalar(&scalar), nil
+}
+
+func parsePublicKey(s string) (*btcec.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	pub, err := schnorr.ParsePubKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return pub, nil
+}
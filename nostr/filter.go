@@ -0,0 +1,114 @@
+package nostr
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// Filter selects events in REQ messages. Tag filters are keyed by the tag
+// name without the leading '#'.
+type Filter struct {
+	IDs     []string
+	Authors []string
+	Kinds   []int
+	Tags    map[string][]string
+	Since   int64
+	Until   int64
+	Limit   int
+}
+
+func (f Filter) MarshalJSON() ([]byte, error) {
+	m := map[string]any{}
+	if len(f.IDs) > 0 {
+		m["ids"] = f.IDs
+	}
+	if len(f.Authors) > 0 {
+		m["authors"] = f.Authors
+	}
+	if len(f.Kinds) > 0 {
+		m["kinds"] = f.Kinds
+	}
+	for name, values := range f.Tags {
+		m["#"+name] = values
+	}
+	if f.Since > 0 {
+		m["since"] = f.Since
+	}
+	if f.Until > 0 {
+		m["until"] = f.Until
+	}
+	if f.Limit > 0 {
+		m["limit"] = f.Limit
+	}
+	return json.Marshal(m)
+}
+
+func (f *Filter) UnmarshalJSON(b []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	*f = Filter{}
+	for k, v := range m {
+		var err error
+		switch {
+		case k == "ids":
+			err = json.Unmarshal(v, &f.IDs)
+		case k == "authors":
+			err = json.Unmarshal(v, &f.Authors)
+		case k == "kinds":
+			err = json.Unmarshal(v, &f.Kinds)
+		case k == "since":
+			err = json.Unmarshal(v, &f.Since)
+		case k == "until":
+			err = json.Unmarshal(v, &f.Until)
+		case k == "limit":
+			err = json.Unmarshal(v, &f.Limit)
+		case strings.HasPrefix(k, "#"):
+			var values []string
+			err = json.Unmarshal(v, &values)
+			if f.Tags == nil {
+				f.Tags = make(map[string][]string)
+			}
+			f.Tags[k[1:]] = values
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the event passes the filter
+func (f Filter) Matches(e *Event) bool {
+	if len(f.IDs) > 0 && !slices.Contains(f.IDs, e.ID) {
+		return false
+	}
+	if len(f.Authors) > 0 && !slices.Contains(f.Authors, e.PubKey) {
+		return false
+	}
+	if len(f.Kinds) > 0 && !slices.Contains(f.Kinds, e.Kind) {
+		return false
+	}
+	if f.Since > 0 && e.CreatedAt < f.Since {
+		return false
+	}
+	if f.Until > 0 && e.CreatedAt > f.Until {
+		return false
+	}
+	for name, values := range f.Tags {
+		found := false
+		for _, t := range e.Tags {
+			if len(t) >= 2 && t[0] == name && slices.Contains(values, t[1]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package nostr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// sharedSecret is the x coordinate of the ECDH point, as NIP-04 specifies
+func sharedSecret(privateKey, publicKey string) ([]byte, error) {
+	priv, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return btcec.GenerateSharedSecret(priv, pub), nil
+}
+
+// Encrypt encrypts a message for publicKey following NIP-04
+func Encrypt(privateKey, publicKey, plaintext string) (string, error) {
+	key, err := sharedSecret(privateKey, publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	// PKCS#7 padding
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	data := append([]byte(plaintext), bytes.Repeat([]byte{byte(pad)}, pad)...)
+
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	return base64.StdEncoding.EncodeToString(data) + "?iv=" + base64.StdEncoding.EncodeToString(iv), nil
+}
+
+// Decrypt decrypts a NIP-04 message sent by publicKey
+func Decrypt(privateKey, publicKey, content string) (string, error) {
+	ct, ivPart, ok := strings.Cut(content, "?iv=")
+	if !ok {
+		return "", errors.New("invalid nip04 content")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ct)
+	if err != nil {
+		return "", fmt.Errorf("invalid nip04 ciphertext: %w", err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(ivPart)
+	if err != nil || len(iv) != aes.BlockSize {
+		return "", errors.New("invalid nip04 iv")
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return "", errors.New("invalid nip04 ciphertext length")
+	}
+
+	key, err := sharedSecret(privateKey, publicKey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(data) {
+		return "", errors.New("invalid nip04 padding")
+	}
+	return string(data[:len(data)-pad]), nil
+}
@@ -0,0 +1,273 @@
+package nostr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrRelayClosed = errors.New("relay connection closed")
+
+// Relay is a connection to a Nostr relay
+type Relay struct {
+	URL string
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	subs   map[string]*Subscription
+	oks    map[string]chan error
+	err    error
+	closed chan struct{}
+}
+
+// Subscription receives the events matching a REQ
+type Subscription struct {
+	ID string
+	// Events is closed when the subscription or the relay is closed.
+	Events <-chan *Event
+	// EOSE is closed once the relay has sent every stored event.
+	EOSE <-chan struct{}
+
+	relay    *Relay
+	events   chan *Event
+	eose     chan struct{}
+	eoseOnce sync.Once
+
+	mu     sync.Mutex
+	isDone bool
+}
+
+// subscriptionBuffer is how many events a subscription holds before new
+// ones are dropped.
+const subscriptionBuffer = 256
+
+// Connect opens a connection to the relay at url (ws:// or wss://)
+func Connect(ctx context.Context, url string) (*Relay, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to relay %s: %w", url, err)
+	}
+
+	r := &Relay{
+		URL:    url,
+		conn:   conn,
+		subs:   make(map[string]*Subscription),
+		oks:    make(map[string]chan error),
+		closed: make(chan struct{}),
+	}
+	go r.readLoop()
+	return r, nil
+}
+
+func (r *Relay) send(msg ...any) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.conn.WriteJSON(msg)
+}
+
+// Publish sends an event and waits for the relay to accept it
+func (r *Relay) Publish(ctx context.Context, ev *Event) error {
+	ok := make(chan error, 1)
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return r.err
+	}
+	r.oks[ev.ID] = ok
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.oks, ev.ID)
+		r.mu.Unlock()
+	}()
+
+	if err := r.send("EVENT", ev); err != nil {
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+
+	select {
+	case err := <-ok:
+		return err
+	case <-r.closed:
+		return ErrRelayClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe asks the relay for events matching any of the filters
+func (r *Relay) Subscribe(ctx context.Context, filters ...Filter) (*Subscription, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	sub := &Subscription{
+		ID:     hex.EncodeToString(id),
+		relay:  r,
+		events: make(chan *Event, subscriptionBuffer),
+		eose:   make(chan struct{}),
+	}
+	sub.Events = sub.events
+	sub.EOSE = sub.eose
+
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return nil, r.err
+	}
+	r.subs[sub.ID] = sub
+	r.mu.Unlock()
+
+	msg := []any{"REQ", sub.ID}
+	for _, f := range filters {
+		msg = append(msg, f)
+	}
+	if err := r.send(msg...); err != nil {
+		r.removeSub(sub.ID)
+		return nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+	return sub, nil
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	if s.relay.removeSub(s.ID) {
+		s.relay.send("CLOSE", s.ID)
+	}
+}
+
+func (s *Subscription) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isDone {
+		s.isDone = true
+		close(s.events)
+	}
+}
+
+// deliver queues an event without ever blocking the read loop
+func (s *Subscription) deliver(ev *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isDone {
+		return
+	}
+	select {
+	case s.events <- ev:
+	default:
+	}
+}
+
+func (r *Relay) removeSub(id string) bool {
+	r.mu.Lock()
+	sub, ok := r.subs[id]
+	delete(r.subs, id)
+	r.mu.Unlock()
+
+	if ok {
+		sub.done()
+	}
+	return ok
+}
+
+// Close closes the connection
+func (r *Relay) Close() error {
+	return r.conn.Close()
+}
+
+func (r *Relay) readLoop() {
+	var err error
+	for {
+		var msg []json.RawMessage
+		if err = r.conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		r.handle(msg)
+	}
+
+	r.mu.Lock()
+	r.err = fmt.Errorf("%w: %v", ErrRelayClosed, err)
+	subs := r.subs
+	r.subs = make(map[string]*Subscription)
+	r.mu.Unlock()
+
+	close(r.closed)
+	for _, sub := range subs {
+		sub.done()
+	}
+}
+
+func (r *Relay) handle(msg []json.RawMessage) {
+	if len(msg) < 2 {
+		return
+	}
+
+	var label, id string
+	if json.Unmarshal(msg[0], &label) != nil || json.Unmarshal(msg[1], &id) != nil {
+		return
+	}
+
+	switch label {
+	case "EVENT":
+		if len(msg) < 3 {
+			return
+		}
+		var ev Event
+		if json.Unmarshal(msg[2], &ev) != nil || ev.Verify() != nil {
+			return
+		}
+		r.mu.Lock()
+		sub, ok := r.subs[id]
+		r.mu.Unlock()
+		if !ok {
+			return
+		}
+		sub.deliver(&ev)
+
+	case "EOSE":
+		r.mu.Lock()
+		sub, ok := r.subs[id]
+		r.mu.Unlock()
+		if ok {
+			sub.eoseOnce.Do(func() { close(sub.eose) })
+		}
+
+	case "CLOSED":
+		r.removeSub(id)
+
+	case "OK":
+		var (
+			accepted bool
+			reason   string
+		)
+		if len(msg) >= 3 {
+			json.Unmarshal(msg[2], &accepted)
+		}
+		if len(msg) >= 4 {
+			json.Unmarshal(msg[3], &reason)
+		}
+
+		r.mu.Lock()
+		ok, found := r.oks[id]
+		r.mu.Unlock()
+		if !found {
+			return
+		}
+		var err error
+		if !accepted {
+			err = fmt.Errorf("relay rejected event: %s", reason)
+		}
+		select {
+		case ok <- err:
+		default:
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package nostr
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxStoredEvents caps the memory used by the in-memory relay
+const maxStoredEvents = 10000
+
+// RelayServer is a minimal in-memory Nostr relay. It is enough to run Nostr
+// Wallet Connect flows offline and in tests: it verifies and stores events,
+// answers REQs with stored events and streams new ones. Ephemeral events
+// (kinds 20000-29999) are forwarded but never stored.
+type RelayServer struct {
+	upgrader websocket.Upgrader
+
+	mu     sync.Mutex
+	events []*Event
+	conns  map[*relayConn]struct{}
+}
+
+type relayConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string][]Filter
+}
+
+func NewRelayServer() *RelayServer {
+	return &RelayServer{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns: make(map[*relayConn]struct{}),
+	}
+}
+
+func (s *RelayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &relayConn{
+		ws:   ws,
+		subs: make(map[string][]Filter),
+	}
+
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		ws.Close()
+	}()
+
+	for {
+		var msg []json.RawMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			return
+		}
+		s.handle(c, msg)
+	}
+}
+
+func (c *relayConn) send(msg ...any) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.WriteJSON(msg)
+}
+
+func (s *RelayServer) handle(c *relayConn, msg []json.RawMessage) {
+	if len(msg) < 2 {
+		c.send("NOTICE", "invalid message")
+		return
+	}
+
+	var label string
+	if json.Unmarshal(msg[0], &label) != nil {
+		c.send("NOTICE", "invalid message")
+		return
+	}
+
+	switch label {
+	case "EVENT":
+		var ev Event
+		if err := json.Unmarshal(msg[1], &ev); err != nil {
+			c.send("NOTICE", "invalid event")
+			return
+		}
+		if err := ev.Verify(); err != nil {
+			c.send("OK", ev.ID, false, "invalid: "+err.Error())
+			return
+		}
+		s.publish(&ev)
+		c.send("OK", ev.ID, true, "")
+
+	case "REQ":
+		var id string
+		if json.Unmarshal(msg[1], &id) != nil {
+			c.send("NOTICE", "invalid subscription id")
+			return
+		}
+		filters := make([]Filter, 0, len(msg)-2)
+		for _, raw := range msg[2:] {
+			var f Filter
+			if err := json.Unmarshal(raw, &f); err != nil {
+				c.send("CLOSED", id, "invalid: bad filter")
+				return
+			}
+			filters = append(filters, f)
+		}
+
+		c.mu.Lock()
+		c.subs[id] = filters
+		c.mu.Unlock()
+
+		s.mu.Lock()
+		stored := append([]*Event(nil), s.events...)
+		s.mu.Unlock()
+
+		for _, ev := range stored {
+			if matchesAny(filters, ev) {
+				c.send("EVENT", id, ev)
+			}
+		}
+		c.send("EOSE", id)
+
+	case "CLOSE":
+		var id string
+		json.Unmarshal(msg[1], &id)
+		c.mu.Lock()
+		delete(c.subs, id)
+		c.mu.Unlock()
+	}
+}
+
+func (s *RelayServer) publish(ev *Event) {
+	s.mu.Lock()
+	if !isEphemeral(ev.Kind) {
+		s.events = append(s.events, ev)
+		if len(s.events) > maxStoredEvents {
+			s.events = s.events[len(s.events)-maxStoredEvents:]
+		}
+	}
+	conns := make([]*relayConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		var ids []string
+		for id, filters := range c.subs {
+			if matchesAny(filters, ev) {
+				ids = append(ids, id)
+			}
+		}
+		c.mu.Unlock()
+
+		for _, id := range ids {
+			c.send("EVENT", id, ev)
+		}
+	}
+}
+
+func isEphemeral(kind int) bool {
+	return kind >= 20000 && kind < 30000
+}
+
+func matchesAny(filters []Filter, ev *Event) bool {
+	for _, f := range filters {
+		if f.Matches(ev) {
+			return true
+		}
+	}
+	return false
+}
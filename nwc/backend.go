@@ -0,0 +1,114 @@
+package nwc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/l402-protocol/go-example/bolt11"
+)
+
+// MemoryBackend is an in-memory Lightning wallet stand-in. It can only pay
+// invoices whose preimage it knows, either because they were issued with
+// NewInvoice or registered with AddPreimage; everything else fails as if
+// there was no route.
+type MemoryBackend struct {
+	nodeKey *btcec.PrivateKey
+
+	mu        sync.Mutex
+	balance   int64
+	preimages map[[32]byte][]byte
+	paid      map[[32]byte]bool
+}
+
+// NewMemoryBackend creates a backend holding balanceMsat
+func NewMemoryBackend(balanceMsat int64) *MemoryBackend {
+	key, _ := btcec.NewPrivateKey()
+	return &MemoryBackend{
+		nodeKey:   key,
+		balance:   balanceMsat,
+		preimages: make(map[[32]byte][]byte),
+		paid:      make(map[[32]byte]bool),
+	}
+}
+
+// AddPreimage makes invoices with the matching payment hash payable
+func (b *MemoryBackend) AddPreimage(preimage []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.preimages[sha256.Sum256(preimage)] = preimage
+}
+
+// NewInvoice issues an invoice payable through this backend, as if it came
+// from a node reachable from it.
+func (b *MemoryBackend) NewInvoice(network bolt11.Network, amountMsat int64, description string, expiry time.Duration) (string, error) {
+	preimage := make([]byte, 32)
+	rand.Read(preimage)
+
+	var secret [32]byte
+	rand.Read(secret[:])
+
+	inv := &bolt11.Invoice{
+		Network:       network,
+		AmountMsat:    amountMsat,
+		Timestamp:     time.Now(),
+		PaymentHash:   sha256.Sum256(preimage),
+		PaymentSecret: &secret,
+		Description:   &description,
+		Expiry:        expiry,
+	}
+	invoice, err := bolt11.Encode(inv, b.nodeKey)
+	if err != nil {
+		return "", err
+	}
+
+	b.AddPreimage(preimage)
+	return invoice, nil
+}
+
+// PayInvoice implements Backend
+func (b *MemoryBackend) PayInvoice(ctx context.Context, invoice string, amountMsat int64) ([]byte, int64, error) {
+	inv, err := bolt11.Decode(invoice)
+	if err != nil {
+		return nil, 0, &Error{Code: CodeOther, Message: "invalid invoice: " + err.Error()}
+	}
+	if inv.Expired(time.Now()) {
+		return nil, 0, &Error{Code: CodePaymentFailed, Message: "invoice expired"}
+	}
+
+	amount := inv.AmountMsat
+	if amount == 0 {
+		amount = amountMsat
+	}
+	if amount <= 0 {
+		return nil, 0, &Error{Code: CodeOther, Message: "amount required"}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.paid[inv.PaymentHash] {
+		return nil, 0, &Error{Code: CodePaymentFailed, Message: "invoice already paid"}
+	}
+	preimage, ok := b.preimages[inv.PaymentHash]
+	if !ok {
+		return nil, 0, &Error{Code: CodePaymentFailed, Message: "no route to payee"}
+	}
+	if b.balance < amount {
+		return nil, 0, &Error{Code: CodeInsufficientBalance, Message: "not enough balance"}
+	}
+
+	b.balance -= amount
+	b.paid[inv.PaymentHash] = true
+	return preimage, 0, nil
+}
+
+// Balance implements Backend
+func (b *MemoryBackend) Balance(ctx context.Context) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.balance, nil
+}
@@ -0,0 +1,178 @@
+package nwc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/l402-protocol/go-example/nostr"
+)
+
+// DefaultTimeout bounds how long the client waits for the wallet service
+const DefaultTimeout = 60 * time.Second
+
+// Client sends NIP-47 requests to a wallet service over a relay
+type Client struct {
+	uri     ConnectionURI
+	pubKey  string
+	timeout time.Duration
+
+	mu    sync.Mutex
+	relay *nostr.Relay
+}
+
+// NewClient creates a client for the wallet service described by uri. The
+// relay connection is opened on first use.
+func NewClient(uri ConnectionURI) (*Client, error) {
+	pubKey, err := nostr.PublicKey(uri.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection secret: %w", err)
+	}
+	return &Client{
+		uri:     uri,
+		pubKey:  pubKey,
+		timeout: DefaultTimeout,
+	}, nil
+}
+
+// PayInvoice asks the wallet service to pay a BOLT11 invoice
+func (c *Client) PayInvoice(ctx context.Context, invoice string) (*PayInvoiceResult, error) {
+	var result PayInvoiceResult
+	if err := c.call(ctx, MethodPayInvoice, PayInvoiceParams{Invoice: invoice}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetBalance returns the wallet balance in msat
+func (c *Client) GetBalance(ctx context.Context) (int64, error) {
+	var result GetBalanceResult
+	if err := c.call(ctx, MethodGetBalance, struct{}{}, &result); err != nil {
+		return 0, err
+	}
+	return result.Balance, nil
+}
+
+// Close closes the relay connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.relay == nil {
+		return nil
+	}
+	err := c.relay.Close()
+	c.relay = nil
+	return err
+}
+
+func (c *Client) connect(ctx context.Context) (*nostr.Relay, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.relay != nil {
+		return c.relay, nil
+	}
+	relay, err := nostr.Connect(ctx, c.uri.Relay)
+	if err != nil {
+		return nil, err
+	}
+	c.relay = relay
+	return relay, nil
+}
+
+func (c *Client) call(ctx context.Context, method string, params, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(Request{Method: method, Params: rawParams})
+	if err != nil {
+		return err
+	}
+	content, err := nostr.Encrypt(c.uri.Secret, c.uri.WalletPubKey, string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt request: %w", err)
+	}
+
+	req := &nostr.Event{
+		CreatedAt: time.Now().Unix(),
+		Kind:      KindRequest,
+		Tags:      []nostr.Tag{{"p", c.uri.WalletPubKey}},
+		Content:   content,
+	}
+	if err := req.Sign(c.uri.Secret); err != nil {
+		return err
+	}
+
+	relay, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Subscribe before publishing so the response can't be missed
+	sub, err := relay.Subscribe(ctx, nostr.Filter{
+		Kinds:   []int{KindResponse},
+		Authors: []string{c.uri.WalletPubKey},
+		Tags:    map[string][]string{"e": {req.ID}},
+	})
+	if err != nil {
+		c.dropRelay(relay)
+		return err
+	}
+	defer sub.Close()
+
+	if err := relay.Publish(ctx, req); err != nil {
+		if errors.Is(err, nostr.ErrRelayClosed) {
+			c.dropRelay(relay)
+		}
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no response from wallet service: %w", ctx.Err())
+
+		case ev, ok := <-sub.Events:
+			if !ok {
+				c.dropRelay(relay)
+				return nostr.ErrRelayClosed
+			}
+
+			plaintext, err := nostr.Decrypt(c.uri.Secret, c.uri.WalletPubKey, ev.Content)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt response: %w", err)
+			}
+
+			var resp Response
+			if err := json.Unmarshal([]byte(plaintext), &resp); err != nil {
+				return fmt.Errorf("invalid response: %w", err)
+			}
+			if resp.Error != nil {
+				return resp.Error
+			}
+			if resp.ResultType != method {
+				return fmt.Errorf("unexpected result type %q", resp.ResultType)
+			}
+			return json.Unmarshal(resp.Result, result)
+		}
+	}
+}
+
+// dropRelay forgets a broken connection so the next call reconnects
+func (c *Client) dropRelay(relay *nostr.Relay) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.relay == relay {
+		c.relay.Close()
+		c.relay = nil
+	}
+}
@@ -0,0 +1,127 @@
+// Package nwc implements Nostr Wallet Connect (NIP-47): a client that asks a
+// remote wallet service to pay invoices, and a wallet service stand-in so
+// the whole flow can run offline.
+package nwc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/l402-protocol/go-example/nostr"
+)
+
+const (
+	KindInfo     = 13194
+	KindRequest  = 23194
+	KindResponse = 23195
+
+	MethodPayInvoice = "pay_invoice"
+	MethodGetBalance = "get_balance"
+
+	uriScheme = "nostr+walletconnect"
+)
+
+// Error codes defined by NIP-47
+const (
+	CodeRateLimited         = "RATE_LIMITED"
+	CodeNotImplemented      = "NOT_IMPLEMENTED"
+	CodeInsufficientBalance = "INSUFFICIENT_BALANCE"
+	CodeQuotaExceeded       = "QUOTA_EXCEEDED"
+	CodeRestricted          = "RESTRICTED"
+	CodeUnauthorized        = "UNAUTHORIZED"
+	CodeInternal            = "INTERNAL"
+	CodeOther               = "OTHER"
+	CodePaymentFailed       = "PAYMENT_FAILED"
+)
+
+// Error is an error returned by the wallet service
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("nwc %s: %s", e.Code, e.Message)
+}
+
+// IsCode reports whether err is a wallet service error with the given code
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type Response struct {
+	ResultType string          `json:"result_type"`
+	Error      *Error          `json:"error,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+}
+
+type PayInvoiceParams struct {
+	Invoice string `json:"invoice"`
+	// Amount in msat, only for invoices without an amount.
+	Amount int64 `json:"amount,omitempty"`
+}
+
+type PayInvoiceResult struct {
+	Preimage string `json:"preimage"`
+	FeesPaid int64  `json:"fees_paid,omitempty"`
+}
+
+type GetBalanceResult struct {
+	// Balance in msat.
+	Balance int64 `json:"balance"`
+}
+
+// ConnectionURI holds what a client needs to talk to a wallet service:
+// nostr+walletconnect://<wallet pubkey>?relay=<url>&secret=<client key>
+type ConnectionURI struct {
+	WalletPubKey string
+	Relay        string
+	Secret       string
+}
+
+// ParseURI parses a nostr+walletconnect:// connection string
+func ParseURI(s string) (ConnectionURI, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return ConnectionURI{}, fmt.Errorf("invalid connection uri: %w", err)
+	}
+	if u.Scheme != uriScheme {
+		return ConnectionURI{}, fmt.Errorf("invalid connection uri scheme %q", u.Scheme)
+	}
+
+	// Both nostr+walletconnect://pubkey and nostr+walletconnect:pubkey are
+	// seen in the wild.
+	pubkey := u.Host
+	if pubkey == "" {
+		pubkey = strings.TrimPrefix(u.Opaque, "//")
+	}
+
+	c := ConnectionURI{
+		WalletPubKey: pubkey,
+		Relay:        u.Query().Get("relay"),
+		Secret:       u.Query().Get("secret"),
+	}
+	if c.WalletPubKey == "" || c.Relay == "" || c.Secret == "" {
+		return ConnectionURI{}, errors.New("connection uri needs a wallet pubkey, relay and secret")
+	}
+	if _, err := nostr.PublicKey(c.Secret); err != nil {
+		return ConnectionURI{}, fmt.Errorf("invalid connection secret: %w", err)
+	}
+	return c, nil
+}
+
+func (c ConnectionURI) String() string {
+	q := url.Values{}
+	q.Set("relay", c.Relay)
+	q.Set("secret", c.Secret)
+	return uriScheme + "://" + c.WalletPubKey + "?" + q.Encode()
+}
@@ -0,0 +1,250 @@
+package nwc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/l402-protocol/go-example/nostr"
+)
+
+// Backend is the Lightning wallet behind a Service
+type Backend interface {
+	// PayInvoice pays a BOLT11 invoice and returns the preimage. amountMsat
+	// is only set for invoices without an amount.
+	PayInvoice(ctx context.Context, invoice string, amountMsat int64) (preimage []byte, feesMsat int64, err error)
+	// Balance returns the spendable balance in msat
+	Balance(ctx context.Context) (int64, error)
+}
+
+// Service is a NIP-47 wallet service. It listens for requests addressed to
+// its public key on a relay and answers them using a Backend. Only clients
+// whose connection was created with NewConnection or authorized with
+// Authorize are served.
+type Service struct {
+	privKey  string
+	pubKey   string
+	relayURL string
+	backend  Backend
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	clients map[string]bool
+	relay   *nostr.Relay
+}
+
+// NewService creates a wallet service with a fresh key
+func NewService(relayURL string, backend Backend) *Service {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	privKey := nostr.GeneratePrivateKey()
+	pubKey, _ := nostr.PublicKey(privKey)
+
+	return &Service{
+		privKey:  privKey,
+		pubKey:   pubKey,
+		relayURL: relayURL,
+		backend:  backend,
+		logger:   logger,
+		clients:  make(map[string]bool),
+	}
+}
+
+// PubKey returns the wallet service public key
+func (s *Service) PubKey() string {
+	return s.pubKey
+}
+
+// Authorize allows a client public key to use the wallet
+func (s *Service) Authorize(clientPubKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[clientPubKey] = true
+}
+
+// NewConnection creates and authorizes a new client connection
+func (s *Service) NewConnection() ConnectionURI {
+	secret := nostr.GeneratePrivateKey()
+	pubKey, _ := nostr.PublicKey(secret)
+	s.Authorize(pubKey)
+
+	return ConnectionURI{
+		WalletPubKey: s.pubKey,
+		Relay:        s.relayURL,
+		Secret:       secret,
+	}
+}
+
+// Start connects to the relay, announces the supported methods and serves
+// requests until ctx is done. It returns once the service is listening.
+func (s *Service) Start(ctx context.Context) error {
+	relay, err := nostr.Connect(ctx, s.relayURL)
+	if err != nil {
+		return err
+	}
+
+	info := &nostr.Event{
+		CreatedAt: time.Now().Unix(),
+		Kind:      KindInfo,
+		Content:   strings.Join([]string{MethodPayInvoice, MethodGetBalance}, " "),
+	}
+	if err := info.Sign(s.privKey); err != nil {
+		relay.Close()
+		return err
+	}
+	if err := relay.Publish(ctx, info); err != nil {
+		relay.Close()
+		return fmt.Errorf("failed to publish wallet info: %w", err)
+	}
+
+	sub, err := relay.Subscribe(ctx, nostr.Filter{
+		Kinds: []int{KindRequest},
+		Tags:  map[string][]string{"p": {s.pubKey}},
+		Since: time.Now().Add(-time.Minute).Unix(),
+	})
+	if err != nil {
+		relay.Close()
+		return err
+	}
+
+	// Once EOSE arrives the relay knows about the subscription
+	select {
+	case <-sub.EOSE:
+	case <-ctx.Done():
+		relay.Close()
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	s.relay = relay
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		relay.Close()
+	}()
+
+	go func() {
+		for ev := range sub.Events {
+			go s.handle(ctx, relay, ev)
+		}
+	}()
+
+	s.logger.Info("nwc wallet service started",
+		"pubkey", s.pubKey,
+		"relay", s.relayURL,
+	)
+	return nil
+}
+
+func (s *Service) handle(ctx context.Context, relay *nostr.Relay, ev *nostr.Event) {
+	s.mu.Lock()
+	authorized := s.clients[ev.PubKey]
+	s.mu.Unlock()
+
+	var req Request
+	resp := Response{}
+
+	plaintext, err := nostr.Decrypt(s.privKey, ev.PubKey, ev.Content)
+	switch {
+	case !authorized:
+		resp.Error = &Error{Code: CodeUnauthorized, Message: "unknown client"}
+	case err != nil:
+		resp.Error = &Error{Code: CodeOther, Message: "failed to decrypt request"}
+	case json.Unmarshal([]byte(plaintext), &req) != nil:
+		resp.Error = &Error{Code: CodeOther, Message: "invalid request"}
+	default:
+		resp = s.dispatch(ctx, req)
+	}
+	if resp.ResultType == "" {
+		resp.ResultType = req.Method
+	}
+
+	s.logger.Info("nwc request handled",
+		"client", ev.PubKey,
+		"method", req.Method,
+		"error", resp.Error,
+	)
+
+	if err := s.respond(ctx, relay, ev, resp); err != nil {
+		s.logger.Error("failed to send nwc response",
+			"error", err,
+			"request_id", ev.ID,
+		)
+	}
+}
+
+func (s *Service) dispatch(ctx context.Context, req Request) Response {
+	resp := Response{ResultType: req.Method}
+
+	var (
+		result any
+		err    error
+	)
+	switch req.Method {
+	case MethodPayInvoice:
+		var params PayInvoiceParams
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.Invoice == "" {
+			resp.Error = &Error{Code: CodeOther, Message: "missing invoice"}
+			return resp
+		}
+		var (
+			preimage []byte
+			fees     int64
+		)
+		preimage, fees, err = s.backend.PayInvoice(ctx, params.Invoice, params.Amount)
+		result = PayInvoiceResult{Preimage: hex.EncodeToString(preimage), FeesPaid: fees}
+
+	case MethodGetBalance:
+		var balance int64
+		balance, err = s.backend.Balance(ctx)
+		result = GetBalanceResult{Balance: balance}
+
+	default:
+		resp.Error = &Error{Code: CodeNotImplemented, Message: "unknown method " + req.Method}
+		return resp
+	}
+
+	if err != nil {
+		var nwcErr *Error
+		if !errors.As(err, &nwcErr) {
+			nwcErr = &Error{Code: CodeInternal, Message: err.Error()}
+		}
+		resp.Error = nwcErr
+		return resp
+	}
+
+	resp.Result, _ = json.Marshal(result)
+	return resp
+}
+
+func (s *Service) respond(ctx context.Context, relay *nostr.Relay, req *nostr.Event, resp Response) error {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	content, err := nostr.Encrypt(s.privKey, req.PubKey, string(payload))
+	if err != nil {
+		return err
+	}
+
+	ev := &nostr.Event{
+		CreatedAt: time.Now().Unix(),
+		Kind:      KindResponse,
+		Tags:      []nostr.Tag{{"p", req.PubKey}, {"e", req.ID}},
+		Content:   content,
+	}
+	if err := ev.Sign(s.privKey); err != nil {
+		return err
+	}
+	return relay.Publish(ctx, ev)
+}
@@ -0,0 +1,56 @@
+package nwc
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/l402-protocol/go-example/nostr"
+)
+
+// StandIn runs an in-memory relay and a wallet service in-process, so the
+// whole NWC flow can be exercised without network access.
+type StandIn struct {
+	Relay   *nostr.RelayServer
+	Service *Service
+	Backend *MemoryBackend
+
+	server *httptest.Server
+	cancel context.CancelFunc
+}
+
+// NewStandIn starts a relay and a wallet service holding balanceMsat
+func NewStandIn(ctx context.Context, balanceMsat int64) (*StandIn, error) {
+	relay := nostr.NewRelayServer()
+	server := httptest.NewServer(relay)
+	relayURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ctx, cancel := context.WithCancel(ctx)
+	backend := NewMemoryBackend(balanceMsat)
+	service := NewService(relayURL, backend)
+	if err := service.Start(ctx); err != nil {
+		cancel()
+		server.Close()
+		return nil, err
+	}
+
+	return &StandIn{
+		Relay:   relay,
+		Service: service,
+		Backend: backend,
+		server:  server,
+		cancel:  cancel,
+	}, nil
+}
+
+// RelayURL returns the websocket URL of the relay
+func (s *StandIn) RelayURL() string {
+	return "ws" + strings.TrimPrefix(s.server.URL, "http")
+}
+
+// Close stops the wallet service and the relay
+func (s *StandIn) Close() {
+	s.cancel()
+	s.server.CloseClientConnections()
+	s.server.Close()
+}
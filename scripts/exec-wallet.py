@@ -0,0 +1,166 @@
+#!/usr/bin/env python3
+"""Reference external wallet for wallet.ExecWallet.
+
+Reads an ExecRequest as JSON on stdin, pays fake-pay offers by submitting the
+gateway checkout form without a browser and writes an ExecResponse as JSON on
+stdout. Logs go to stderr.
+
+Exit codes:
+  0 paid (or pending)      3 insufficient funds   5 temporary failure
+  1 failed                 4 unsupported          6 cancelled
+  2 bad input
+
+Set EXEC_WALLET_SCENARIO to insufficient, unsupported, temporary, cancel,
+sleep or garbage to exercise the error paths, and EXEC_WALLET_BALANCE to cap
+what the wallet can spend.
+"""
+
+import http.cookiejar
+import json
+import os
+import sys
+import time
+import urllib.error
+import urllib.parse
+import urllib.request
+from html.parser import HTMLParser
+
+PROTOCOL_VERSION = "1"
+
+
+def log(msg):
+    print(msg, file=sys.stderr)
+
+
+def reply(code, **fields):
+    json.dump(fields, sys.stdout)
+    sys.stdout.write("\n")
+    sys.exit(code)
+
+
+class FormParser(HTMLParser):
+    """Collects the POST forms of a page with their fields."""
+
+    def __init__(self):
+        super().__init__()
+        self.forms = []
+        self.current = None
+
+    def handle_starttag(self, tag, attrs):
+        attrs = dict(attrs)
+        if tag == "form" and (attrs.get("method") or "").upper() == "POST":
+            self.current = (attrs.get("action") or "", [])
+            self.forms.append(self.current)
+        elif tag == "input" and self.current is not None and attrs.get("name"):
+            self.current[1].append((attrs["name"], attrs.get("value") or ""))
+
+    def handle_endtag(self, tag):
+        if tag == "form":
+            self.current = None
+
+
+def confirmation_form(page, base):
+    """Returns where the checkout form posts and its fields, like
+    confirmationForm in wallet/checkout.go. The checkout may be under a path
+    prefix of the gateway."""
+    parser = FormParser()
+    parser.feed(page)
+    base_path = urllib.parse.urlsplit(base).path
+    for action, fields in parser.forms:
+        target = urllib.parse.urlsplit(urllib.parse.urljoin(base, action))
+        if target.path != base_path:
+            # Older gateways behind a path prefix left it out of the action
+            if target.path == "/" or not base_path.endswith(target.path):
+                continue
+            target = target._replace(path=base_path)
+        return urllib.parse.urlunsplit(target), fields
+    return None, None
+
+
+def confirm(opener, checkout_url):
+    """Loads the checkout page and submits its confirmation form, keeping the
+    cookie its CSRF token is tied to. Returns the payment status reported by
+    the gateway, if any."""
+    with opener.open(checkout_url, timeout=30) as resp:
+        status = resp.headers.get("X-Payment-Status", "")
+        page = resp.read(1 << 20).decode("utf-8", "replace")
+        base = resp.geturl()
+    if status == "paid":
+        return status
+
+    action, fields = confirmation_form(page, base)
+    if action is None:
+        # Older gateways confirm when the checkout page is loaded
+        return status
+
+    data = urllib.parse.urlencode(fields).encode()
+    with opener.open(action, data=data, timeout=30) as resp:
+        return resp.headers.get("X-Payment-Status", "")
+
+
+def post_json(url, body):
+    req = urllib.request.Request(
+        url,
+        data=json.dumps(body).encode(),
+        headers={"Content-Type": "application/json"},
+        method="POST",
+    )
+    with urllib.request.urlopen(req, timeout=30) as resp:
+        return json.load(resp)
+
+
+def main():
+    try:
+        req = json.load(sys.stdin)
+    except ValueError as e:
+        reply(2, error=f"invalid input: {e}")
+
+    if req.get("version") != PROTOCOL_VERSION:
+        reply(2, error=f"unsupported protocol version {req.get('version')!r}")
+
+    offer = req["offer"]
+    l402 = req["l402"]
+    method = req["payment_method"]
+    scenario = os.environ.get("EXEC_WALLET_SCENARIO", "")
+
+    if scenario == "sleep":
+        time.sleep(3600)
+    if scenario == "garbage":
+        print("this is not json")
+        sys.exit(0)
+    if scenario == "cancel":
+        reply(6, error="user cancelled")
+    if scenario == "temporary":
+        reply(5, error="wallet backend unavailable")
+    if scenario == "unsupported" or method != "fake-pay":
+        reply(4, error=f"payment method {method} not supported")
+
+    balance = os.environ.get("EXEC_WALLET_BALANCE")
+    if scenario == "insufficient":
+        balance = "0"
+    if balance is not None and int(balance) < offer["amount"]:
+        reply(3, error="not enough funds", currency=offer["currency"],
+              needed=offer["amount"], available=int(balance))
+
+    try:
+        pay_req = post_json(l402["payment_request_url"], {
+            "offer_id": offer["id"],
+            "payment_method": method,
+            "payment_context_token": l402["payment_context_token"],
+        })
+        checkout_url = pay_req["payment_request"]["check_url"]
+        log(f"confirming checkout {checkout_url}")
+        opener = urllib.request.build_opener(
+            urllib.request.HTTPCookieProcessor(http.cookiejar.CookieJar()))
+        status = confirm(opener, checkout_url)
+    except urllib.error.HTTPError as e:
+        temporary = e.code >= 500 or e.code == 429
+        reply(5 if temporary else 1, error=f"gateway returned {e.code}")
+    except (urllib.error.URLError, OSError) as e:
+        reply(5, error=f"gateway unreachable: {e}")
+
+    reply(0, status="settled" if status == "paid" else "pending")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,465 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// ErrInsufficientFunds matches any InsufficientFundsError with errors.Is
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// InsufficientFundsError is returned when a BalanceWallet can't cover an offer
+type InsufficientFundsError struct {
+	Currency  string
+	Needed    int64
+	Available int64
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("insufficient funds: need %d %s, have %d %s",
+		e.Needed, e.Currency, e.Available, e.Currency)
+}
+
+func (e *InsufficientFundsError) Is(target error) bool {
+	return target == ErrInsufficientFunds
+}
+
+type EntryType string
+
+const (
+	EntryCredit EntryType = "credit"
+	EntryDebit  EntryType = "debit"
+	EntryRefund EntryType = "refund"
+	// EntryReversal gives back a debit whose payment failed.
+	EntryReversal EntryType = "reversal"
+)
+
+// LedgerEntry is a balance movement of a BalanceWallet
+type LedgerEntry struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Type     EntryType `json:"type"`
+	Currency string    `json:"currency"`
+	// Amount is always positive, Type tells the direction.
+	Amount int64 `json:"amount"`
+	// Balance of the currency after the entry.
+	Balance int64 `json:"balance"`
+
+	OfferID             string `json:"offer_id,omitempty"`
+	PaymentContextToken string `json:"payment_context_token,omitempty"`
+	Reference           string `json:"reference,omitempty"`
+
+	// Pending marks a debit whose payment may or may not have gone through.
+	// It is settled with the payment status at StatusURL.
+	Pending   bool   `json:"pending,omitempty"`
+	StatusURL string `json:"status_url,omitempty"`
+}
+
+type balanceState struct {
+	Balances map[string]int64 `json:"balances"`
+	History  []LedgerEntry    `json:"history"`
+	NextID   int64            `json:"next_id"`
+}
+
+// BalanceWallet caps what another wallet can spend with a prefunded balance
+// per currency. The balance is debited before the inner wallet pays and
+// credited back if the payment fails. A payment that may have gone through,
+// e.g. one that timed out or isn't settled yet, keeps its debit pending until SettlePending finds
+// out how it ended.
+type BalanceWallet struct {
+	offerID string
+	inner   l402.ProofWallet
+	path    string
+	logger  *slog.Logger
+
+	mu    sync.Mutex
+	state balanceState
+}
+
+// NewBalanceWallet loads the balance stored at path, creating it if missing,
+// and wraps inner. An empty path keeps the balance in memory only.
+func NewBalanceWallet(path string, offerID string, inner l402.Wallet) (*BalanceWallet, error) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	w := &BalanceWallet{
+		offerID: offerID,
+		inner:   l402.AdaptWalletForOffer(inner, offerID),
+		path:    path,
+		logger:  logger,
+		state: balanceState{
+			Balances: make(map[string]int64),
+			NextID:   1,
+		},
+	}
+
+	if path == "" {
+		return w, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read balance file: %w", err)
+	}
+	if err := json.Unmarshal(data, &w.state); err != nil {
+		return nil, fmt.Errorf("failed to parse balance file: %w", err)
+	}
+	if w.state.Balances == nil {
+		w.state.Balances = make(map[string]int64)
+	}
+	return w, nil
+}
+
+// Pay implements the l402.Wallet interface
+func (w *BalanceWallet) Pay(response *l402.L402Response) error {
+	_, err := w.PayWithProof(context.Background(), response)
+	return err
+}
+
+// PayWithProof implements the l402.ProofWallet interface
+func (w *BalanceWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	offer, err := findOffer(response, w.offerID)
+	if err != nil {
+		return nil, err
+	}
+
+	currency := strings.ToUpper(offer.Currency)
+	amount := int64(offer.Amount)
+
+	debit, err := w.debit(currency, amount, offer.ID, response.PaymentContextToken)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := w.inner.PayWithProof(ctx, response)
+	if err != nil {
+		if !paymentFailed(err) {
+			w.logger.Warn("payment outcome unknown, keeping debit pending",
+				"error", err,
+				"entry_id", debit.ID,
+				"payment_context", response.PaymentContextToken,
+			)
+			if perr := w.markPending(debit.ID, response.PaymentStatusURL); perr != nil {
+				w.logger.Error("failed to mark debit pending",
+					"error", perr,
+					"entry_id", debit.ID,
+				)
+			}
+			return nil, err
+		}
+		w.reverse(debit, "payment failed")
+		return nil, err
+	}
+
+	switch result.Status {
+	case l402.SettlementSettled:
+	case l402.SettlementFailed:
+		w.reverse(debit, "payment failed")
+		return result, nil
+	default:
+		// Not final yet, e.g. an unconfirmed transaction or a v1 wallet.
+		// The debit is settled once the gateway knows how it ended.
+		statusURL := result.StatusURL
+		if statusURL == "" {
+			statusURL = response.PaymentStatusURL
+		}
+		if err := w.markPending(debit.ID, statusURL); err != nil {
+			w.logger.Error("failed to mark debit pending",
+				"error", err,
+				"entry_id", debit.ID,
+			)
+		}
+		return result, nil
+	}
+
+	// Give back whatever the inner wallet didn't spend
+	if result.Amount > 0 && strings.EqualFold(result.Currency, currency) && int64(result.Amount) < amount {
+		if _, err := w.apply(EntryReversal, currency, amount-int64(result.Amount), offer.ID,
+			response.PaymentContextToken, fmt.Sprintf("partial spend of entry %d", debit.ID)); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// paymentFailed reports whether err means the inner wallet definitely did
+// not pay. Retryable errors promise that nothing was spent, so another
+// wallet may pay instead. Anything else, like a timeout, may come after the
+// money left.
+func paymentFailed(err error) bool {
+	return IsRetryable(err) ||
+		errors.Is(err, ErrInsufficientFunds) ||
+		errors.Is(err, ErrExecUsage) ||
+		errors.Is(err, ErrExecCancelled)
+}
+
+// reverse credits back a debit whose payment failed
+func (w *BalanceWallet) reverse(debit LedgerEntry, why string) {
+	if _, err := w.apply(EntryReversal, debit.Currency, debit.Amount, debit.OfferID, debit.PaymentContextToken,
+		fmt.Sprintf("%s, reverting entry %d", why, debit.ID)); err != nil {
+		w.logger.Error("failed to revert debit",
+			"error", err,
+			"entry_id", debit.ID,
+		)
+	}
+}
+
+// markPending flags a debit whose payment outcome is unknown
+func (w *BalanceWallet) markPending(id int64, statusURL string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	prev := w.state
+	w.state.History = withPending(prev.History, id, true, statusURL)
+	if err := w.save(); err != nil {
+		w.state = prev
+		return err
+	}
+	return nil
+}
+
+// settle clears the pending flag of a debit, crediting it back in the same
+// write if its payment failed
+func (w *BalanceWallet) settle(debit LedgerEntry, failed bool, why string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	prev := w.state
+	w.state.History = withPending(prev.History, debit.ID, false, debit.StatusURL)
+	if !failed {
+		if err := w.save(); err != nil {
+			w.state = prev
+			return err
+		}
+		return nil
+	}
+	if _, err := w.applyLocked(EntryReversal, debit.Currency, debit.Amount, debit.OfferID, debit.PaymentContextToken,
+		fmt.Sprintf("%s, reverting entry %d", why, debit.ID)); err != nil {
+		w.state = prev
+		return err
+	}
+	return nil
+}
+
+// withPending returns a copy of history with the pending flag of entry id set
+func withPending(history []LedgerEntry, id int64, pending bool, statusURL string) []LedgerEntry {
+	history = append([]LedgerEntry(nil), history...)
+	for i := range history {
+		if history[i].ID == id {
+			history[i].Pending = pending
+			history[i].StatusURL = statusURL
+		}
+	}
+	return history
+}
+
+// Pending returns the debits whose payment outcome is unknown
+func (w *BalanceWallet) Pending() []LedgerEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var pending []LedgerEntry
+	for _, e := range w.state.History {
+		if e.Pending {
+			pending = append(pending, e)
+		}
+	}
+	return pending
+}
+
+// SettlePending asks the gateway how the payments of pending debits ended.
+// Debits of paid payments are kept, those of failed or expired ones are
+// credited back. Payments still in progress, or whose status can't be
+// fetched, stay pending.
+func (w *BalanceWallet) SettlePending(ctx context.Context, client *http.Client) error {
+	var errs []error
+	for _, debit := range w.Pending() {
+		if debit.StatusURL == "" {
+			continue
+		}
+		status, err := l402.GetPaymentStatus(ctx, client, debit.StatusURL, "", 0)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("entry %d: %w", debit.ID, err))
+			continue
+		}
+
+		var failed bool
+		switch status.Status {
+		case l402.PaymentStatusPaid, l402.PaymentStatusPartiallyRefunded, l402.PaymentStatusRefunded:
+			// Refunds are credited on their own
+		case l402.PaymentStatusFailed, l402.PaymentStatusExpired:
+			failed = true
+		default:
+			continue
+		}
+		if err := w.settle(debit, failed, "payment "+status.Status); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		w.logger.Info("pending debit settled",
+			"entry_id", debit.ID,
+			"payment_context", debit.PaymentContextToken,
+			"status", status.Status,
+		)
+	}
+	return errors.Join(errs...)
+}
+
+func (w *BalanceWallet) debit(currency string, amount int64, offerID, paymentContext string) (LedgerEntry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if available := w.state.Balances[currency]; available < amount {
+		return LedgerEntry{}, &InsufficientFundsError{
+			Currency:  currency,
+			Needed:    amount,
+			Available: available,
+		}
+	}
+	return w.applyLocked(EntryDebit, currency, amount, offerID, paymentContext, "")
+}
+
+// Credit adds funds to the wallet
+func (w *BalanceWallet) Credit(currency string, amount int64, reference string) error {
+	_, err := w.apply(EntryCredit, currency, amount, "", "", reference)
+	return err
+}
+
+// Refund credits back a payment refunded by a merchant
+func (w *BalanceWallet) Refund(currency string, amount int64, paymentContext, reference string) error {
+	_, err := w.apply(EntryRefund, currency, amount, "", paymentContext, reference)
+	return err
+}
+
+// Balance returns the available balance of a currency
+func (w *BalanceWallet) Balance(currency string) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state.Balances[strings.ToUpper(currency)]
+}
+
+// Balances returns the available balance of every currency
+func (w *BalanceWallet) Balances() map[string]int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	balances := make(map[string]int64, len(w.state.Balances))
+	for c, b := range w.state.Balances {
+		balances[c] = b
+	}
+	return balances
+}
+
+// History returns every balance movement, oldest first
+func (w *BalanceWallet) History() []LedgerEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]LedgerEntry(nil), w.state.History...)
+}
+
+func (w *BalanceWallet) apply(typ EntryType, currency string, amount int64, offerID, paymentContext, reference string) (LedgerEntry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.applyLocked(typ, strings.ToUpper(currency), amount, offerID, paymentContext, reference)
+}
+
+func (w *BalanceWallet) applyLocked(typ EntryType, currency string, amount int64, offerID, paymentContext, reference string) (LedgerEntry, error) {
+	if amount <= 0 {
+		return LedgerEntry{}, fmt.Errorf("invalid amount %d", amount)
+	}
+
+	delta := amount
+	if typ == EntryDebit {
+		delta = -amount
+	}
+
+	prev := w.state
+	balances := make(map[string]int64, len(prev.Balances)+1)
+	for c, b := range prev.Balances {
+		balances[c] = b
+	}
+	balances[currency] += delta
+
+	entry := LedgerEntry{
+		ID:                  prev.NextID,
+		Time:                time.Now().UTC(),
+		Type:                typ,
+		Currency:            currency,
+		Amount:              amount,
+		Balance:             balances[currency],
+		OfferID:             offerID,
+		PaymentContextToken: paymentContext,
+		Reference:           reference,
+	}
+
+	w.state = balanceState{
+		Balances: balances,
+		History:  append(prev.History, entry),
+		NextID:   prev.NextID + 1,
+	}
+
+	// Only keep the change if it made it to disk
+	if err := w.save(); err != nil {
+		w.state = prev
+		return LedgerEntry{}, err
+	}
+
+	w.logger.Info("balance updated",
+		"type", typ,
+		"currency", currency,
+		"amount", amount,
+		"balance", entry.Balance,
+	)
+	return entry, nil
+}
+
+// save writes the state to a temporary file and renames it over the old one
+// so a crash never leaves a half written balance.
+func (w *BalanceWallet) save() error {
+	if w.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(w.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save balance: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save balance: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save balance: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save balance: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		return fmt.Errorf("failed to save balance: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// stubWallet pays every offer with a fixed settlement status
+type stubWallet struct {
+	status l402.SettlementStatus
+}
+
+func (w stubWallet) Pay(response *l402.L402Response) error {
+	return nil
+}
+
+func (w stubWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	return &l402.PaymentResult{
+		OfferID:             "offer_1",
+		PaymentContextToken: response.PaymentContextToken,
+		Status:              w.status,
+	}, nil
+}
+
+// statusServer answers payment status requests with status
+func statusServer(t *testing.T, status string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(l402.PaymentStatus{
+			PaymentContextToken: "ctx_1",
+			Status:              status,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestBalance(t *testing.T, status l402.SettlementStatus) *BalanceWallet {
+	t.Helper()
+	w, err := NewBalanceWallet("", "offer_1", stubWallet{status})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Credit("USD", 100, "test"); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func testResponse(statusURL string) *l402.L402Response {
+	return &l402.L402Response{
+		PaymentContextToken: "ctx_1",
+		PaymentStatusURL:    statusURL,
+		Offers: []l402.Offer{{
+			ID:             "offer_1",
+			Amount:         30,
+			Currency:       "USD",
+			PaymentMethods: []l402.PaymentMethods{l402.FakePay},
+		}},
+	}
+}
+
+func TestBalanceFailedResultIsReversed(t *testing.T) {
+	w := newTestBalance(t, l402.SettlementFailed)
+
+	result, err := w.PayWithProof(context.Background(), testResponse(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != l402.SettlementFailed {
+		t.Errorf("status = %s, want failed", result.Status)
+	}
+	if got := w.Balance("USD"); got != 100 {
+		t.Errorf("balance = %d, want 100", got)
+	}
+	if pending := w.Pending(); len(pending) != 0 {
+		t.Errorf("pending = %v, want none", pending)
+	}
+}
+
+func TestBalanceUnsettledResultStaysPending(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  l402.SettlementStatus
+		outcome string
+		balance int64
+	}{
+		{"pending then expired", l402.SettlementPending, l402.PaymentStatusExpired, 100},
+		{"unknown then failed", l402.SettlementUnknown, l402.PaymentStatusFailed, 100},
+		{"pending then paid", l402.SettlementPending, l402.PaymentStatusPaid, 70},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := statusServer(t, tt.outcome)
+			w := newTestBalance(t, tt.status)
+
+			if _, err := w.PayWithProof(context.Background(), testResponse(srv.URL)); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Balance("USD"); got != 70 {
+				t.Errorf("balance before settling = %d, want 70", got)
+			}
+			pending := w.Pending()
+			if len(pending) != 1 || pending[0].StatusURL != srv.URL {
+				t.Fatalf("pending = %+v, want the debit with status URL %s", pending, srv.URL)
+			}
+
+			if err := w.SettlePending(context.Background(), srv.Client()); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Balance("USD"); got != tt.balance {
+				t.Errorf("balance after settling = %d, want %d", got, tt.balance)
+			}
+			if pending := w.Pending(); len(pending) != 0 {
+				t.Errorf("pending after settling = %v, want none", pending)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// Challenge is a 3-D Secure challenge raised during a card checkout
+type Challenge struct {
+	ChargeID string
+	URL      string
+}
+
+// ChallengeResponder answers a 3-D Secure challenge, e.g. by asking the card
+// holder for the code sent by their bank.
+type ChallengeResponder func(ctx context.Context, challenge Challenge) (string, error)
+
+// StaticChallengeResponder always answers with the same code. Useful with
+// the mock card processor.
+func StaticChallengeResponder(code string) ChallengeResponder {
+	return func(ctx context.Context, challenge Challenge) (string, error) {
+		return code, nil
+	}
+}
+
+// cardCheckoutResponse is what the hosted card checkout returns to JSON
+// clients.
+type cardCheckoutResponse struct {
+	Status       string `json:"status"`
+	ChargeID     string `json:"charge_id"`
+	ChallengeURL string `json:"challenge_url"`
+	Message      string `json:"message"`
+}
+
+// CardWallet pays credit card offers by submitting a tokenized card to the
+// gateway hosted card checkout.
+type CardWallet struct {
+	offerID    string
+	cardToken  string
+	challenge  ChallengeResponder
+	httpClient *http.Client
+	logger     *slog.Logger
+}
+
+// NewCardWallet creates a wallet for a tokenized card. challenge is called
+// when the card issuer asks for 3-D Secure authentication.
+func NewCardWallet(offerID string, cardToken string, challenge ChallengeResponder) *CardWallet {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	// The checkout forms are tied to a cookie, like in a browser
+	jar, _ := cookiejar.New(nil)
+
+	return &CardWallet{
+		offerID:    offerID,
+		cardToken:  cardToken,
+		challenge:  challenge,
+		httpClient: &http.Client{Timeout: 30 * time.Second, Jar: jar},
+		logger:     logger,
+	}
+}
+
+// Pay implements the l402.Wallet interface
+func (w *CardWallet) Pay(response *l402.L402Response) error {
+	_, err := w.PayWithProof(context.Background(), response)
+	return err
+}
+
+// PayWithProof implements the l402.ProofWallet interface
+func (w *CardWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	offer, err := findOffer(response, w.offerID)
+	if err != nil {
+		return nil, err
+	}
+	return w.PayOffer(ctx, response, *offer, l402.CreditCard)
+}
+
+// PaymentMethods implements MethodWallet
+func (w *CardWallet) PaymentMethods() []l402.PaymentMethods {
+	return []l402.PaymentMethods{l402.CreditCard}
+}
+
+// PayOffer implements MethodWallet
+func (w *CardWallet) PayOffer(ctx context.Context, response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods) (*l402.PaymentResult, error) {
+	if method != l402.CreditCard {
+		return nil, unsupportedMethod(method)
+	}
+
+	payResp, err := requestPayment(ctx, response.PaymentRequestURL, l402.PaymentRequestRequest{
+		OfferID:             offer.ID,
+		PaymentMethod:       string(l402.CreditCard),
+		PaymentContextToken: response.PaymentContextToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	checkoutURL := payResp.PaymentRequest.CheckoutURL
+	if _, err := url.Parse(checkoutURL); err != nil || checkoutURL == "" {
+		return nil, errors.New("gateway did not return a valid checkout URL")
+	}
+
+	w.logger.Info("submitting card",
+		"offer_id", offer.ID,
+		"checkout_url", checkoutURL,
+	)
+
+	// Submit the card the same way the hosted form does
+	resp, err := w.submit(ctx, checkoutURL, url.Values{"card_token": {w.cardToken}})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status == "requires_action" {
+		if w.challenge == nil {
+			return nil, errors.New("card requires authentication but no challenge responder is configured")
+		}
+
+		w.logger.Info("card requires authentication",
+			"charge_id", resp.ChargeID,
+		)
+
+		code, err := w.challenge(ctx, Challenge{ChargeID: resp.ChargeID, URL: resp.ChallengeURL})
+		if err != nil {
+			return nil, fmt.Errorf("failed to answer card challenge: %w", err)
+		}
+
+		resp, err = w.submit(ctx, resp.ChallengeURL, url.Values{"code": {code}})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status == "requires_action" {
+			return nil, errors.New("card authentication failed: wrong challenge code")
+		}
+	}
+
+	if resp.Status != "succeeded" {
+		// Another card or payment method may still work
+		return nil, Retryable(fmt.Errorf("card payment %s: %s", resp.Status, resp.Message))
+	}
+
+	w.logger.Info("card payment succeeded",
+		"offer_id", offer.ID,
+		"charge_id", resp.ChargeID,
+	)
+
+	result := newResult(response, offer, l402.CreditCard, l402.SettlementSettled)
+	result.ReceiptID = resp.ChargeID
+	return result, nil
+}
+
+// submit loads a card checkout page and posts its form with fields filled
+// in, like a browser does. Gateways without such a form get the parameters
+// of the page URL posted instead.
+func (w *CardWallet) submit(ctx context.Context, pageURL string, fields url.Values) (*cardCheckoutResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return nil, Retryable(fmt.Errorf("card checkout request failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckoutPage))
+	if err != nil {
+		return nil, Retryable(fmt.Errorf("failed to read card checkout page: %w", err))
+	}
+	if transientStatus(resp.StatusCode) {
+		return nil, Retryable(fmt.Errorf("card checkout failed with status %d", resp.StatusCode))
+	}
+
+	action, values, ok := confirmationForm(page, resp.Request.URL)
+	if !ok {
+		page := *resp.Request.URL
+		action = &page
+		values = action.Query()
+		action.RawQuery = ""
+	}
+	for k, v := range fields {
+		values[k] = v
+	}
+	return w.post(ctx, action.String(), values)
+}
+
+// post submits a form to the card checkout asking for a JSON answer
+func (w *CardWallet) post(ctx context.Context, target string, form url.Values) (*cardCheckoutResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return nil, Retryable(fmt.Errorf("card checkout request failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		err := fmt.Errorf("card checkout failed with status %d", resp.StatusCode)
+		if transientStatus(resp.StatusCode) {
+			return nil, Retryable(err)
+		}
+		return nil, err
+	}
+
+	var out cardCheckoutResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode card checkout response: %w", err)
+	}
+	return &out, nil
+}
@@ -0,0 +1,261 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// maxCheckoutRedirects is how many redirects the headless checkout follows
+const maxCheckoutRedirects = 10
+
+// maxCheckoutPage bounds how much of a checkout page is read
+const maxCheckoutPage = 1 << 20
+
+// CheckoutWallet pays by following the gateway checkout URL without a
+// browser: it loads the checkout page, submits its confirmation form with the
+// cookies it got, follows redirects and checks the final status.
+type CheckoutWallet struct {
+	offerID       string
+	method        l402.PaymentMethods
+	confirmMethod string
+	httpClient    *http.Client
+	logger        *slog.Logger
+}
+
+// NewCheckoutWallet creates a headless checkout wallet for the fake-pay
+// method. confirmMethod is how gateways whose checkout page has no
+// confirmation form are confirmed: GET loads the page, POST posts the
+// checkout parameters.
+func NewCheckoutWallet(offerID string, confirmMethod string) *CheckoutWallet {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	if confirmMethod == "" {
+		confirmMethod = http.MethodGet
+	}
+
+	// The confirmation form is only accepted with the cookies of the page
+	jar, _ := cookiejar.New(nil)
+
+	return &CheckoutWallet{
+		offerID:       offerID,
+		method:        l402.FakePay,
+		confirmMethod: strings.ToUpper(confirmMethod),
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Jar:     jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxCheckoutRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxCheckoutRedirects)
+				}
+				return nil
+			},
+		},
+		logger: logger,
+	}
+}
+
+// Pay implements the l402.Wallet interface
+func (w *CheckoutWallet) Pay(response *l402.L402Response) error {
+	_, err := w.PayWithProof(context.Background(), response)
+	return err
+}
+
+// PayWithProof implements the l402.ProofWallet interface
+func (w *CheckoutWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	offer, err := findOffer(response, w.offerID)
+	if err != nil {
+		return nil, err
+	}
+	return w.PayOffer(ctx, response, *offer, w.method)
+}
+
+// PaymentMethods implements MethodWallet
+func (w *CheckoutWallet) PaymentMethods() []l402.PaymentMethods {
+	return []l402.PaymentMethods{w.method}
+}
+
+// PayOffer implements MethodWallet
+func (w *CheckoutWallet) PayOffer(ctx context.Context, response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods) (*l402.PaymentResult, error) {
+	if method != w.method {
+		return nil, unsupportedMethod(method)
+	}
+
+	payResp, err := requestPayment(ctx, response.PaymentRequestURL, l402.PaymentRequestRequest{
+		OfferID:             offer.ID,
+		PaymentMethod:       string(method),
+		PaymentContextToken: response.PaymentContextToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	checkoutURL := payResp.PaymentRequest.CheckoutURL
+	if checkoutURL == "" {
+		return nil, errors.New("gateway did not return a checkout URL")
+	}
+
+	w.logger.Info("following checkout",
+		"offer_id", offer.ID,
+		"checkout_url", checkoutURL,
+		"method", w.confirmMethod,
+	)
+
+	finalURL, status, err := w.confirm(ctx, checkoutURL)
+	if err != nil {
+		return nil, err
+	}
+
+	w.logger.Info("checkout completed",
+		"offer_id", offer.ID,
+		"final_url", finalURL,
+		"payment_status", status,
+	)
+
+	// Without a status header all we know is that the checkout page loaded
+	settlement := l402.SettlementPending
+	if status == l402.PaymentStatusPaid {
+		settlement = l402.SettlementSettled
+	}
+	return newResult(response, offer, method, settlement), nil
+}
+
+// confirm loads the checkout page and submits its confirmation form, like a
+// browser would. It returns the URL of the page we ended up on and the
+// payment status reported by the gateway, if any.
+func (w *CheckoutWallet) confirm(ctx context.Context, checkoutURL string) (string, string, error) {
+	u, err := url.Parse(checkoutURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid checkout URL: %w", err)
+	}
+	if w.confirmMethod != http.MethodGet && w.confirmMethod != http.MethodPost {
+		return "", "", fmt.Errorf("unsupported confirmation method %s", w.confirmMethod)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", "", err
+	}
+	page, status, body, err := w.do(req)
+	if err != nil || status == l402.PaymentStatusPaid {
+		return page, status, err
+	}
+
+	action, values, ok := confirmationForm(body, req.URL)
+	switch {
+	case ok:
+	case w.confirmMethod == http.MethodPost:
+		// Older gateways confirm with the checkout parameters posted
+		action, values = u, u.Query()
+	default:
+		// Older gateways confirm when the checkout page is loaded
+		return page, status, nil
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, action.String(), strings.NewReader(values.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	page, status, _, err = w.do(req)
+	return page, status, err
+}
+
+// do sends a checkout request, following redirects, and returns the final
+// URL, the payment status reported by the gateway and the page
+func (w *CheckoutWallet) do(req *http.Request) (string, string, []byte, error) {
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return "", "", nil, Retryable(fmt.Errorf("checkout request failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckoutPage))
+	if err != nil {
+		return "", "", nil, Retryable(fmt.Errorf("failed to read checkout page: %w", err))
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("checkout failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body[:min(len(body), 1024)])))
+		if transientStatus(resp.StatusCode) {
+			return "", "", nil, Retryable(err)
+		}
+		return "", "", nil, err
+	}
+
+	// Gateways with a scriptable checkout tell us how it went
+	status := resp.Header.Get(l402.PaymentStatusHeader)
+	if status != "" && status != l402.PaymentStatusPaid {
+		return "", "", nil, fmt.Errorf("checkout finished with payment status %q", status)
+	}
+
+	return resp.Request.URL.String(), status, body, nil
+}
+
+// confirmationForm finds the form of a checkout page posting to the
+// checkout, and returns where it posts and its fields. The checkout may be
+// under a path prefix of the gateway.
+func confirmationForm(page []byte, base *url.URL) (*url.URL, url.Values, bool) {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil, nil, false
+	}
+
+	for form := range doc.Descendants() {
+		if form.Type != html.ElementNode || form.DataAtom != atom.Form {
+			continue
+		}
+		if !strings.EqualFold(attr(form, "method"), http.MethodPost) {
+			continue
+		}
+		action, err := base.Parse(attr(form, "action"))
+		if err != nil {
+			continue
+		}
+		// Older gateways behind a path prefix left it out of the action
+		if action.Path != base.Path {
+			if action.Path == "/" || !strings.HasSuffix(base.Path, action.Path) {
+				continue
+			}
+			action.Path = base.Path
+		}
+
+		values := url.Values{}
+		for input := range form.Descendants() {
+			if input.Type != html.ElementNode || input.DataAtom != atom.Input {
+				continue
+			}
+			if name := attr(input, "name"); name != "" {
+				values.Add(name, attr(input, "value"))
+			}
+		}
+		return action, values, true
+	}
+	return nil, nil, false
+}
+
+// attr returns an attribute of an HTML element
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// DefaultPreference is the order in which a CompositeWallet tries payment
+// methods when none is given.
+var DefaultPreference = []l402.PaymentMethods{
+	l402.Lightning,
+	l402.Onchain,
+	l402.CreditCard,
+	l402.FakePay,
+}
+
+// CompositeWallet holds several wallets and routes a payment to the best
+// payment method the offer allows. If a wallet fails with a retryable error
+// the next wallet, or the next method, is tried.
+type CompositeWallet struct {
+	offerID    string
+	preference []l402.PaymentMethods
+	wallets    []MethodWallet
+	logger     *slog.Logger
+}
+
+// NewCompositeWallet creates a wallet that tries methods in preference order
+// and, for each method, wallets in the order given.
+func NewCompositeWallet(offerID string, preference []l402.PaymentMethods, wallets ...MethodWallet) *CompositeWallet {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	if len(preference) == 0 {
+		preference = DefaultPreference
+	}
+
+	return &CompositeWallet{
+		offerID:    offerID,
+		preference: preference,
+		wallets:    wallets,
+		logger:     logger,
+	}
+}
+
+// Pay implements the l402.Wallet interface
+func (w *CompositeWallet) Pay(response *l402.L402Response) error {
+	_, err := w.PayWithProof(context.Background(), response)
+	return err
+}
+
+// PayWithProof implements the l402.ProofWallet interface
+func (w *CompositeWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	offer, err := findOffer(response, w.offerID)
+	if err != nil {
+		return nil, err
+	}
+
+	supported := w.PaymentMethods()
+
+	var errs []error
+	for _, method := range w.preference {
+		if !slices.Contains(offer.PaymentMethods, method) || !slices.Contains(supported, method) {
+			continue
+		}
+
+		result, err := w.PayOffer(ctx, response, *offer, method)
+		if err == nil {
+			return result, nil
+		}
+		if !IsRetryable(err) {
+			return nil, err
+		}
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no wallet supports the payment methods of offer %s: %v",
+			offer.ID, offer.PaymentMethods)
+	}
+	return nil, fmt.Errorf("no wallet could pay offer %s: %w", offer.ID, errors.Join(errs...))
+}
+
+// PaymentMethods implements MethodWallet, returning the methods supported by
+// any of the wallets.
+func (w *CompositeWallet) PaymentMethods() []l402.PaymentMethods {
+	var methods []l402.PaymentMethods
+	for _, wallet := range w.wallets {
+		for _, m := range wallet.PaymentMethods() {
+			if !slices.Contains(methods, m) {
+				methods = append(methods, m)
+			}
+		}
+	}
+	return methods
+}
+
+// PayOffer implements MethodWallet, trying every wallet supporting method
+// until one succeeds or fails with a non retryable error.
+func (w *CompositeWallet) PayOffer(ctx context.Context, response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods) (*l402.PaymentResult, error) {
+	var errs []error
+	for i, wallet := range w.wallets {
+		if !slices.Contains(wallet.PaymentMethods(), method) {
+			continue
+		}
+
+		w.logger.Info("trying wallet",
+			"offer_id", offer.ID,
+			"payment_method", method,
+			"wallet", fmt.Sprintf("%d:%T", i, wallet),
+		)
+
+		result, err := wallet.PayOffer(ctx, response, offer, method)
+		if err == nil {
+			return result, nil
+		}
+		if !IsRetryable(err) {
+			return nil, err
+		}
+
+		w.logger.Warn("wallet failed, trying next",
+			"offer_id", offer.ID,
+			"payment_method", method,
+			"error", err,
+		)
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return nil, unsupportedMethod(method)
+	}
+	return nil, Retryable(errors.Join(errs...))
+}
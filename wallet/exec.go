@@ -0,0 +1,279 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// ExecProtocolVersion is sent to external wallets so they can refuse inputs
+// they don't understand.
+const ExecProtocolVersion = "1"
+
+// DefaultExecTimeout bounds how long an external wallet may run
+const DefaultExecTimeout = 2 * time.Minute
+
+// Exit codes of external wallets. Any other non zero code is treated like
+// ExitFailed.
+const (
+	ExitOK                = 0
+	ExitFailed            = 1
+	ExitUsage             = 2
+	ExitInsufficientFunds = 3
+	ExitUnsupported       = 4
+	ExitTemporary         = 5
+	ExitCancelled         = 6
+)
+
+var (
+	ErrExecFailed    = errors.New("external wallet failed")
+	ErrExecUsage     = errors.New("external wallet rejected its input")
+	ErrExecCancelled = errors.New("external wallet cancelled the payment")
+	ErrExecTimeout   = errors.New("external wallet timed out")
+	ErrExecProtocol  = errors.New("external wallet returned an invalid result")
+)
+
+// ExecError is returned when an external wallet exits with a non zero code
+// or is killed. It unwraps to the error the exit code maps to.
+type ExecError struct {
+	Command  string
+	ExitCode int
+	Message  string
+	Stderr   string
+	Err      error
+}
+
+func (e *ExecError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = strings.TrimSpace(e.Stderr)
+	}
+	status := fmt.Sprintf("exited with code %d", e.ExitCode)
+	if e.ExitCode < 0 {
+		status = "was killed"
+	}
+	if msg == "" {
+		return fmt.Sprintf("%s: %s %s", e.Err, e.Command, status)
+	}
+	return fmt.Sprintf("%s: %s %s: %s", e.Err, e.Command, status, msg)
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// ExecRequest is written as JSON to the stdin of external wallets
+type ExecRequest struct {
+	Version       string              `json:"version"`
+	L402          *l402.L402Response  `json:"l402"`
+	Offer         l402.Offer          `json:"offer"`
+	PaymentMethod l402.PaymentMethods `json:"payment_method"`
+}
+
+// ExecResponse is read as JSON from the stdout of external wallets. On a non
+// zero exit Error may explain what went wrong, other fields are ignored.
+type ExecResponse struct {
+	Status    l402.SettlementStatus `json:"status"`
+	Preimage  string                `json:"preimage,omitempty"`
+	TxID      string                `json:"txid,omitempty"`
+	ReceiptID string                `json:"receipt_id,omitempty"`
+	Error     string                `json:"error,omitempty"`
+
+	// Set by wallets that couldn't pay for lack of funds
+	Currency  string `json:"currency,omitempty"`
+	Needed    int64  `json:"needed,omitempty"`
+	Available int64  `json:"available,omitempty"`
+}
+
+// ExecWallet delegates payments to an external command, so payment tooling
+// written in other languages can be reused.
+type ExecWallet struct {
+	offerID string
+	command []string
+	methods []l402.PaymentMethods
+	timeout time.Duration
+	logger  *slog.Logger
+}
+
+// NewExecWallet creates a wallet running command (program and arguments) for
+// every payment with one of methods. A zero timeout uses DefaultExecTimeout.
+func NewExecWallet(offerID string, command []string, methods []l402.PaymentMethods, timeout time.Duration) *ExecWallet {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+
+	return &ExecWallet{
+		offerID: offerID,
+		command: command,
+		methods: methods,
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+// Pay implements the l402.Wallet interface
+func (w *ExecWallet) Pay(response *l402.L402Response) error {
+	_, err := w.PayWithProof(context.Background(), response)
+	return err
+}
+
+// PayWithProof implements the l402.ProofWallet interface, paying with the
+// first configured method the offer accepts
+func (w *ExecWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	offer, err := findOffer(response, w.offerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range w.methods {
+		if slices.Contains(offer.PaymentMethods, m) {
+			return w.PayOffer(ctx, response, *offer, m)
+		}
+	}
+	return nil, fmt.Errorf("offer %s accepts none of %v", offer.ID, w.methods)
+}
+
+// PaymentMethods implements MethodWallet
+func (w *ExecWallet) PaymentMethods() []l402.PaymentMethods {
+	return w.methods
+}
+
+// PayOffer implements MethodWallet
+func (w *ExecWallet) PayOffer(ctx context.Context, response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods) (*l402.PaymentResult, error) {
+	if !slices.Contains(w.methods, method) {
+		return nil, unsupportedMethod(method)
+	}
+	if len(w.command) == 0 {
+		return nil, errors.New("no external wallet command configured")
+	}
+
+	input, err := json.Marshal(ExecRequest{
+		Version:       ExecProtocolVersion,
+		L402:          response,
+		Offer:         offer,
+		PaymentMethod: method,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, w.command[0], w.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't hang on grandchildren keeping the pipes open
+	cmd.WaitDelay = 5 * time.Second
+
+	w.logger.Info("running external wallet",
+		"command", w.command[0],
+		"offer_id", offer.ID,
+		"payment_method", method,
+	)
+
+	start := time.Now()
+	runErr := cmd.Run()
+
+	w.logger.Debug("external wallet exited",
+		"command", w.command[0],
+		"duration", time.Since(start),
+		"error", runErr,
+		"stderr", tail(stderr.String(), 1024),
+	)
+
+	var out ExecResponse
+	decodeErr := json.Unmarshal(bytes.TrimSpace(stdout.Bytes()), &out)
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, &ExecError{
+			Command:  w.command[0],
+			ExitCode: -1,
+			Message:  fmt.Sprintf("no result after %s", w.timeout),
+			Err:      ErrExecTimeout,
+		}
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(runErr, &exitErr) {
+		return nil, w.exitError(exitErr.ExitCode(), out, stderr.String())
+	}
+	if runErr != nil {
+		return nil, fmt.Errorf("failed to run external wallet: %w", runErr)
+	}
+
+	if decodeErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExecProtocol, decodeErr)
+	}
+	switch out.Status {
+	case l402.SettlementSettled, l402.SettlementPending, l402.SettlementUnknown:
+	case l402.SettlementFailed:
+		return nil, fmt.Errorf("%w: %s", ErrExecFailed, out.Error)
+	case "":
+		out.Status = l402.SettlementUnknown
+	default:
+		return nil, fmt.Errorf("%w: unknown status %q", ErrExecProtocol, out.Status)
+	}
+
+	result := newResult(response, offer, method, out.Status)
+	result.Preimage = out.Preimage
+	result.TxID = out.TxID
+	result.ReceiptID = out.ReceiptID
+	return result, nil
+}
+
+// exitError maps the exit code of an external wallet to a typed error
+func (w *ExecWallet) exitError(code int, out ExecResponse, stderr string) error {
+	e := &ExecError{
+		Command:  w.command[0],
+		ExitCode: code,
+		Message:  out.Error,
+		Stderr:   tail(stderr, 1024),
+	}
+
+	switch code {
+	case ExitUsage:
+		e.Err = ErrExecUsage
+	case ExitCancelled:
+		e.Err = ErrExecCancelled
+	case ExitInsufficientFunds:
+		e.Err = &InsufficientFundsError{
+			Currency:  out.Currency,
+			Needed:    out.Needed,
+			Available: out.Available,
+		}
+		return Retryable(e)
+	case ExitUnsupported:
+		e.Err = ErrExecFailed
+		return Retryable(e)
+	case ExitTemporary:
+		e.Err = ErrExecFailed
+		return Retryable(e)
+	default:
+		e.Err = ErrExecFailed
+	}
+	return e
+}
+
+// tail returns at most the last n bytes of s
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[len(s)-n:]
+}
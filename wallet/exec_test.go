@@ -0,0 +1,193 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// execWalletScript is the reference external wallet
+const execWalletScript = "../scripts/exec-wallet.py"
+
+// checkoutGateway fakes the fake-pay checkout of a gateway: a page whose
+// form must be posted back with the CSRF token tied to its cookie. With
+// failing set, payment requests answer 503.
+func checkoutGateway(t *testing.T, failing bool) (*httptest.Server, *bool) {
+	t.Helper()
+	paid := new(bool)
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("POST /payment-request", func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"payment_request":{"check_url":%q}}`, srv.URL+"/checkout?payment_context_token=ctx_1&offer_id=offer_1")
+	})
+	mux.HandleFunc("GET /checkout", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "csrf", Value: "secret"})
+		fmt.Fprint(w, `<html><body><form method="POST" action="/checkout">
+			<input type="hidden" name="payment_context_token" value="ctx_1">
+			<input type="hidden" name="offer_id" value="offer_1">
+			<input type="hidden" name="csrf_token" value="secret">
+			<button type="submit">Pay</button>
+		</form></body></html>`)
+	})
+	mux.HandleFunc("POST /checkout", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("csrf")
+		if err != nil || cookie.Value != r.FormValue("csrf_token") || r.FormValue("payment_context_token") != "ctx_1" {
+			http.Error(w, "invalid or missing CSRF token", http.StatusForbidden)
+			return
+		}
+		*paid = true
+		w.Header().Set(l402.PaymentStatusHeader, l402.PaymentStatusPaid)
+		fmt.Fprint(w, "paid")
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, paid
+}
+
+func execResponse(gatewayURL string) *l402.L402Response {
+	return &l402.L402Response{
+		PaymentRequestURL:   gatewayURL + "/payment-request",
+		PaymentContextToken: "ctx_1",
+		Offers: []l402.Offer{{
+			ID:             "offer_1",
+			Amount:         10,
+			Currency:       "USD",
+			PaymentMethods: []l402.PaymentMethods{l402.FakePay, l402.Onchain},
+		}},
+	}
+}
+
+func TestExecWalletScript(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not found")
+	}
+
+	tests := []struct {
+		name      string
+		scenario  string
+		method    l402.PaymentMethods
+		failing   bool
+		timeout   time.Duration
+		retryable bool
+		check     func(t *testing.T, err error)
+	}{
+		{
+			name:   "paid",
+			method: l402.FakePay,
+		},
+		{
+			name:      "insufficient funds",
+			scenario:  "insufficient",
+			method:    l402.FakePay,
+			retryable: true,
+			check: func(t *testing.T, err error) {
+				var funds *InsufficientFundsError
+				if !errors.As(err, &funds) || funds.Needed != 10 || funds.Currency != "USD" {
+					t.Errorf("error = %v, want insufficient funds for 10 USD", err)
+				}
+			},
+		},
+		{
+			name:      "unsupported method",
+			method:    l402.Onchain,
+			retryable: true,
+			check:     exitCode(ExitUnsupported, ErrExecFailed),
+		},
+		{
+			name:      "gateway 5xx",
+			method:    l402.FakePay,
+			failing:   true,
+			retryable: true,
+			check:     exitCode(ExitTemporary, ErrExecFailed),
+		},
+		{
+			name:     "cancelled",
+			scenario: "cancel",
+			method:   l402.FakePay,
+			check:    exitCode(ExitCancelled, ErrExecCancelled),
+		},
+		{
+			name:     "timeout",
+			scenario: "sleep",
+			method:   l402.FakePay,
+			timeout:  500 * time.Millisecond,
+			check: func(t *testing.T, err error) {
+				if !errors.Is(err, ErrExecTimeout) {
+					t.Errorf("error = %v, want %v", err, ErrExecTimeout)
+				}
+			},
+		},
+		{
+			name:     "unparsable stdout",
+			scenario: "garbage",
+			method:   l402.FakePay,
+			check: func(t *testing.T, err error) {
+				if !errors.Is(err, ErrExecProtocol) {
+					t.Errorf("error = %v, want %v", err, ErrExecProtocol)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("EXEC_WALLET_SCENARIO", tt.scenario)
+			srv, paid := checkoutGateway(t, tt.failing)
+			response := execResponse(srv.URL)
+
+			w := NewExecWallet("offer_1", []string{"python3", execWalletScript},
+				[]l402.PaymentMethods{l402.FakePay, l402.Onchain}, tt.timeout)
+			start := time.Now()
+			result, err := w.PayOffer(context.Background(), response, response.Offers[0], tt.method)
+
+			if tt.check == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Status != l402.SettlementSettled || !*paid {
+					t.Errorf("status = %s, paid = %v, want a settled payment", result.Status, *paid)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("got %+v, want an error", result)
+			}
+			if IsRetryable(err) != tt.retryable {
+				t.Errorf("retryable = %v, want %v: %v", IsRetryable(err), tt.retryable, err)
+			}
+			if *paid {
+				t.Error("payment made despite the error")
+			}
+			if tt.timeout > 0 && time.Since(start) > 10*time.Second {
+				t.Errorf("wallet killed after %s, want about %s", time.Since(start), tt.timeout)
+			}
+			tt.check(t, err)
+		})
+	}
+}
+
+// exitCode checks an error comes from an external wallet exiting with code,
+// mapped to target
+func exitCode(code int, target error) func(t *testing.T, err error) {
+	return func(t *testing.T, err error) {
+		t.Helper()
+		var execErr *ExecError
+		if !errors.As(err, &execErr) || execErr.ExitCode != code {
+			t.Errorf("error = %v, want exit code %d", err, code)
+		}
+		if !errors.Is(err, target) {
+			t.Errorf("error = %v, want %v", err, target)
+		}
+	}
+}
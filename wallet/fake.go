@@ -1,47 +1,60 @@
 package wallet
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"log/slog"
-	"net/http"
 	"os"
 
+	"github.com/l402-protocol/go-example/bolt11"
 	"github.com/l402-protocol/go-example/l402"
 )
 
 // FakeWallet can be used to simulate a payment.
 type FakeWallet struct {
-	offerID string
-	logger  *slog.Logger
+	offerID  string
+	invoices *InvoiceVerifier
+	logger   *slog.Logger
 }
 
-// NewFakeWallet creates a new fake wallet
-func NewFakeWallet(offerID string) *FakeWallet {
+// NewFakeWallet creates a new fake wallet. Lightning invoices handed out
+// with the checkout must be for network.
+func NewFakeWallet(offerID string, network bolt11.Network) *FakeWallet {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	}))
 
 	return &FakeWallet{
-		offerID: offerID,
-		logger:  logger,
+		offerID:  offerID,
+		invoices: NewInvoiceVerifier(network, DefaultExchangeRates),
+		logger:   logger,
 	}
 }
 
 // Pay simulates a payment by making the payment request
 func (w *FakeWallet) Pay(response *l402.L402Response) error {
-	var offer *l402.Offer
-	for _, o := range response.Offers {
-		if o.ID == w.offerID {
-			offer = &o
-			break
-		}
+	_, err := w.PayWithProof(context.Background(), response)
+	return err
+}
+
+// PayWithProof implements the l402.ProofWallet interface
+func (w *FakeWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	offer, err := findOffer(response, w.offerID)
+	if err != nil {
+		return nil, err
 	}
+	return w.PayOffer(ctx, response, *offer, l402.FakePay)
+}
 
-	if offer == nil {
-		return fmt.Errorf("offer %s not found", w.offerID)
+// PaymentMethods implements MethodWallet
+func (w *FakeWallet) PaymentMethods() []l402.PaymentMethods {
+	return []l402.PaymentMethods{l402.FakePay}
+}
+
+// PayOffer implements MethodWallet
+func (w *FakeWallet) PayOffer(ctx context.Context, response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods) (*l402.PaymentResult, error) {
+	if method != l402.FakePay {
+		return nil, unsupportedMethod(method)
 	}
 
 	w.logger.Info("processing payment",
@@ -58,27 +71,9 @@ func (w *FakeWallet) Pay(response *l402.L402Response) error {
 		PaymentContextToken: response.PaymentContextToken,
 	}
 
-	body, err := json.Marshal(payReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal payment request: %w", err)
-	}
-
-	// Make payment request to gateway
-	resp, err := http.Post(response.PaymentRequestURL, "application/json", bytes.NewBuffer(body))
+	payResp, err := requestPayment(ctx, response.PaymentRequestURL, payReq)
 	if err != nil {
-		return fmt.Errorf("failed to make payment request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("payment request failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	// Parse payment request response
-	var payResp l402.PaymentRequestResponse
-	if err := json.NewDecoder(resp.Body).Decode(&payResp); err != nil {
-		return fmt.Errorf("failed to decode payment response: %w", err)
+		return nil, err
 	}
 
 	w.logger.Info("received payment request response",
@@ -86,6 +81,15 @@ func (w *FakeWallet) Pay(response *l402.L402Response) error {
 		"expires_at", payResp.ExpiresAt,
 	)
 
-	fmt.Printf("\nTo complete the payment, visit:\n%s\n", payResp.PaymentRequest.CheckoutURL)
-	return nil
+	// Never pay an invoice that doesn't match what we picked
+	if invoice := payResp.PaymentRequest.LightningInvoice; invoice != "" {
+		if _, err := w.invoices.Verify(invoice, offer); err != nil {
+			return nil, fmt.Errorf("refusing lightning invoice: %w", err)
+		}
+	}
+
+	fmt.Printf("\nTo complete the payment, visit and confirm:\n%s\n", payResp.PaymentRequest.CheckoutURL)
+
+	// Settles once someone confirms the checkout
+	return newResult(response, offer, l402.FakePay, l402.SettlementPending), nil
 }
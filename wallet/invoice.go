@@ -0,0 +1,120 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/l402-protocol/go-example/bolt11"
+	"github.com/l402-protocol/go-example/l402"
+)
+
+var (
+	ErrInvoiceNetwork = errors.New("invoice network mismatch")
+	ErrInvoiceAmount  = errors.New("invoice amount mismatch")
+	ErrInvoiceExpired = errors.New("invoice expired")
+)
+
+// ExchangeRates converts offer amounts into millisatoshis. Each entry is the
+// number of millisatoshis in the smallest unit of a currency.
+type ExchangeRates map[string]int64
+
+// DefaultExchangeRates only knows about bitcoin denominated offers, whose
+// amounts are expressed in satoshis.
+var DefaultExchangeRates = ExchangeRates{
+	"BTC": 1000,
+	"SAT": 1000,
+}
+
+// ParseExchangeRates parses comma separated CURRENCY:MSAT rates, e.g.
+// "USD:20000,EUR:22000", on top of DefaultExchangeRates
+func ParseExchangeRates(list string) (ExchangeRates, error) {
+	rates := maps.Clone(DefaultExchangeRates)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		currency, value, ok := strings.Cut(entry, ":")
+		msat, err := strconv.ParseInt(value, 10, 64)
+		if !ok || currency == "" || err != nil || msat <= 0 {
+			return nil, fmt.Errorf("invalid exchange rate %q, expected CURRENCY:MSAT", entry)
+		}
+		rates[strings.ToUpper(currency)] = msat
+	}
+	return rates, nil
+}
+
+// ToMsat converts an amount in the smallest unit of currency to millisatoshis.
+func (r ExchangeRates) ToMsat(amount int, currency string) (int64, error) {
+	rate, ok := r[strings.ToUpper(currency)]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", currency)
+	}
+	return int64(amount) * rate, nil
+}
+
+// InvoiceVerifier checks that a BOLT11 invoice handed out by a gateway
+// matches the offer the wallet selected before anything is paid.
+type InvoiceVerifier struct {
+	// Network the wallet pays on.
+	Network bolt11.Network
+	// Rates used to convert the offer amount.
+	Rates ExchangeRates
+	// MinTimeLeft is how long the invoice must remain valid for the payment
+	// to have a chance to go through.
+	MinTimeLeft time.Duration
+	// Now returns the current time, it defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewInvoiceVerifier creates a verifier for the given network and rates
+func NewInvoiceVerifier(network bolt11.Network, rates ExchangeRates) *InvoiceVerifier {
+	return &InvoiceVerifier{
+		Network:     network,
+		Rates:       rates,
+		MinTimeLeft: 10 * time.Second,
+		Now:         time.Now,
+	}
+}
+
+// Verify decodes the invoice and returns an error if its network, amount or
+// expiry don't match the offer.
+func (v *InvoiceVerifier) Verify(invoice string, offer l402.Offer) (*bolt11.Invoice, error) {
+	if !slices.Contains(offer.PaymentMethods, l402.Lightning) {
+		return nil, fmt.Errorf("offer %s does not accept lightning payments", offer.ID)
+	}
+
+	inv, err := bolt11.Decode(invoice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode invoice: %w", err)
+	}
+
+	if inv.Network != v.Network {
+		return nil, fmt.Errorf("%w: invoice is for %s, wallet is on %s",
+			ErrInvoiceNetwork, inv.Network, v.Network)
+	}
+
+	expected, err := v.Rates.ToMsat(offer.Amount, offer.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if inv.AmountMsat != expected {
+		return nil, fmt.Errorf("%w: invoice asks for %d msat, offer %s costs %d msat",
+			ErrInvoiceAmount, inv.AmountMsat, offer.ID, expected)
+	}
+
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	if inv.Expired(now().Add(v.MinTimeLeft)) {
+		return nil, fmt.Errorf("%w: invoice expired at %s",
+			ErrInvoiceExpired, inv.ExpiresAt().Format(time.RFC3339))
+	}
+
+	return inv, nil
+}
@@ -0,0 +1,62 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/l402-protocol/go-example/bolt11"
+	"github.com/l402-protocol/go-example/chain"
+)
+
+// Names under which wallet secrets are stored in a keystore by default
+const (
+	SecretNWC         = "nwc_uri"
+	SecretCardToken   = "card_token"
+	SecretOnchainSeed = "onchain_seed"
+)
+
+// SecretStore is where wallets load their secrets from, see
+// keystore.Keystore.
+type SecretStore interface {
+	Get(name string) ([]byte, error)
+}
+
+// NewNWCWalletFromKeystore creates a NWC wallet from the connection URI
+// stored under name
+func NewNWCWalletFromKeystore(store SecretStore, name string, offerID string, network bolt11.Network, rates ExchangeRates) (*NWCWallet, error) {
+	uri, err := loadSecret(store, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewNWCWallet(offerID, string(uri), network, rates)
+}
+
+// NewCardWalletFromKeystore creates a card wallet from the card token stored
+// under name
+func NewCardWalletFromKeystore(store SecretStore, name string, offerID string, challenge ChallengeResponder) (*CardWallet, error) {
+	token, err := loadSecret(store, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewCardWallet(offerID, string(token), challenge), nil
+}
+
+// NewOnchainWalletFromKeystore creates an on-chain wallet whose address is
+// derived from the seed stored under name
+func NewOnchainWalletFromKeystore(store SecretStore, name string, offerID string, node chain.Node) (*OnchainWallet, error) {
+	seed, err := loadSecret(store, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewOnchainWallet(offerID, node, chain.DeriveAddress(seed, "wallet")), nil
+}
+
+func loadSecret(store SecretStore, name string) ([]byte, error) {
+	secret, err := store.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load wallet secret %s: %w", name, err)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("wallet secret %s is empty", name)
+	}
+	return secret, nil
+}
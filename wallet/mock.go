@@ -2,6 +2,7 @@ package wallet
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/l402-protocol/go-example/l402"
 )
@@ -17,13 +18,8 @@ func NewMockWallet() *MockWallet {
 // Pay implements the l402.Wallet interface but only logs the request and returns an error
 func (w *MockWallet) Pay(response *l402.L402Response) error {
 	fmt.Printf("Available offers:\n")
-	for _, offer := range response.Offers {
-		fmt.Printf("  Offer ID: %s\n", offer.ID)
-		fmt.Printf("  Title: %s\n", offer.Title)
-		fmt.Printf("  Price: $%.2f %s\n", float64(offer.Amount)/100, offer.Currency)
-		fmt.Printf("  SupportedPayment Methods: %v\n", offer.PaymentMethods)
-		fmt.Printf(" --------\n\n")
-	}
+	PrintOffers(os.Stdout, response.Offers)
+	fmt.Println()
 
-	return fmt.Errorf("mock wallet cannot process payments, run client with --fake to simulate a payment")
+	return fmt.Errorf("mock wallet cannot process payments, run client with --fake to simulate a payment or --pick to choose an offer")
 }
@@ -0,0 +1,147 @@
+package wallet
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/l402-protocol/go-example/bolt11"
+	"github.com/l402-protocol/go-example/l402"
+	"github.com/l402-protocol/go-example/nwc"
+)
+
+// NWCWallet pays lightning invoices through a Nostr Wallet Connect (NIP-47)
+// wallet service.
+type NWCWallet struct {
+	offerID  string
+	client   *nwc.Client
+	invoices *InvoiceVerifier
+	logger   *slog.Logger
+}
+
+// NewNWCWallet creates a wallet from a nostr+walletconnect:// URI. Invoices
+// are checked against network and rates before being paid.
+func NewNWCWallet(offerID string, uri string, network bolt11.Network, rates ExchangeRates) (*NWCWallet, error) {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	conn, err := nwc.ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := nwc.NewClient(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NWCWallet{
+		offerID:  offerID,
+		client:   client,
+		invoices: NewInvoiceVerifier(network, rates),
+		logger:   logger,
+	}, nil
+}
+
+// Balance returns the balance of the remote wallet in msat
+func (w *NWCWallet) Balance(ctx context.Context) (int64, error) {
+	return w.client.GetBalance(ctx)
+}
+
+// Close closes the relay connection
+func (w *NWCWallet) Close() error {
+	return w.client.Close()
+}
+
+// Pay implements the l402.Wallet interface
+func (w *NWCWallet) Pay(response *l402.L402Response) error {
+	_, err := w.PayWithProof(context.Background(), response)
+	return err
+}
+
+// PayWithProof implements the l402.ProofWallet interface
+func (w *NWCWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	offer, err := findOffer(response, w.offerID)
+	if err != nil {
+		return nil, err
+	}
+	return w.PayOffer(ctx, response, *offer, l402.Lightning)
+}
+
+// PaymentMethods implements MethodWallet
+func (w *NWCWallet) PaymentMethods() []l402.PaymentMethods {
+	return []l402.PaymentMethods{l402.Lightning}
+}
+
+// PayOffer implements MethodWallet
+func (w *NWCWallet) PayOffer(ctx context.Context, response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods) (*l402.PaymentResult, error) {
+	if method != l402.Lightning {
+		return nil, unsupportedMethod(method)
+	}
+
+	payResp, err := requestPayment(ctx, response.PaymentRequestURL, l402.PaymentRequestRequest{
+		OfferID:             offer.ID,
+		PaymentMethod:       string(l402.Lightning),
+		PaymentContextToken: response.PaymentContextToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invoice := payResp.PaymentRequest.LightningInvoice
+	if invoice == "" {
+		return nil, errors.New("gateway did not return a lightning invoice")
+	}
+
+	inv, err := w.invoices.Verify(invoice, offer)
+	if err != nil {
+		return nil, fmt.Errorf("refusing lightning invoice: %w", err)
+	}
+
+	// Check the balance first so the client gets a clear error
+	balance, err := w.client.GetBalance(ctx)
+	if err != nil {
+		return nil, Retryable(fmt.Errorf("failed to get nwc balance: %w", err))
+	}
+	if balance < inv.AmountMsat {
+		return nil, Retryable(&InsufficientFundsError{
+			Currency:  "MSAT",
+			Needed:    inv.AmountMsat,
+			Available: balance,
+		})
+	}
+
+	w.logger.Info("paying invoice via nwc",
+		"offer_id", offer.ID,
+		"amount_msat", inv.AmountMsat,
+		"payment_hash", hex.EncodeToString(inv.PaymentHash[:]),
+	)
+
+	res, err := w.client.PayInvoice(ctx, invoice)
+	switch {
+	case nwc.IsCode(err, nwc.CodeInsufficientBalance):
+		return nil, Retryable(&InsufficientFundsError{Currency: "MSAT", Needed: inv.AmountMsat})
+	case nwc.IsCode(err, nwc.CodeRateLimited), nwc.IsCode(err, nwc.CodeInternal):
+		return nil, Retryable(err)
+	case err != nil:
+		return nil, fmt.Errorf("nwc payment failed: %w", err)
+	}
+
+	preimage, err := hex.DecodeString(res.Preimage)
+	if err != nil || sha256.Sum256(preimage) != inv.PaymentHash {
+		return nil, errors.New("wallet service returned a preimage that doesn't match the invoice")
+	}
+
+	w.logger.Info("invoice paid via nwc",
+		"offer_id", offer.ID,
+		"fees_msat", res.FeesPaid,
+	)
+
+	result := newResult(response, offer, l402.Lightning, l402.SettlementSettled)
+	result.Preimage = res.Preimage
+	return result, nil
+}
@@ -0,0 +1,155 @@
+package wallet
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/l402-protocol/go-example/chain"
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// OnchainWallet pays offers by sending coins on the simulated chain.
+type OnchainWallet struct {
+	offerID string
+	node    chain.Node
+	address string
+	logger  *slog.Logger
+}
+
+// NewOnchainWallet creates a wallet that spends the coins held by address
+func NewOnchainWallet(offerID string, node chain.Node, address string) *OnchainWallet {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	return &OnchainWallet{
+		offerID: offerID,
+		node:    node,
+		address: address,
+		logger:  logger,
+	}
+}
+
+// Address returns the address the wallet spends from
+func (w *OnchainWallet) Address() string {
+	return w.address
+}
+
+// Pay requests an on-chain address from the gateway and funds it
+func (w *OnchainWallet) Pay(response *l402.L402Response) error {
+	_, err := w.PayWithProof(context.Background(), response)
+	return err
+}
+
+// PayWithProof implements the l402.ProofWallet interface
+func (w *OnchainWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	offer, err := findOffer(response, w.offerID)
+	if err != nil {
+		return nil, err
+	}
+	return w.PayOffer(ctx, response, *offer, l402.Onchain)
+}
+
+// PaymentMethods implements MethodWallet
+func (w *OnchainWallet) PaymentMethods() []l402.PaymentMethods {
+	return []l402.PaymentMethods{l402.Onchain}
+}
+
+// PayOffer implements MethodWallet
+func (w *OnchainWallet) PayOffer(ctx context.Context, response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods) (*l402.PaymentResult, error) {
+	if method != l402.Onchain {
+		return nil, unsupportedMethod(method)
+	}
+	if !slices.Contains(offer.PaymentMethods, l402.Onchain) {
+		return nil, fmt.Errorf("offer %s does not accept on-chain payments", offer.ID)
+	}
+
+	info, err := w.node.Info(ctx)
+	if err != nil {
+		return nil, Retryable(fmt.Errorf("failed to get chain info: %w", err))
+	}
+
+	payResp, err := requestPayment(ctx, response.PaymentRequestURL, l402.PaymentRequestRequest{
+		OfferID:             offer.ID,
+		PaymentMethod:       string(l402.Onchain),
+		PaymentContextToken: response.PaymentContextToken,
+		Chain:               info.Chain,
+		Asset:               offer.Currency,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pr := payResp.PaymentRequest
+	if pr.Address == "" {
+		return nil, fmt.Errorf("gateway did not return an address")
+	}
+	if pr.Chain != info.Chain || pr.Asset != offer.Currency {
+		return nil, fmt.Errorf("gateway asked for %s on %s, expected %s on %s",
+			pr.Asset, pr.Chain, offer.Currency, info.Chain)
+	}
+
+	w.logger.Info("paying on-chain",
+		"offer_id", offer.ID,
+		"address", pr.Address,
+		"asset", pr.Asset,
+		"amount", offer.Amount,
+		"expires_at", payResp.ExpiresAt,
+	)
+
+	txid, err := w.send(ctx, pr.Address, pr.Asset, int64(offer.Amount))
+	if err != nil {
+		return nil, err
+	}
+
+	w.logger.Info("on-chain payment broadcast",
+		"offer_id", offer.ID,
+		"txid", txid,
+	)
+
+	// Settles once the gateway sees enough confirmations
+	result := newResult(response, offer, l402.Onchain, l402.SettlementPending)
+	result.TxID = txid
+	return result, nil
+}
+
+// send builds a transaction paying amount of asset to address, returning
+// any change to the wallet address.
+func (w *OnchainWallet) send(ctx context.Context, to, asset string, amount int64) (string, error) {
+	utxos, err := w.node.UTXOs(ctx, w.address)
+	if err != nil {
+		return "", fmt.Errorf("failed to list utxos: %w", err)
+	}
+
+	var (
+		tx    chain.Tx
+		total int64
+	)
+	for _, u := range utxos {
+		if u.Asset != asset {
+			continue
+		}
+		tx.Inputs = append(tx.Inputs, u.OutPoint)
+		total += u.Amount
+		if total >= amount {
+			break
+		}
+	}
+	if total < amount {
+		return "", Retryable(fmt.Errorf("insufficient %s balance: have %d, need %d", asset, total, amount))
+	}
+
+	tx.Outputs = append(tx.Outputs, chain.TxOut{Address: to, Asset: asset, Amount: amount})
+	if change := total - amount; change > 0 {
+		tx.Outputs = append(tx.Outputs, chain.TxOut{Address: w.address, Asset: asset, Amount: change})
+	}
+
+	txid, err := w.node.Submit(ctx, &tx)
+	if err != nil {
+		return "", fmt.Errorf("failed to broadcast transaction: %w", err)
+	}
+	return txid, nil
+}
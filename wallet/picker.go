@@ -0,0 +1,290 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/l402-protocol/go-example/l402"
+	"golang.org/x/term"
+)
+
+// ErrPickerCancelled is returned when the user leaves the picker without
+// choosing anything.
+var ErrPickerCancelled = errors.New("payment cancelled by user")
+
+// PickerWallet lets the user choose an offer and a payment method in the
+// terminal and hands the payment off to another wallet.
+type PickerWallet struct {
+	payer  MethodWallet
+	in     *os.File
+	out    io.Writer
+	logger *slog.Logger
+}
+
+// NewPickerWallet creates an interactive wallet paying through payer. When
+// stdin is not a terminal it falls back to numbered prompts.
+func NewPickerWallet(payer MethodWallet) *PickerWallet {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	return &PickerWallet{
+		payer:  payer,
+		in:     os.Stdin,
+		out:    os.Stdout,
+		logger: logger,
+	}
+}
+
+// Pay implements the l402.Wallet interface
+func (w *PickerWallet) Pay(response *l402.L402Response) error {
+	_, err := w.PayWithProof(context.Background(), response)
+	return err
+}
+
+// PayWithProof implements the l402.ProofWallet interface
+func (w *PickerWallet) PayWithProof(ctx context.Context, response *l402.L402Response) (*l402.PaymentResult, error) {
+	if len(response.Offers) == 0 {
+		return nil, errors.New("no offers to choose from")
+	}
+
+	header, rows := offerTable(response.Offers)
+	i, err := w.choose("Choose an offer", header, rows, nil)
+	if err != nil {
+		return nil, err
+	}
+	offer := response.Offers[i]
+
+	// Only methods the payer can handle can be picked
+	var supported []l402.PaymentMethods
+	if w.payer != nil {
+		supported = w.payer.PaymentMethods()
+	}
+	labels := make([]string, len(offer.PaymentMethods))
+	disabled := make([]bool, len(offer.PaymentMethods))
+	available := 0
+	for j, m := range offer.PaymentMethods {
+		labels[j] = string(m)
+		if !slices.Contains(supported, m) {
+			labels[j] += " (no wallet configured)"
+			disabled[j] = true
+			continue
+		}
+		available++
+	}
+	if available == 0 {
+		return nil, fmt.Errorf("no configured wallet can pay offer %s, it accepts %v", offer.ID, offer.PaymentMethods)
+	}
+
+	title := fmt.Sprintf("Pay %s for %q with", l402.FormatPrice(offer.Amount, offer.Currency), offer.Title)
+	if response.TermsURL != "" {
+		title += fmt.Sprintf(" (terms: %s)", response.TermsURL)
+	}
+	j, err := w.choose(title, "", labels, disabled)
+	if err != nil {
+		return nil, err
+	}
+	method := offer.PaymentMethods[j]
+
+	w.logger.Info("offer picked",
+		"offer_id", offer.ID,
+		"payment_method", method,
+	)
+
+	return w.payer.PayOffer(ctx, response, offer, method)
+}
+
+// PaymentMethods implements MethodWallet
+func (w *PickerWallet) PaymentMethods() []l402.PaymentMethods {
+	if w.payer == nil {
+		return nil
+	}
+	return w.payer.PaymentMethods()
+}
+
+// PayOffer implements MethodWallet, paying an already chosen offer without
+// asking anything.
+func (w *PickerWallet) PayOffer(ctx context.Context, response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods) (*l402.PaymentResult, error) {
+	if w.payer == nil {
+		return nil, unsupportedMethod(method)
+	}
+	return w.payer.PayOffer(ctx, response, offer, method)
+}
+
+// PrintOffers writes the offers as a table
+func PrintOffers(out io.Writer, offers []l402.Offer) {
+	header, rows := offerTable(offers)
+	fmt.Fprintln(out, "  "+header)
+	for _, row := range rows {
+		fmt.Fprintln(out, "  "+row)
+	}
+}
+
+// offerTable renders offers as aligned text rows
+func offerTable(offers []l402.Offer) (string, []string) {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tPRICE\tTYPE\tMETHODS")
+	for _, o := range offers {
+		typ := string(o.Type)
+		if o.Type == l402.TopUp && o.Balance > 0 {
+			typ += fmt.Sprintf(" (+%d credits)", o.Balance)
+		}
+		methods := make([]string, len(o.PaymentMethods))
+		for i, m := range o.PaymentMethods {
+			methods[i] = string(m)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", o.ID, o.Title,
+			l402.FormatPrice(o.Amount, o.Currency), typ, strings.Join(methods, ", "))
+	}
+	tw.Flush()
+
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	return lines[0], lines[1:]
+}
+
+// choose asks the user to pick one of items and returns its index. Disabled
+// items are shown but can't be picked.
+func (w *PickerWallet) choose(title, header string, items []string, disabled []bool) (int, error) {
+	isDisabled := func(i int) bool {
+		return disabled != nil && disabled[i]
+	}
+
+	if !term.IsTerminal(int(w.in.Fd())) {
+		return w.prompt(title, header, items, isDisabled)
+	}
+
+	state, err := term.MakeRaw(int(w.in.Fd()))
+	if err != nil {
+		return w.prompt(title, header, items, isDisabled)
+	}
+	defer term.Restore(int(w.in.Fd()), state)
+
+	cursor := 0
+	for cursor < len(items) && isDisabled(cursor) {
+		cursor++
+	}
+
+	// move advances the cursor by step, skipping disabled items
+	move := func(step int) {
+		for next := cursor + step; next >= 0 && next < len(items); next += step {
+			if !isDisabled(next) {
+				cursor = next
+				return
+			}
+		}
+	}
+
+	// In raw mode the terminal doesn't return the carriage on newlines
+	fmt.Fprintf(w.out, "%s (↑/↓ or j/k, enter to select, q to cancel)\r\n", title)
+	lines := len(items)
+	if header != "" {
+		fmt.Fprintf(w.out, "    %s\r\n", header)
+	}
+
+	render := func(first bool) {
+		if !first {
+			fmt.Fprintf(w.out, "\x1b[%dA", lines)
+		}
+		for i, item := range items {
+			marker := "  "
+			if i == cursor {
+				marker = "> "
+			}
+			if isDisabled(i) {
+				item = "\x1b[2m" + item + "\x1b[0m"
+			} else if i == cursor {
+				item = "\x1b[1m" + item + "\x1b[0m"
+			}
+			fmt.Fprintf(w.out, "\r\x1b[2K%s%d %s\r\n", marker, i+1, item)
+		}
+	}
+	render(true)
+
+	buf := make([]byte, 8)
+	for {
+		n, err := w.in.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		key := buf[:n]
+
+		switch {
+		case bytes.Equal(key, []byte("\x1b[A")), bytes.Equal(key, []byte("k")):
+			move(-1)
+		case bytes.Equal(key, []byte("\x1b[B")), bytes.Equal(key, []byte("j")):
+			move(1)
+		case key[0] == '\r' || key[0] == '\n':
+			if cursor < len(items) && !isDisabled(cursor) {
+				return cursor, nil
+			}
+		case key[0] == 'q' || key[0] == 3 || bytes.Equal(key, []byte("\x1b")):
+			return 0, ErrPickerCancelled
+		case key[0] >= '1' && key[0] <= '9':
+			if i := int(key[0] - '1'); i < len(items) && !isDisabled(i) {
+				cursor = i
+			}
+		}
+		render(false)
+	}
+}
+
+// prompt is the fallback of choose when stdin is not a terminal
+func (w *PickerWallet) prompt(title, header string, items []string, isDisabled func(int) bool) (int, error) {
+	fmt.Fprintln(w.out, title)
+	if header != "" {
+		fmt.Fprintf(w.out, "    %s\n", header)
+	}
+	for i, item := range items {
+		fmt.Fprintf(w.out, "  %d %s\n", i+1, item)
+	}
+
+	for {
+		fmt.Fprintf(w.out, "Select [1-%d, q to cancel]: ", len(items))
+		line, err := w.readLine()
+		if err != nil && line == "" {
+			return 0, ErrPickerCancelled
+		}
+		if line == "q" {
+			return 0, ErrPickerCancelled
+		}
+
+		n, convErr := strconv.Atoi(line)
+		if convErr == nil && n >= 1 && n <= len(items) && !isDisabled(n-1) {
+			return n - 1, nil
+		}
+		if err != nil {
+			return 0, ErrPickerCancelled
+		}
+		fmt.Fprintln(w.out, "Invalid choice")
+	}
+}
+
+// readLine reads a line byte by byte so that nothing after it is consumed
+// from stdin, later prompts may still need it.
+func (w *PickerWallet) readLine() (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := w.in.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			return strings.TrimSpace(string(line)), err
+		}
+	}
+	return strings.TrimSpace(string(line)), nil
+}
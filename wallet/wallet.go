@@ -0,0 +1,152 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/l402-protocol/go-example/l402"
+)
+
+// MethodWallet is a wallet that can pay an already selected offer with a
+// specific payment method. Wallets implementing it can be combined in a
+// CompositeWallet.
+type MethodWallet interface {
+	// PaymentMethods returns the payment methods the wallet can pay with
+	PaymentMethods() []l402.PaymentMethods
+
+	// PayOffer pays offer using method
+	PayOffer(ctx context.Context, response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods) (*l402.PaymentResult, error)
+}
+
+// RetryableError marks a failure where another wallet or payment method may
+// still succeed, e.g. the gateway not supporting a method or a wallet running
+// out of funds.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable wraps err in a RetryableError
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err}
+}
+
+// IsRetryable reports whether err, or any error it wraps, is retryable
+func IsRetryable(err error) bool {
+	var r *RetryableError
+	return errors.As(err, &r)
+}
+
+func unsupportedMethod(method l402.PaymentMethods) error {
+	return Retryable(fmt.Errorf("payment method %s not supported by wallet", method))
+}
+
+// newResult returns a payment result for the full offer amount
+func newResult(response *l402.L402Response, offer l402.Offer, method l402.PaymentMethods, status l402.SettlementStatus) *l402.PaymentResult {
+	return &l402.PaymentResult{
+		OfferID:             offer.ID,
+		PaymentContextToken: response.PaymentContextToken,
+		Method:              method,
+		Amount:              offer.Amount,
+		Currency:            offer.Currency,
+		Status:              status,
+	}
+}
+
+// findOffer returns the offer with the given ID from an L402 response
+func findOffer(response *l402.L402Response, offerID string) (*l402.Offer, error) {
+	for _, o := range response.Offers {
+		if o.ID == offerID {
+			return &o, nil
+		}
+	}
+	return nil, fmt.Errorf("offer %s not found", offerID)
+}
+
+// paymentRequestAttempts is how often a payment request is tried while the
+// gateway is unreachable or failing
+const paymentRequestAttempts = 3
+
+// requestPayment asks the gateway for the payment details of an offer
+func requestPayment(ctx context.Context, paymentRequestURL string, payReq l402.PaymentRequestRequest) (*l402.PaymentRequestResponse, error) {
+	body, err := json.Marshal(payReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payment request: %w", err)
+	}
+
+	// Make payment request to gateway. Retries of a failed request reuse the
+	// idempotency key so the gateway answers them like the first.
+	key := uuid.NewString()
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		resp, err = postPaymentRequest(ctx, paymentRequestURL, body, key)
+		if err == nil && !transientStatus(resp.StatusCode) || attempt == paymentRequestAttempts {
+			break
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * 200 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		return nil, Retryable(fmt.Errorf("failed to make payment request: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		err := fmt.Errorf("payment request failed with status %d: %s", resp.StatusCode, string(body))
+
+		// Only a gateway that is down or busy may do better on another try.
+		// Rejected requests fail the same way everywhere.
+		if transientStatus(resp.StatusCode) {
+			return nil, Retryable(err)
+		}
+		return nil, err
+	}
+
+	// Parse payment request response
+	var payResp l402.PaymentRequestResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payResp); err != nil {
+		return nil, fmt.Errorf("failed to decode payment response: %w", err)
+	}
+	return &payResp, nil
+}
+
+// transientStatus reports whether a response status means the gateway may
+// answer the same request differently later
+func transientStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+func postPaymentRequest(ctx context.Context, paymentRequestURL string, body []byte, key string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentRequestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,177 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SignatureHeader carries the timestamp and signatures of a webhook, e.g.
+// "t=1700000000,v1=5257a8...,v1=9f86d0...". There is one v1 signature per
+// active secret so receivers can rotate secrets without downtime.
+const SignatureHeader = "L402-Signature"
+
+// DefaultTolerance is how old a webhook may be before it is rejected
+const DefaultTolerance = 5 * time.Minute
+
+// DevSecret is shared by the example gateway and server so they work out of
+// the box. Never use it outside development.
+const DevSecret = "whsec_l402_example_development_only"
+
+// maxBodySize bounds the webhook bodies VerifyRequest reads
+const maxBodySize = 1 << 20
+
+var (
+	ErrNoSignature      = errors.New("webhook is not signed")
+	ErrInvalidHeader    = errors.New("invalid webhook signature header")
+	ErrTooOld           = errors.New("webhook timestamp is outside the tolerance")
+	ErrInvalidSignature = errors.New("webhook signature does not match")
+	ErrReplayed         = errors.New("webhook was already received")
+	ErrNoSecrets        = errors.New("no webhook secrets configured")
+)
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" under secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Header returns the SignatureHeader value of body sent at t, signed with
+// every secret
+func Header(secrets []string, t time.Time, body []byte) string {
+	ts := t.Unix()
+	parts := []string{"t=" + strconv.FormatInt(ts, 10)}
+	for _, secret := range secrets {
+		parts = append(parts, "v1="+Sign(secret, ts, body))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseHeader returns the timestamp and v1 signatures of a header
+func parseHeader(header string) (int64, []string, error) {
+	var (
+		ts         int64
+		signatures []string
+		err        error
+	)
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return 0, nil, ErrInvalidHeader
+		}
+		switch key {
+		case "t":
+			ts, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return 0, nil, ErrInvalidHeader
+			}
+		case "v1":
+			signatures = append(signatures, value)
+		}
+		// Unknown schemes are skipped for forward compatibility
+	}
+	if ts == 0 || len(signatures) == 0 {
+		return 0, nil, ErrInvalidHeader
+	}
+	return ts, signatures, nil
+}
+
+// Verifier checks webhook signatures. Any of its secrets may have signed a
+// webhook, so a new secret can be added before the sender switches to it.
+// Signatures already seen within the tolerance are rejected as replays.
+type Verifier struct {
+	secrets   []string
+	tolerance time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time // signature -> when it can be forgotten
+}
+
+// NewVerifier creates a verifier accepting webhooks signed with one of
+// secrets at most tolerance ago. A zero tolerance uses DefaultTolerance.
+func NewVerifier(tolerance time.Duration, secrets ...string) *Verifier {
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+	return &Verifier{
+		secrets:   secrets,
+		tolerance: tolerance,
+		seen:      make(map[string]time.Time),
+	}
+}
+
+// Verify checks the SignatureHeader value of body
+func (v *Verifier) Verify(header string, body []byte) error {
+	if len(v.secrets) == 0 {
+		return ErrNoSecrets
+	}
+	if header == "" {
+		return ErrNoSignature
+	}
+	ts, signatures, err := parseHeader(header)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	sent := time.Unix(ts, 0)
+	if sent.Before(now.Add(-v.tolerance)) || sent.After(now.Add(v.tolerance)) {
+		return fmt.Errorf("%w: sent at %s", ErrTooOld, sent.UTC().Format(time.RFC3339))
+	}
+
+	match := ""
+	for _, secret := range v.secrets {
+		expected := Sign(secret, ts, body)
+		for _, sig := range signatures {
+			if hmac.Equal([]byte(expected), []byte(sig)) {
+				match = expected
+			}
+		}
+	}
+	if match == "" {
+		return ErrInvalidSignature
+	}
+
+	return v.remember(match, sent.Add(v.tolerance), now)
+}
+
+// remember records a valid signature until it falls out of the tolerance,
+// after which its timestamp alone rejects it
+func (v *Verifier) remember(signature string, until, now time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for sig, expiry := range v.seen {
+		if now.After(expiry) {
+			delete(v.seen, sig)
+		}
+	}
+	if _, ok := v.seen[signature]; ok {
+		return ErrReplayed
+	}
+	v.seen[signature] = until
+	return nil
+}
+
+// VerifyRequest reads the body of a webhook request and verifies it
+func (v *Verifier) VerifyRequest(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook body: %w", err)
+	}
+	if err := v.Verify(r.Header.Get(SignatureHeader), body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}